@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//defaultAccount is the account transactions are recorded in when none is given
+const defaultAccount = "main"
+
+//summaryUser is the user older versions recorded period summaries by. The
+//summaries carried the balance over to the next period, opening balances
+//are now computed from the journal instead.
+const summaryUser = "Server"
+
+//Account is a named pool of money, like a checking account, a credit card or cash
+type Account struct {
+	Name    string
+	Created Timestamp
+	Creator string
+}
+
+//Json returns the Account as a Json Encoded string
+func (a *Account) Json() (string, error) {
+	return toJsonString(a)
+}
+
+//accountExists returns whether name is the default account or one that was added
+func (h *Handler) accountExists(name string) (bool, error) {
+	if name == "" || name == defaultAccount {
+		return true, nil
+	}
+	a, err := h.db.GetAccount(name)
+	return a != nil, err
+}
+
+//checkAccounts replies to msg and returns false if any of names isn't an account
+func (h *Handler) checkAccounts(msg chat1.MsgSummary, names ...string) (bool, error) {
+	for _, name := range names {
+		ok, err := h.accountExists(name)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			h.ReactQuestion(msg)
+			h.ChatEcho(msg.ConvID, "I don't know the account `%s`, add it with `account add %s`.", name, name)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//noteOrAccount returns the args of a spent or received command. Words like
+//`from the market` only name an account if it exists, otherwise they're put
+//back at the start of the note.
+func (h *Handler) noteOrAccount(args *Args) (*Args, error) {
+	if args.Account == "" {
+		return args, nil
+	}
+	ok, err := h.accountExists(args.Account)
+	if err != nil || ok {
+		return args, err
+	}
+	c := args.clone()
+	c.Account = ""
+	c.Note = strings.TrimSpace(args.AccountWords + " " + args.Note)
+	return c, nil
+}
+
+//accountOf returns the name an account is stored as in a Txn
+func accountOf(name string) string {
+	if name == defaultAccount {
+		return ""
+	}
+	return name
+}
+
+//HandleAccountAdd adds an account transactions can be recorded in
+func (h *Handler) HandleAccountAdd(args *Args, msg chat1.MsgSummary) error {
+	name := strings.ToLower(args.Tags[0])
+	if ok, err := h.accountExists(name); err != nil || ok {
+		if err == nil {
+			h.ReactQuestion(msg)
+			h.ChatEcho(msg.ConvID, "There's already an account called `%s`.", name)
+		}
+		return err
+	}
+	if err := h.db.PutAccount(Account{name, TimestampNow(), msg.Sender.Username}); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactSuccess(msg)
+	return nil
+}
+
+//HandleTransfer moves money between two accounts. It's recorded as a pair of
+//transactions that aren't counted as spending or income.
+func (h *Handler) HandleTransfer(args *Args, msg chat1.MsgSummary) error {
+	from, to := strings.ToLower(args.Words[0]), strings.ToLower(args.Words[1])
+	if ok, err := h.checkAccounts(msg, from, to); err != nil || !ok {
+		return err
+	}
+	if from == to {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "%s", "A transfer needs two different accounts.")
+		return nil
+	}
+	now := TimestampNow()
+	txns := []Txn{
+		{Date: now, Amount: -args.Amount, Tags: []string{}, Note: args.Note, User: msg.Sender.Username, Account: accountOf(from), Transfer: true},
+		{Date: now, Amount: args.Amount, Tags: []string{}, Note: args.Note, User: msg.Sender.Username, Account: accountOf(to), Transfer: true},
+	}
+	if err := h.db.PutTransactions(txns); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactSuccess(msg)
+	return nil
+}
+
+//accountNames returns the names of the accounts and of any others with a
+//balance, the default one first and the rest in alphabetical order
+func accountNames(accounts []Account, balances map[string]USD) []string {
+	names := []string{defaultAccount}
+	for _, a := range accounts {
+		names = append(names, a.Name)
+	}
+	for name := range balances {
+		if !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+//balancesString lists the balance of every account, the default one first,
+//and the net worth
+func balancesString(accounts []Account, balances map[string]USD) string {
+	names := accountNames(accounts, balances)
+	if len(names) == 1 {
+		return fmt.Sprintf("current balance is **%s**", signed(balances[defaultAccount]))
+	}
+	var (
+		b     strings.Builder
+		worth USD
+	)
+	b.WriteString("*Balances*\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, ">%s: %s\n", name, signed(balances[name]))
+		worth += balances[name]
+	}
+	fmt.Fprintf(&b, "net worth is **%s**", signed(worth))
+	return b.String()
+}
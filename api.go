@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//APIConfig configures the optional HTTP API
+type APIConfig struct {
+	Listen    string            `toml:"listen"`    //address the API is served on ie: :8080, empty disables it (KST_API_LISTEN)
+	Tokens    map[string]string `toml:"tokens"`    //the token each user authenticates with (KST_API_TOKENS as user=token,...)
+	Dashboard bool              `toml:"dashboard"` //whether to serve the read-only dashboard at / (KST_DASHBOARD)
+}
+
+//minTokenLength is the shortest token the API accepts
+const minTokenLength = 16
+
+//maxRequestSize is the largest request body the API reads
+const maxRequestSize = 1 << 20
+
+//API serves the ledger over HTTP as JSON. Requests are authenticated with
+//a bearer token that identifies the user. Amounts are strings of dollars
+//and cents ie: "-45.20" so they don't lose precision.
+type API struct {
+	*Output
+	h      *Handler
+	rec    *Handler          //records transactions offline so the reply to the command can be returned
+	recMu  sync.Mutex        //held while rec records a transaction and its reply is read
+	tokens map[string]string //users by token
+	mux    *http.ServeMux
+}
+
+//NewAPI returns an API for the handler's database, tokens maps users to
+//the token they authenticate with
+func NewAPI(h *Handler, tokens map[string]string) *API {
+	rec := NewHandler(nil, h.db, "")
+	a := &API{
+		Output: NewDebugOutput("api", nil, ""),
+		h:      h,
+		rec:    &rec,
+		tokens: make(map[string]string, len(tokens)),
+		mux:    http.NewServeMux(),
+	}
+	for user, token := range tokens {
+		a.tokens[token] = user
+	}
+	a.handle("/api/transactions", a.handleTransactions)
+	a.handle("/api/balance", a.handleBalance)
+	a.handle("/api/tags", a.handleTags)
+	a.handle("/api/tags/balances", a.handleTagBalances)
+	return a
+}
+
+//apiError is an error with the status it's responded with
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+//badRequest returns an error responded to with 400 Bad Request
+func badRequest(msg string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(msg, args...)}
+}
+
+//handle registers an endpoint that responds with the value it returns as
+//JSON, or with the error it returns
+func (a *API) handle(pattern string, endpoint func(user string, r *http.Request) (int, interface{}, error)) {
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		user, ok := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kst"`)
+			a.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or unknown token"})
+			return
+		}
+		status, v, err := endpoint(user, r)
+		if err != nil {
+			var aerr *apiError
+			if !errors.As(err, &aerr) {
+				a.Debug("%s %s: %s", r.Method, r.URL.Path, err)
+				aerr = &apiError{http.StatusInternalServerError, "internal error"}
+			}
+			a.writeJSON(w, aerr.status, map[string]string{"error": aerr.msg})
+			return
+		}
+		a.writeJSON(w, status, v)
+	})
+}
+
+//ServeHTTP routes requests to the API's endpoints
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+//authenticate returns the user the request's token belongs to, sent with or
+//without the Bearer scheme. Browsers send the token as the password of the
+//user it belongs to.
+func (a *API) authenticate(r *http.Request) (string, bool) {
+	if usr, token, ok := r.BasicAuth(); ok {
+		user, ok := a.tokenUser(token)
+		return user, ok && user == usr
+	}
+	//the Bearer scheme is optional
+	return a.tokenUser(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+//tokenUser returns the user token belongs to
+func (a *API) tokenUser(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	for t, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+//writeJSON responds with v encoded as JSON
+func (a *API) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.Debug("writeJSON: failed to write response: %s", err)
+	}
+}
+
+//ListenAndServe serves the API on addr until ctx is cancelled, and returns
+//once the requests being served have finished
+func (a *API) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: a, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			a.Debug("ListenAndServe: error shutting down: %s", err)
+		}
+	}()
+	a.Debug("listening on %s", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
+
+//decimal formats an amount as dollars and cents without a currency symbol ie: -45.20
+func decimal(m USD) string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+	}
+	m = m.Abs()
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+//apiTxn is a transaction as the API responds with it
+type apiTxn struct {
+	ID       int64     `json:"id"`
+	Date     time.Time `json:"date"`
+	Amount   string    `json:"amount"`
+	Tags     []string  `json:"tags"`
+	Note     string    `json:"note"`
+	User     string    `json:"user"`
+	Account  string    `json:"account"`
+	Transfer bool      `json:"transfer"`
+	Cleared  bool      `json:"cleared"`
+	Receipt  bool      `json:"receipt"`
+}
+
+func newAPITxn(t Txn) apiTxn {
+	return apiTxn{t.ID, t.Date.Time().In(location), decimal(t.Amount), t.Tags, t.Note, t.User, t.AccountName(), t.Transfer, t.Cleared, t.Receipt != nil}
+}
+
+//apiNewTxn is the body of a request to record a transaction
+type apiNewTxn struct {
+	Type    string   `json:"type"`   //spent or received
+	Amount  string   `json:"amount"` //ie: 45.20
+	Tags    []string `json:"tags"`
+	Note    string   `json:"note"`
+	Account string   `json:"account"` //empty for the default account
+}
+
+//noteQuoter escapes a note so it's read as a single quoted string
+var noteQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "“", "\\“", "”", "\\”")
+
+//command returns the spent or received chat command that records the
+//transaction ie: spent 45.20 on hardware from visa "deck screws"
+func (n *apiNewTxn) command() string {
+	words := []string{n.Type, n.Amount, "on", strings.Join(n.Tags, ", ")}
+	if n.Type == "received" {
+		words[2] = "from"
+	}
+	if n.Account != "" {
+		words = append(words, "from", n.Account)
+		if n.Type == "received" {
+			words[len(words)-2] = "into"
+		}
+	}
+	if n.Note != "" {
+		words = append(words, `"`+noteQuoter.Replace(n.Note)+`"`)
+	}
+	return strings.Join(words, " ")
+}
+
+//args parses the transaction with the grammar of the spent or received
+//command, so it's validated the way they are in chat
+func (n *apiNewTxn) args(h *Handler) (*Args, error) {
+	if n.Type != "spent" && n.Type != "received" {
+		return nil, badRequest("type must be spent or received")
+	}
+	args, err := h.findCommand([]string{n.Type}).Parse(n.command())
+	if perr, ok := err.(*ParseError); ok {
+		return nil, badRequest("invalid transaction: %s", perr.Msg)
+	} else if err != nil {
+		return nil, err
+	}
+	//a tag or account the grammar read as something else isn't one
+	if strings.Join(args.Tags, ",") != strings.Join(n.Tags, ",") {
+		return nil, badRequest("invalid tags %q, tags may only contain letters, numbers, - and _", n.Tags)
+	}
+	if args.Account != strings.ToLower(n.Account) {
+		return nil, badRequest("invalid account %q", n.Account)
+	}
+	return args, nil
+}
+
+//queryRange returns the range of time between the from and to parameters,
+//which default to the current period
+func queryRange(r *http.Request) (time.Time, time.Time, error) {
+	t1, t2 := StartOfPeriod(), EndOfPeriod()
+	if from := r.URL.Query().Get("from"); from != "" {
+		d, ok := parseDate(from)
+		if !ok {
+			return t1, t2, badRequest("invalid from %q, expected a month or a date like 2026-10-15", from)
+		}
+		t1 = d[0]
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		d, ok := parseDate(to)
+		if !ok {
+			return t1, t2, badRequest("invalid to %q, expected a month or a date like 2026-10-15", to)
+		}
+		t2 = d[1]
+	}
+	return t1, t2, nil
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return &apiError{http.StatusMethodNotAllowed, r.Method + " is not allowed"}
+}
+
+//handleTransactions lists the transactions between from and to, or records one
+func (a *API) handleTransactions(user string, r *http.Request) (int, interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		t1, t2, err := queryRange(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		txns, err := a.h.db.GetTransactions(t1, t2)
+		if err != nil {
+			return 0, nil, err
+		}
+		res := make([]apiTxn, len(txns))
+		for i, t := range txns {
+			res[i] = newAPITxn(t)
+		}
+		return http.StatusOK, res, nil
+	case http.MethodPost:
+		var n apiNewTxn
+		dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&n); err != nil {
+			return 0, nil, badRequest("invalid transaction: %v", err)
+		}
+		a.recMu.Lock()
+		defer a.recMu.Unlock()
+		h := a.rec
+		var out strings.Builder
+		h.SetConsole(&out)
+		flagged := h.Flagged()
+		args, err := n.args(h)
+		if err != nil {
+			return 0, nil, err
+		}
+		ok, err := h.accountExists(args.Account)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			return 0, nil, badRequest("unknown account %q", args.Account)
+		}
+		msg := chat1.MsgSummary{
+			Sender:  chat1.MsgSender{Username: user},
+			Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MessageText{Body: n.command()}},
+		}
+		txn := spentTxn(args, msg)
+		if n.Type == "received" {
+			txn = receivedTxn(args, msg)
+		}
+		if txn.ID, err = h.record(txn, msg); err != nil {
+			return 0, nil, err
+		}
+		if h.Flagged() > flagged {
+			return 0, nil, badRequest("%s", strings.TrimSpace(out.String()))
+		}
+		return http.StatusCreated, newAPITxn(txn), nil
+	}
+	return 0, nil, methodNotAllowed(r)
+}
+
+//handleBalance responds with the balance of every account and the net worth
+//at the end of the at parameter, or now
+func (a *API) handleBalance(user string, r *http.Request) (int, interface{}, error) {
+	if r.Method != http.MethodGet {
+		return 0, nil, methodNotAllowed(r)
+	}
+	at := time.Now()
+	if s := r.URL.Query().Get("at"); s != "" {
+		d, ok := parseDate(s)
+		if !ok {
+			return 0, nil, badRequest("invalid at %q, expected a month or a date like 2026-10-15", s)
+		}
+		at = d[1]
+	}
+	accounts, err := a.h.db.GetAccounts()
+	if err != nil {
+		return 0, nil, err
+	}
+	balances, err := a.h.db.GetAccountBalances(at)
+	if err != nil {
+		return 0, nil, err
+	}
+	res := struct {
+		At       time.Time         `json:"at"`
+		Accounts map[string]string `json:"accounts"`
+		NetWorth string            `json:"net_worth"`
+	}{at.In(location), map[string]string{defaultAccount: decimal(0)}, ""}
+	for _, acct := range accounts {
+		res.Accounts[acct.Name] = decimal(0)
+	}
+	var worth USD
+	for name, bal := range balances {
+		res.Accounts[name] = decimal(bal)
+		worth += bal
+	}
+	res.NetWorth = decimal(worth)
+	return http.StatusOK, res, nil
+}
+
+//handleTags lists every tag that has been used
+func (a *API) handleTags(user string, r *http.Request) (int, interface{}, error) {
+	if r.Method != http.MethodGet {
+		return 0, nil, methodNotAllowed(r)
+	}
+	tags, err := a.h.db.GetTags()
+	if tags == nil {
+		tags = []string{}
+	}
+	return http.StatusOK, tags, err
+}
+
+//apiTagBalance is what was spent on or received from a tag in total and by each user
+type apiTagBalance struct {
+	Tag   string            `json:"tag"`
+	Total string            `json:"total"`
+	Users map[string]string `json:"users"`
+}
+
+//handleTagBalances responds with the balance of every tag between from and
+//to, or of the tag parameter
+func (a *API) handleTagBalances(user string, r *http.Request) (int, interface{}, error) {
+	if r.Method != http.MethodGet {
+		return 0, nil, methodNotAllowed(r)
+	}
+	t1, t2, err := queryRange(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var tbs []*TagBalance
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		tb, err := a.h.db.GetTagBalance(tag, t1, t2)
+		if err != nil {
+			return 0, nil, err
+		}
+		tbs = []*TagBalance{tb}
+	} else if tbs, err = a.h.db.GetTagBalances(t1, t2); err != nil {
+		return 0, nil, err
+	}
+	res := []apiTagBalance{}
+	for _, tb := range tbs {
+		if len(tb.usrs) == 0 {
+			continue
+		}
+		b := apiTagBalance{tb.tag, decimal(tb.Total()), make(map[string]string, len(tb.usrs))}
+		for usr, bal := range tb.usrs {
+			b.Users[usr] = decimal(bal)
+		}
+		res = append(res, b)
+	}
+	return http.StatusOK, res, nil
+}
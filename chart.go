@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	chartWidth  = 640
+	chartHeight = 400
+	//maxSlices is how many slices a pie chart has before the rest are grouped as other
+	maxSlices = 7
+)
+
+//ChartKind is the way a chart draws its data
+type ChartKind string
+
+const (
+	BarChart  ChartKind = "bar"
+	LineChart ChartKind = "line"
+	PieChart  ChartKind = "pie"
+)
+
+var (
+	chartBackground = color.RGBA{255, 255, 255, 255}
+	chartInk        = color.RGBA{40, 40, 40, 255}
+	chartGrid       = color.RGBA{225, 225, 225, 255}
+	chartPalette    = []color.RGBA{
+		{51, 160, 255, 255},
+		{255, 112, 67, 255},
+		{76, 175, 80, 255},
+		{255, 193, 7, 255},
+		{156, 39, 176, 255},
+		{0, 188, 212, 255},
+		{233, 30, 99, 255},
+		{158, 158, 158, 255},
+	}
+)
+
+//Chart is a titled series of labelled amounts
+type Chart struct {
+	Kind   ChartKind
+	Title  string
+	Labels []string
+	Values []USD
+}
+
+//Total returns the sum of the chart's values
+func (c *Chart) Total() USD {
+	var total USD
+	for _, v := range c.Values {
+		total += v
+	}
+	return total
+}
+
+//Render draws the chart
+func (c *Chart) Render() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chartBackground), image.Point{}, draw.Src)
+	drawText(img, (chartWidth-textWidth(c.Title))/2, 24, c.Title, chartInk)
+	if c.Kind == PieChart {
+		c.drawPie(img)
+	} else {
+		c.drawSeries(img)
+	}
+	return img
+}
+
+//WritePNG renders the chart as a PNG file in dir, returning its path
+func (c *Chart) WritePNG(dir string) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s-chart.png", c.Kind))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err := png.Encode(f, c.Render()); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+//drawSeries draws the values over time as bars or a line
+func (c *Chart) drawSeries(img *image.RGBA) {
+	const left, right, top, bottom = 80, 20, 48, 40
+	plot := image.Rect(left, top, chartWidth-right, chartHeight-bottom)
+	var max USD
+	for _, v := range c.Values {
+		if v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		max = 100
+	}
+	y := func(v USD) int {
+		return plot.Max.Y - int(float64(plot.Dy())*v.InDollars()/max.InDollars())
+	}
+
+	const gridLines = 4
+	for i := 0; i <= gridLines; i++ {
+		v := max.Times(float64(i) / gridLines)
+		fillRect(img, image.Rect(plot.Min.X, y(v), plot.Max.X, y(v)+1), chartGrid)
+		label := v.String()
+		drawText(img, plot.Min.X-8-textWidth(label), y(v)+4, label, chartInk)
+	}
+
+	slot := float64(plot.Dx()) / float64(len(c.Values))
+	//skip labels so they don't overlap
+	every := 1 + len(c.Values)*textWidth("Jan 06")/plot.Dx()
+	var prev image.Point
+	for i, v := range c.Values {
+		x := plot.Min.X + int(slot*float64(i)+slot/2)
+		pt := image.Pt(x, y(v))
+		if c.Kind == LineChart {
+			if i > 0 {
+				drawLine(img, prev, pt, chartPalette[0])
+			}
+			fillRect(img, image.Rect(x-3, pt.Y-3, x+4, pt.Y+4), chartPalette[0])
+			prev = pt
+		} else {
+			half := int(slot * 0.3)
+			fillRect(img, image.Rect(x-half, pt.Y, x+half+1, plot.Max.Y), chartPalette[0])
+		}
+		if i%every == 0 {
+			drawText(img, x-textWidth(c.Labels[i])/2, plot.Max.Y+18, c.Labels[i], chartInk)
+		}
+	}
+	fillRect(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+1), chartInk)
+}
+
+//drawPie draws the values as slices of a pie with a legend beside it
+func (c *Chart) drawPie(img *image.RGBA) {
+	const cx, cy, r = 190, 215, 150
+	total := c.Total().InDollars()
+	if total <= 0 {
+		return
+	}
+	//the angle each slice ends at, clockwise from 12 o'clock
+	ends := make([]float64, len(c.Values))
+	var sum float64
+	for i, v := range c.Values {
+		sum += v.InDollars()
+		ends[i] = 2 * math.Pi * sum / total
+	}
+	for py := cy - r; py <= cy+r; py++ {
+		for px := cx - r; px <= cx+r; px++ {
+			dx, dy := float64(px-cx), float64(py-cy)
+			if dx*dx+dy*dy > r*r {
+				continue
+			}
+			angle := math.Atan2(dx, -dy)
+			if angle < 0 {
+				angle += 2 * math.Pi
+			}
+			i := sort.SearchFloat64s(ends, angle)
+			if i >= len(ends) {
+				i = len(ends) - 1
+			}
+			img.SetRGBA(px, py, chartPalette[i%len(chartPalette)])
+		}
+	}
+
+	for i, v := range c.Values {
+		ly := 90 + i*24
+		fillRect(img, image.Rect(380, ly-10, 392, ly+2), chartPalette[i%len(chartPalette)])
+		label := fmt.Sprintf("%s %s (%.0f%%)", c.Labels[i], v, v.InDollars()/total*100)
+		drawText(img, 400, ly, label, chartInk)
+	}
+}
+
+func fillRect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+//drawLine draws a 3 pixel wide line from a to b
+func drawLine(img *image.RGBA, a, b image.Point, c color.RGBA) {
+	steps := int(math.Max(math.Abs(float64(b.X-a.X)), math.Abs(float64(b.Y-a.Y))))
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / math.Max(float64(steps), 1)
+		x := a.X + int(math.Round(t*float64(b.X-a.X)))
+		y := a.Y + int(math.Round(t*float64(b.Y-a.Y)))
+		fillRect(img, image.Rect(x-1, y-1, x+2, y+2), c)
+	}
+}
+
+//drawText draws s with its baseline starting at x, y
+func drawText(img *image.RGBA, x, y int, s string, c color.RGBA) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+func textWidth(s string) int {
+	return font.MeasureString(basicfont.Face7x13, s).Ceil()
+}
+
+//spendingPerPeriod returns the spending in each period starting at starts,
+//on tag if it isn't empty
+func spendingPerPeriod(txns []Txn, starts []time.Time, unit Period, tag string) ([]string, []USD) {
+	labels, values := make([]string, len(starts)), make([]USD, len(starts))
+	for i, start := range starts {
+		labels[i] = start.Format("Jan 06")
+		if unit == Weekly {
+			labels[i] = start.Format("Jan 2")
+		}
+	}
+	for _, txn := range txns {
+		if txn.Amount >= 0 || (tag != "" && !contains(txn.Tags, tag)) {
+			continue
+		}
+		i := sort.Search(len(starts), func(i int) bool { return starts[i].After(txn.Date.Time()) }) - 1
+		if i >= 0 {
+			values[i] -= txn.Amount
+		}
+	}
+	return labels, values
+}
+
+//spendingShares returns the spending per tag, or per user on tag if it
+//isn't empty, largest first with the smallest grouped as other
+func spendingShares(txns []Txn, tag string) ([]string, []USD) {
+	shares := make(map[string]USD)
+	for _, txn := range txns {
+		if txn.Amount >= 0 {
+			continue
+		}
+		switch {
+		case tag != "" && contains(txn.Tags, tag):
+			shares["@"+txn.User] -= txn.Amount
+		case tag == "" && len(txn.Tags) > 0:
+			//only the first tag so the slices add up to what was spent
+			shares[txn.Tags[0]] -= txn.Amount
+		}
+	}
+	amts := sortedAmounts(shares)
+	if len(amts) > maxSlices {
+		other := Amount{Name: "other"}
+		for _, a := range amts[maxSlices-1:] {
+			other.Amount += a.Amount
+		}
+		amts = append(amts[:maxSlices-1], other)
+	}
+	labels, values := make([]string, len(amts)), make([]USD, len(amts))
+	for i, a := range amts {
+		labels[i], values[i] = a.Name, a.Amount
+	}
+	return labels, values
+}
+
+//HandleChart uploads a chart of spending over a span of periods, or of
+//how spending was shared between tags or users
+func (h *Handler) HandleChart(args *Args, msg chat1.MsgSummary) error {
+	c := &Chart{Kind: BarChart}
+	if len(args.Keywords) > 0 {
+		c.Kind = ChartKind(args.Keywords[0])
+	}
+	var tag string
+	if len(args.Tags) > 0 {
+		tag = args.Tags[0]
+	}
+	s := args.Span
+	if s == nil {
+		s = &Span{Count: 6, Unit: Monthly}
+		if c.Kind == PieChart {
+			s = &Span{Count: 1, Unit: period}
+		}
+	}
+	starts := s.Starts(time.Now())
+	txns, err := h.db.GetTransactions(starts[0], s.Unit.End(starts[len(starts)-1]))
+	if err != nil {
+		return err
+	}
+
+	var on string
+	if tag != "" {
+		on = " on " + tag
+	}
+	subject := "Spending" + on
+	if c.Kind == PieChart {
+		c.Labels, c.Values = spendingShares(txns, tag)
+		if tag == "" {
+			subject += " by tag"
+		} else {
+			subject += " by user"
+		}
+	} else {
+		c.Labels, c.Values = spendingPerPeriod(txns, starts, s.Unit, tag)
+	}
+	c.Title = fmt.Sprintf("%s, %s", subject, s)
+	if c.Total() == 0 {
+		h.ChatEcho(msg.ConvID, "Nothing was spent%s %s.", on, s)
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "kst-chart")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path, err := c.WritePNG(dir)
+	if err != nil {
+		return err
+	}
+	return h.Attach(msg.ConvID, path, c.Title)
+}
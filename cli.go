@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//cliCommand is a subcommand that works with the database from the command line
+type cliCommand struct {
+	Usage       string
+	Description string
+	Run         func(h *Handler, args []string, out io.Writer) error
+}
+
+//cliCommands are the subcommands by name
+var cliCommands = map[string]cliCommand{
+	"add": {"add -user <name> <spent|received|transfer|start> ...",
+		"record a transaction with the same syntax as chat, ie: add -user alice spent 12.50 on food lunch", cliAdd},
+	"list":    {"list [<from> [<to>]]", "list the transactions of this period, or between two months or dates", cliList},
+	"balance": {"balance [<month|date>]", "show the balance of every account, now or at the end of a month or date", cliBalance},
+	"tags":    {"tags", "list every tag that has been used", cliTags},
+	"export":  {"export [<file>]", "write every transaction as CSV to a file or stdout", cliExport},
+	"import":  {"import <file>", "record the transactions in a CSV file written by export in a database without any", cliImport},
+	"migrate": {"migrate", "bring the database up to date and check the books", cliMigrate},
+	"backup":  {"backup <file>", "write a copy of the database to a new file", cliBackup},
+}
+
+//errCLIUsage is returned when a subcommand is given the wrong arguments
+var errCLIUsage = errors.New("usage")
+
+//CLIUsage describes the subcommands
+func CLIUsage() string {
+	var b strings.Builder
+	b.WriteString("subcommands, run against the database at dbloc (KST_DBLOC) without keybase:\n")
+	for _, name := range []string{"add", "list", "balance", "tags", "export", "import", "migrate", "backup"} {
+		c := cliCommands[name]
+		fmt.Fprintf(&b, "  %s\n    \t%s\n", c.Usage, c.Description)
+	}
+	return b.String()
+}
+
+//RunCLI runs the subcommand named by args[0] against the configured
+//database and returns the exit status
+func RunCLI(cfg *Config, args []string, stdout, stderr io.Writer) int {
+	c, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown subcommand %q\n%s", args[0], CLIUsage())
+		return 2
+	}
+	if err := cfg.ValidateLocal(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := cfg.Apply(); err != nil {
+		fmt.Fprintln(stderr, "error applying configuration:", err)
+		return 1
+	}
+	//nobody can react to a confirmation prompt on the command line
+	SetThresholds(Thresholds{})
+
+	db := NewDB(cfg.DBLoc)
+	if err := db.Init(); err != nil {
+		fmt.Fprintln(stderr, "error opening database:", err)
+		return 1
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			fmt.Fprintln(stderr, "error closing database:", err)
+		}
+	}()
+	h := NewHandler(nil, db, "")
+	h.SetConsole(stdout)
+
+	err := c.Run(&h, args[1:], stdout)
+	switch {
+	case err == errCLIUsage:
+		fmt.Fprintf(stderr, "usage: %s\n", c.Usage)
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "%s: %s\n", args[0], err)
+		return 1
+	case h.Flagged() > 0:
+		return 1
+	}
+	return 0
+}
+
+//cliTxnCommands are the chat commands add can run
+var cliTxnCommands = []string{"spent", "received", "transfer", "start"}
+
+//cliAdd records a transaction by running the chat command that records it
+func cliAdd(h *Handler, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	user := fs.String("user", "", "the keybase user the transaction is recorded by")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 || *user == "" {
+		return errCLIUsage
+	}
+	if !usernameExp.MatchString(*user) {
+		return fmt.Errorf("invalid user %q, expected a keybase username", *user)
+	}
+	cmdstring := strings.Join(fs.Args(), " ")
+	cmd := h.findCommand(fs.Args())
+	if cmd == nil || !contains(cliTxnCommands, cmd.Name) {
+		return fmt.Errorf("expected one of %s, ie: add -user alice spent 12.50 on food", strings.Join(cliTxnCommands, ", "))
+	}
+	parsed, err := cmd.Parse(cmdstring)
+	if err != nil {
+		if perr, ok := err.(*ParseError); ok {
+			return fmt.Errorf("%s\nusage: %s", perr.Msg, cmd.Usage())
+		}
+		return err
+	}
+	msg := chat1.MsgSummary{
+		Sender:  chat1.MsgSender{Username: *user},
+		Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MessageText{Body: cmdstring}},
+	}
+	return cmd.EntryPoint(parsed, msg)
+}
+
+//cliRange parses the optional from and to of a subcommand into a range,
+//which defaults to the current period
+func cliRange(args []string) (time.Time, time.Time, error) {
+	t1, t2 := StartOfPeriod(), EndOfPeriod()
+	if len(args) > 2 {
+		return t1, t2, errCLIUsage
+	}
+	if len(args) > 0 {
+		d, ok := parseDate(args[0])
+		if !ok {
+			return t1, t2, fmt.Errorf("invalid date %q, expected a month or a date like 2026-10-15", args[0])
+		}
+		t1, t2 = d[0], d[1]
+		if len(args) == 1 {
+			t2 = time.Now()
+		}
+	}
+	if len(args) > 1 {
+		d, ok := parseDate(args[1])
+		if !ok {
+			return t1, t2, fmt.Errorf("invalid date %q, expected a month or a date like 2026-10-15", args[1])
+		}
+		t2 = d[1]
+	}
+	return t1, t2, nil
+}
+
+//cliList prints the transactions in a range, one per line separated by tabs
+func cliList(h *Handler, args []string, out io.Writer) error {
+	t1, t2, err := cliRange(args)
+	if err != nil {
+		return err
+	}
+	txns, err := h.db.GetTransactions(t1, t2)
+	if err != nil {
+		return err
+	}
+	for _, t := range txns {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Date.Time().In(location).Format("2006-01-02 15:04"),
+			t.User, decimal(t.Amount), t.AccountName(), strings.Join(t.Tags, ","), t.Note)
+	}
+	return nil
+}
+
+//cliBalance prints the balance of every account and the net worth
+func cliBalance(h *Handler, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errCLIUsage
+	}
+	at := time.Now()
+	if len(args) == 1 {
+		d, ok := parseDate(args[0])
+		if !ok {
+			return fmt.Errorf("invalid date %q, expected a month or a date like 2026-10-15", args[0])
+		}
+		at = d[1]
+	}
+	accounts, err := h.db.GetAccounts()
+	if err != nil {
+		return err
+	}
+	balances, err := h.db.GetAccountBalances(at)
+	if err != nil {
+		return err
+	}
+	var worth USD
+	for _, name := range accountNames(accounts, balances) {
+		fmt.Fprintf(out, "%s\t%s\n", name, decimal(balances[name]))
+		worth += balances[name]
+	}
+	fmt.Fprintf(out, "net worth\t%s\n", decimal(worth))
+	return nil
+}
+
+//cliTags prints every tag that has been used
+func cliTags(h *Handler, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return errCLIUsage
+	}
+	tags, err := h.db.GetTags()
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		fmt.Fprintln(out, tag)
+	}
+	return nil
+}
+
+//csvHeader is the first row of an export
+var csvHeader = []string{"id", "date", "amount", "tags", "note", "user", "account", "summary", "transfer", "cleared"}
+
+//cliExport writes every transaction as CSV. Receipts aren't exported.
+func cliExport(h *Handler, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errCLIUsage
+	}
+	if len(args) == 1 {
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	txns, err := h.db.GetAllTransactions()
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	if err := w.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, t := range txns {
+		err := w.Write([]string{
+			strconv.FormatInt(t.ID, 10),
+			t.Date.Time().In(location).Format(time.RFC3339Nano),
+			decimal(t.Amount),
+			strings.Join(t.Tags, ","),
+			t.Note,
+			t.User,
+			t.Account,
+			strconv.FormatBool(t.Summary),
+			strconv.FormatBool(t.Transfer),
+			strconv.FormatBool(t.Cleared),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+//parseCSVTxn parses a row of an export, checking it the way the chat
+//commands check transactions
+func parseCSVTxn(row []string) (Txn, error) {
+	var t Txn
+	if len(row) != len(csvHeader) {
+		return t, fmt.Errorf("expected %d columns, got %d", len(csvHeader), len(row))
+	}
+	date, err := time.Parse(time.RFC3339Nano, row[1])
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q", row[1])
+	}
+	t.Date = Timestamp(date.In(location))
+	amt, ok := parseAmount(strings.TrimPrefix(row[2], "-"))
+	if !ok {
+		return t, fmt.Errorf("invalid amount %q", row[2])
+	}
+	t.Amount = amt
+	if strings.HasPrefix(row[2], "-") {
+		t.Amount = -amt
+	}
+	t.Tags = []string{}
+	if row[3] != "" {
+		t.Tags = strings.Split(row[3], ",")
+	}
+	for _, tag := range t.Tags {
+		if !tagExp.MatchString(tag) {
+			return t, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	t.Note, t.User, t.Account = row[4], row[5], accountOf(strings.ToLower(row[6]))
+	if t.User == "" {
+		return t, errors.New("the user is missing")
+	}
+	for i, b := range []*bool{&t.Summary, &t.Transfer, &t.Cleared} {
+		if *b, err = strconv.ParseBool(row[7+i]); err != nil {
+			return t, fmt.Errorf("invalid %s %q", csvHeader[7+i], row[7+i])
+		}
+	}
+	if len(t.Tags) == 0 && !t.Summary && !t.Transfer {
+		return t, errors.New("spending and income need at least one tag")
+	}
+	return t, nil
+}
+
+//cliImport records the transactions in a CSV export, adding the accounts
+//they name that don't exist yet. Nothing is recorded if any row is invalid,
+//or if the database already has transactions, which could be recorded twice.
+func cliImport(h *Handler, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errCLIUsage
+	}
+	if has, err := h.db.HasTransactions(); err != nil {
+		return err
+	} else if has {
+		return errors.New("the database already has transactions, import into a new database so none are recorded twice")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil || strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+		return fmt.Errorf("expected a CSV file with the header %s", strings.Join(csvHeader, ","))
+	}
+	var (
+		txns    []Txn
+		missing []Account
+	)
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		t, err := parseCSVTxn(row)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		ok, err := h.accountExists(t.Account)
+		if err != nil {
+			return err
+		}
+		if !ok && !accountListed(missing, t.Account) {
+			if !tagExp.MatchString(t.Account) {
+				return fmt.Errorf("line %d: invalid account %q", line, t.Account)
+			}
+			missing = append(missing, Account{t.Account, t.Date, t.User})
+		}
+		txns = append(txns, t)
+	}
+	if err := h.db.ImportTransactions(missing, txns); err != nil {
+		return err
+	}
+	for _, a := range missing {
+		fmt.Fprintf(out, "added the account %s\n", a.Name)
+	}
+	fmt.Fprintf(out, "imported %d transactions\n", len(txns))
+	return nil
+}
+
+//accountListed returns whether accounts includes one named name
+func accountListed(accounts []Account, name string) bool {
+	for _, a := range accounts {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//cliMigrate reports on the books once opening the database has brought it up to date
+func cliMigrate(h *Handler, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return errCLIUsage
+	}
+	c, err := h.CheckBooks()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "the database is up to date")
+	fmt.Fprintln(out, c.String())
+	if !c.OK() {
+		return errors.New("the books don't balance")
+	}
+	return nil
+}
+
+//cliBackup writes a copy of the database
+func cliBackup(h *Handler, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errCLIUsage
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return fmt.Errorf("%s already exists", args[0])
+	}
+	if err := h.db.Backup(args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "backed up %s to %s\n", h.db, args[0])
+	return nil
+}
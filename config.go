@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+//Config holds the bot's settings. It is loaded from an optional TOML file
+//and KST_* environment variables, which take precedence over the file.
+type Config struct {
+	KBHome     string             `toml:"kbhome"`      //keybase home directory (KST_KBHOME)
+	KBLoc      string             `toml:"kbloc"`       //location of the keybase binary (KST_KBLOC)
+	DBLoc      string             `toml:"dbloc"`       //location of the sqlite database (KST_DBLOC)
+	Receipts   string             `toml:"receipts"`    //directory receipt photos are saved in (KST_RECEIPTS)
+	OCR        string             `toml:"ocr"`         //local program that reads receipt photos sent without a caption (KST_OCR)
+	OCRTimeout string             `toml:"ocr_timeout"` //how long the ocr program may read a photo, ie: 30s (KST_OCR_TIMEOUT)
+	DebugConv  string             `toml:"debug_conv"`  //conversation id debug messages are reported to (KST_DBGCONV)
+	Users      []string           `toml:"users"`       //authorized usernames and team:name entries (KST_USERS)
+	Admins     []string           `toml:"admins"`      //usernames allowed to reconcile the books (KST_ADMINS)
+	Timezone   string             `toml:"timezone"`    //IANA timezone periods are calculated in (KST_TIMEZONE)
+	Currency   string             `toml:"currency"`    //ISO currency code amounts are displayed in (KST_CURRENCY)
+	Period     string             `toml:"period"`      //budgeting period, monthly or weekly (KST_PERIOD)
+	Reactions  Reactions          `toml:"reactions"`   //emoji the bot reacts to commands with
+	Confirm    Thresholds         `toml:"confirm"`     //when transactions need to be confirmed
+	Budgets    map[string]float64 `toml:"budgets"`     //the most to spend on a tag each period
+	API        APIConfig          `toml:"api"`         //the optional HTTP API
+}
+
+//Reactions are the emoji the bot reacts to messages with
+type Reactions struct {
+	Success  string `toml:"success"`
+	Error    string `toml:"error"`
+	Dollar   string `toml:"dollar"`
+	Question string `toml:"question"`
+	Confirm  string `toml:"confirm"` //reaction that confirms a pending transaction
+}
+
+//currencySymbols maps the supported ISO currency codes to their display symbol
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"CAD": "$",
+	"AUD": "$",
+	"NZD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"CHF": "CHF ",
+}
+
+//DefaultConfig returns a Config with every optional setting filled in
+func DefaultConfig() *Config {
+	return &Config{
+		KBLoc:      "keybase",
+		DBLoc:      "kst.db",
+		Receipts:   "receipts",
+		OCRTimeout: "30s",
+		Timezone:   "Local",
+		Currency:   "USD",
+		Period:     string(Monthly),
+		Reactions:  DefaultReactions(),
+		Confirm:    DefaultThresholds(),
+	}
+}
+
+//LoadConfig reads the config file at path on top of the defaults and applies
+//environment overrides. An empty path loads the defaults and environment only.
+//The returned config has not been validated.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file %s: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return nil, fmt.Errorf("config file %s: unknown settings: %s", path, strings.Join(keys, ", "))
+		}
+	}
+	c.applyEnv(os.Getenv)
+	return c, nil
+}
+
+//applyEnv overrides settings with any non-empty KST_* environment variables
+func (c *Config) applyEnv(getenv func(string) string) {
+	for env, field := range map[string]*string{
+		"KST_KBHOME":      &c.KBHome,
+		"KST_KBLOC":       &c.KBLoc,
+		"KST_DBLOC":       &c.DBLoc,
+		"KST_RECEIPTS":    &c.Receipts,
+		"KST_OCR":         &c.OCR,
+		"KST_OCR_TIMEOUT": &c.OCRTimeout,
+		"KST_DBGCONV":     &c.DebugConv,
+		"KST_TIMEZONE":    &c.Timezone,
+		"KST_CURRENCY":    &c.Currency,
+		"KST_PERIOD":      &c.Period,
+		"KST_API_LISTEN":  &c.API.Listen,
+	} {
+		if v := getenv(env); v != "" {
+			*field = v
+		}
+	}
+	if v := getenv("KST_USERS"); v != "" {
+		c.Users = strings.Split(v, ",")
+	}
+	if v := getenv("KST_ADMINS"); v != "" {
+		c.Admins = strings.Split(v, ",")
+	}
+	if v := getenv("KST_DASHBOARD"); v != "" {
+		c.API.Dashboard = v == "1" || strings.EqualFold(v, "true")
+	}
+	if v := getenv("KST_API_TOKENS"); v != "" {
+		c.API.Tokens = make(map[string]string)
+		for _, entry := range strings.Split(v, ",") {
+			//entries without a token are reported by Validate
+			usr, token := entry, ""
+			if i := strings.Index(entry, "="); i >= 0 {
+				usr, token = entry[:i], entry[i+1:]
+			}
+			c.API.Tokens[strings.TrimSpace(usr)] = strings.TrimSpace(token)
+		}
+	}
+}
+
+//UsersString returns the authorized users in the comma separated form
+//accepted by ParseUserList
+func (c *Config) UsersString() string {
+	return strings.Join(c.Users, ",")
+}
+
+//Validate checks every setting and returns a single error describing
+//all of the problems found
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+//ValidateLocal checks the settings used to work with the database from the
+//command line, ignoring the keybase, receipt reading and API settings
+func (c *Config) ValidateLocal() error {
+	return c.validate(false)
+}
+
+//validate checks the settings, those only used by the bot if bot is set
+func (c *Config) validate(bot bool) error {
+	var problems []string
+	report := func(setting, env, msg string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("  %s (%s): %s", setting, env, fmt.Sprintf(msg, args...)))
+	}
+
+	if bot {
+		if c.KBLoc == "" {
+			report("kbloc", "KST_KBLOC", "location of the keybase binary is required")
+		}
+		if c.KBHome != "" {
+			if fi, err := os.Stat(c.KBHome); err != nil || !fi.IsDir() {
+				report("kbhome", "KST_KBHOME", "%q is not a directory", c.KBHome)
+			}
+		}
+	}
+	if c.DBLoc == "" {
+		report("dbloc", "KST_DBLOC", "location of the database is required")
+	} else if fi, err := os.Stat(c.DBLoc); err == nil && fi.IsDir() {
+		report("dbloc", "KST_DBLOC", "%q is a directory, expected a database file", c.DBLoc)
+	}
+	if fi, err := os.Stat(c.Receipts); c.Receipts != "" && err == nil && !fi.IsDir() {
+		report("receipts", "KST_RECEIPTS", "%q is not a directory", c.Receipts)
+	}
+	//the authorized users, nil when they aren't valid
+	var users *UserList
+	if bot {
+		if args := strings.Fields(c.OCR); len(args) > 0 {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				report("ocr", "KST_OCR", "%q was not found, install it or leave ocr empty to not read receipts", args[0])
+			}
+		}
+		if d, err := time.ParseDuration(c.OCRTimeout); err != nil || d <= 0 {
+			report("ocr_timeout", "KST_OCR_TIMEOUT", "%q is not a duration like 30s or 2m", c.OCRTimeout)
+		}
+		if len(c.Users) == 0 {
+			report("users", "KST_USERS", "at least one authorized user is required, ie: users = [\"alice\", \"team:ourfamily\"]")
+		} else if l, err := ParseUserList(c.UsersString()); err != nil {
+			report("users", "KST_USERS", "%v", err)
+		} else {
+			users = l
+			for _, usr := range c.Admins {
+				usr = strings.ToLower(strings.TrimSpace(usr))
+				if !usernameExp.MatchString(usr) {
+					report("admins", "KST_ADMINS", "%q is not a valid username", usr)
+				} else if !users.mayInclude(usr) {
+					report("admins", "KST_ADMINS", "%s is not one of the authorized users", usr)
+				}
+			}
+		}
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		report("timezone", "KST_TIMEZONE", "unknown timezone %q, expected a name like America/New_York", c.Timezone)
+	}
+	if _, ok := currencySymbols[strings.ToUpper(c.Currency)]; !ok {
+		codes := make([]string, 0, len(currencySymbols))
+		for code := range currencySymbols {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		report("currency", "KST_CURRENCY", "unsupported currency %q, expected one of %s", c.Currency, strings.Join(codes, ", "))
+	}
+	if !Period(c.Period).Valid() {
+		report("period", "KST_PERIOD", "unknown period %q, expected %s or %s", c.Period, Monthly, Weekly)
+	}
+	for _, r := range []struct{ name, emoji string }{
+		{"success", c.Reactions.Success},
+		{"error", c.Reactions.Error},
+		{"dollar", c.Reactions.Dollar},
+		{"question", c.Reactions.Question},
+		{"confirm", c.Reactions.Confirm},
+	} {
+		if strings.TrimSpace(r.emoji) == "" || strings.ContainsAny(r.emoji, " \t\n") {
+			report("reactions."+r.name, "config file", "%q is not a valid reaction", r.emoji)
+		}
+	}
+	if c.Confirm.Above < 0 {
+		report("confirm.above", "config file", "%v must not be negative, use 0 to disable", c.Confirm.Above)
+	}
+	if c.Confirm.TagMultiple != 0 && c.Confirm.TagMultiple <= 1 {
+		report("confirm.tag_multiple", "config file", "%v must be greater than 1, use 0 to disable", c.Confirm.TagMultiple)
+	}
+
+	for tag, amt := range c.Budgets {
+		if !tagExp.MatchString(tag) {
+			report("budgets."+tag, "config file", "%q is not a valid tag", tag)
+		}
+		if amt <= 0 {
+			report("budgets."+tag, "config file", "%v must be greater than 0", amt)
+		}
+	}
+
+	if bot {
+		if c.API.Dashboard && c.API.Listen == "" {
+			report("api.dashboard", "KST_DASHBOARD", "the dashboard is served on api.listen (KST_API_LISTEN), which is empty")
+		}
+		if c.API.Listen != "" && len(c.API.Tokens) == 0 {
+			report("api.tokens", "KST_API_TOKENS", "at least one token is required to serve the API, ie: alice=<token>")
+		}
+		seen := make(map[string]string)
+		for usr, token := range c.API.Tokens {
+			if !usernameExp.MatchString(usr) {
+				report("api.tokens", "KST_API_TOKENS", "%q is not a valid username", usr)
+			} else if users != nil && !users.mayInclude(usr) {
+				report("api.tokens."+usr, "KST_API_TOKENS", "%s is not one of the authorized users", usr)
+			}
+			if len(token) < minTokenLength {
+				report("api.tokens."+usr, "KST_API_TOKENS", "the token must be at least %d characters", minTokenLength)
+			} else if other, ok := seen[token]; ok {
+				report("api.tokens."+usr, "KST_API_TOKENS", "the token is the same as %s's", other)
+			}
+			seen[token] = usr
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n" + strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+//Apply sets the package wide display and period settings from the config.
+//The config must be valid.
+func (c *Config) Apply() error {
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return err
+	}
+	SetLocation(loc)
+	SetPeriod(Period(c.Period))
+	SetCurrencySymbol(currencySymbols[strings.ToUpper(c.Currency)])
+	SetReactions(c.Reactions)
+	SetThresholds(c.Confirm)
+	SetBudgets(c.Budgets)
+	SetAdmins(c.Admins)
+	SetReceiptsDir(c.Receipts)
+	if args := strings.Fields(c.OCR); len(args) > 0 {
+		timeout, err := time.ParseDuration(c.OCRTimeout)
+		if err != nil {
+			return err
+		}
+		SetOCR(CommandOCR{args, timeout})
+	} else {
+		SetOCR(nil)
+	}
+	return nil
+}
+
+//String describes the API config without revealing the tokens
+func (c APIConfig) String() string {
+	if c.Listen == "" {
+		return "off"
+	}
+	users := make([]string, 0, len(c.Tokens))
+	for usr := range c.Tokens {
+		users = append(users, usr)
+	}
+	sort.Strings(users)
+	str := fmt.Sprintf("listen %s, tokens for %s", c.Listen, strings.Join(users, ", "))
+	if c.Dashboard {
+		str += ", dashboard at /"
+	}
+	return str
+}
+
+//String returns a human readable summary of the config
+func (c *Config) String() string {
+	return fmt.Sprintf(`kbhome:     %s
+kbloc:      %s
+dbloc:      %s
+receipts:   %s
+ocr:        %s, timeout %s
+debug_conv: %s
+users:      %s
+admins:     %s
+timezone:   %s
+currency:   %s
+period:     %s
+reactions:  success %s, error %s, dollar %s, question %s, confirm %s
+confirm:    above %v, tag_multiple %v
+budgets:    %v
+api:        %s`,
+		c.KBHome, c.KBLoc, c.DBLoc, c.Receipts, c.OCR, c.OCRTimeout, c.DebugConv, c.UsersString(), strings.Join(c.Admins, ","), c.Timezone, c.Currency, c.Period,
+		c.Reactions.Success, c.Reactions.Error, c.Reactions.Dollar, c.Reactions.Question, c.Reactions.Confirm,
+		c.Confirm.Above, c.Confirm.TagMultiple, c.Budgets, c.API)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//minTagHistory is how many transactions a tag needs before its average
+//is used to decide whether a transaction is unusual
+const minTagHistory = 3
+
+//pendingExpiry is how long a transaction waits to be confirmed before the
+//confirmation is refused
+const pendingExpiry = 24 * time.Hour
+
+//Thresholds decide which transactions need to be confirmed before they're
+//recorded. A zero threshold is disabled.
+type Thresholds struct {
+	Above       float64 `toml:"above"`        //confirm amounts over this many dollars
+	TagMultiple float64 `toml:"tag_multiple"` //confirm amounts over this multiple of a tag's average
+}
+
+//DefaultThresholds returns the thresholds used when none are configured
+func DefaultThresholds() Thresholds {
+	return Thresholds{TagMultiple: 10}
+}
+
+//thresholds are the Thresholds transactions are checked against
+var thresholds = DefaultThresholds()
+
+//SetThresholds sets the thresholds transactions are checked against
+func SetThresholds(t Thresholds) {
+	thresholds = t
+}
+
+//thumbsUp are the ways chat clients send a thumbs up reaction
+var thumbsUp = []string{":+1:", ":thumbsup:", "👍"}
+
+//isConfirmation returns whether the reaction body confirms a pending transaction
+func isConfirmation(body string) bool {
+	if body == reactions.Confirm {
+		return true
+	}
+	return contains(thumbsUp, reactions.Confirm) && contains(thumbsUp, body)
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+//confirmReason returns why txn needs to be confirmed, or an empty string
+//if it can be recorded right away
+func (h *Handler) confirmReason(txn Txn) (string, error) {
+	amt := txn.Amount.Abs()
+	if thresholds.Above > 0 && amt > ToUSD(thresholds.Above) {
+		return fmt.Sprintf("that's over %s", ToUSD(thresholds.Above)), nil
+	}
+	//tag averages are of spending
+	if thresholds.TagMultiple <= 0 || txn.Amount >= 0 {
+		return "", nil
+	}
+	for _, tag := range txn.Tags {
+		avg, n, err := h.db.GetTagAverage(tag)
+		if err != nil {
+			return "", err
+		}
+		if n >= minTagHistory && avg > 0 && amt > avg.Times(thresholds.TagMultiple) {
+			return fmt.Sprintf("that's %.0fx the usual %s for %s", amt.InDollars()/avg.InDollars(), avg, tag), nil
+		}
+	}
+	return "", nil
+}
+
+//record stores txn and returns its id, or asks for it to be confirmed first if
+//it's large or unusual and returns 0. A photo attached to msg is kept as the
+//transaction's receipt.
+func (h *Handler) record(txn Txn, msg chat1.MsgSummary) (int64, error) {
+	reason, err := h.confirmReason(txn)
+	if err != nil {
+		h.ReactError(msg)
+		return 0, err
+	}
+	if txn.Receipt == nil {
+		txn.Receipt = h.saveReceipt(msg)
+	}
+	if reason == "" {
+		id, err := h.db.InsertTransaction(txn)
+		if err != nil {
+			h.ReactError(msg)
+			return 0, err
+		}
+		h.ReactSuccess(msg)
+		h.receiptRecorded(msg.ConvID, txn, id)
+		return id, nil
+	}
+	//without a conversation nobody can react to confirm it
+	if msg.ConvID == "" {
+		h.ReactError(msg)
+		h.ChatEcho(msg.ConvID, "This needs to be confirmed (%s), record it in chat instead.", reason)
+		return 0, nil
+	}
+	return 0, h.confirm(txn, msg, reason)
+}
+
+//confirm asks for txn to be confirmed with a reaction before it's recorded,
+//saying why it needs to be
+func (h *Handler) confirm(txn Txn, msg chat1.MsgSummary, reason string) error {
+	prep := "from"
+	if txn.Amount < 0 {
+		prep = "on"
+	}
+	promptID, err := h.Ask(msg.ConvID, "Record %s %s %s? react %s to confirm (%s)",
+		txn.Amount.Abs(), prep, strings.Join(txn.Tags, ", "), reactions.Confirm, reason)
+	if err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	if err := h.db.PutPending(newPending(txn, msg, promptID)); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactQuestion(msg)
+	return nil
+}
+
+//newPending returns txn waiting on the prompt with the given id to be
+//confirmed, msg is the message it was entered with
+func newPending(txn Txn, msg chat1.MsgSummary, promptID chat1.MessageID) PendingTxn {
+	return PendingTxn{
+		ConvID:   msg.ConvID,
+		PromptID: promptID,
+		CmdID:    msg.Id,
+		Txn:      txn,
+		Sender:   msg.Sender.Username,
+		Created:  Timestamp(now()),
+	}
+}
+
+//HandleReaction records the pending transaction a confirmation reaction was
+//left on. Only whoever entered it or an admin may confirm it, and only
+//until it expires.
+func (h *Handler) HandleReaction(msg chat1.MsgSummary) error {
+	r := msg.Content.Reaction
+	if r == nil || !isConfirmation(r.Body) {
+		return nil
+	}
+	p, err := h.db.GetPending(msg.ConvID, r.MessageID)
+	if err != nil || p == nil {
+		return err
+	}
+	if usr := msg.Sender.Username; usr != p.Sender && !admins[usr] {
+		return nil
+	}
+	//taking it makes sure it's only recorded once
+	if p, err = h.db.TakePending(msg.ConvID, r.MessageID); err != nil || p == nil {
+		return err
+	}
+	if now().Sub(p.Created.Time()) > pendingExpiry {
+		h.react(p.ConvID, p.CmdID, reactions.Error)
+		h.ChatEcho(p.ConvID, "That confirmation expired, enter the transaction again to record it.")
+		return nil
+	}
+	id, err := h.db.InsertTransaction(p.Txn)
+	if err != nil {
+		h.react(p.ConvID, p.CmdID, reactions.Error)
+		return err
+	}
+	h.react(p.ConvID, p.CmdID, reactions.Success)
+	h.receiptRecorded(p.ConvID, p.Txn, id)
+	return nil
+}
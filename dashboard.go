@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+//templates holds the HTML the dashboard is rendered from
+//go:embed templates
+var templates embed.FS
+
+var dashboardTemplate = template.Must(template.New("dashboard.html").Funcs(template.FuncMap{
+	"signed": signed,
+	"date":   func(t Timestamp) string { return t.Time().In(location).Format("Mon Jan 2") },
+}).ParseFS(templates, "templates/dashboard.html"))
+
+//recentCount is how many of the latest transactions the dashboard lists
+const recentCount = 20
+
+//trendMonths is how many months of spending the dashboard charts
+const trendMonths = 12
+
+//MonthTotal is the money in and out of the ledger in a month, with the
+//width of its bars relative to the busiest month
+type MonthTotal struct {
+	Month  time.Time
+	Total  Total
+	InPct  int
+	OutPct int
+}
+
+//Dashboard is what the web dashboard shows
+type Dashboard struct {
+	Now      time.Time
+	Accounts []Amount //the balance of every account, the default one first
+	NetWorth USD
+	Report   *Report //the current period so far
+	Recent   []Txn   //the latest transactions, newest first
+	Months   []MonthTotal
+}
+
+//BuildDashboard gathers the dashboard as of now
+func (h *Handler) BuildDashboard(now time.Time) (*Dashboard, error) {
+	d := &Dashboard{Now: now}
+	accounts, err := h.db.GetAccounts()
+	if err != nil {
+		return nil, err
+	}
+	balances, err := h.db.GetAccountBalances(now)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range accountNames(accounts, balances) {
+		d.Accounts = append(d.Accounts, Amount{name, balances[name]})
+		d.NetWorth += balances[name]
+	}
+	if d.Report, err = h.BuildReport(now); err != nil {
+		return nil, err
+	}
+
+	start := Monthly.Start(now)
+	for i := 1; i < trendMonths; i++ {
+		start = Monthly.Previous(start)
+	}
+	txns, err := h.db.GetTransactions(start, now)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(txns) - 1; i >= 0 && len(d.Recent) < recentCount; i-- {
+		d.Recent = append(d.Recent, txns[i])
+	}
+	var busiest USD
+	for ; !start.After(now); start = Monthly.Next(start) {
+		end := Monthly.End(start)
+		var month []Txn
+		for _, txn := range txns {
+			if t := txn.Date.Time(); !t.Before(start) && !t.After(end) {
+				month = append(month, txn)
+			}
+		}
+		total, _, _ := totalOf(month)
+		d.Months = append(d.Months, MonthTotal{Month: start, Total: total})
+		if total.In > busiest {
+			busiest = total.In
+		}
+		if total.Out > busiest {
+			busiest = total.Out
+		}
+	}
+	if busiest > 0 {
+		for i, m := range d.Months {
+			d.Months[i].InPct = int(m.Total.In * 100 / busiest)
+			d.Months[i].OutPct = int(m.Total.Out * 100 / busiest)
+		}
+	}
+	return d, nil
+}
+
+//ServeDashboard adds the read-only dashboard at /. Browsers sign in with a
+//username and the user's API token as the password.
+func (a *API) ServeDashboard() {
+	a.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.authenticate(r); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kst", charset="UTF-8"`)
+			http.Error(w, "sign in with your username and API token", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, r.Method+" is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d, err := a.h.BuildDashboard(now())
+		if err != nil {
+			a.Debug("dashboard: %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		var b bytes.Buffer
+		if err := dashboardTemplate.Execute(&b, d); err != nil {
+			a.Debug("dashboard: %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := b.WriteTo(w); err != nil {
+			a.Debug("dashboard: failed to write response: %s", err)
+		}
+	})
+}
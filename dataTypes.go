@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 )
 
 func toJsonString(x interface{}) (string, error) {
@@ -18,6 +22,14 @@ func toJsonString(x interface{}) (string, error) {
 // USD represents US dollar amount in terms of cents
 type USD int64
 
+//currencySymbol is prefixed to formatted amounts
+var currencySymbol = "$"
+
+//SetCurrencySymbol sets the symbol formatted amounts are prefixed with
+func SetCurrencySymbol(symbol string) {
+	currencySymbol = symbol
+}
+
 // ToUSD converts a float64 to USD
 // e.g. 1.23 to $1.23, 1.345 to $1.35
 func ToUSD(f float64) USD {
@@ -51,7 +63,7 @@ func (m USD) Times(x float64) USD {
 
 // String returns a formatted USD value
 func (m USD) String() string {
-	return fmt.Sprintf("$%.2f", m.InDollars())
+	return fmt.Sprintf("%s%.2f", currencySymbol, m.InDollars())
 }
 
 //Abs returns the absolute value of the USD
@@ -80,13 +92,17 @@ func (m *USD) UnmarshalJSON(b []byte) error {
 
 //Txn represents a single transaction
 type Txn struct {
-	Date    Timestamp //the unix timestamp of the transaction
-	Amount  USD       //the amount of the transaction in cents
-	Tags    []string  //tags for the transaction
-	Note    string    //notes related to the transaction
-	User    string    //name of user who submitted the tx
-	Summary bool      //whether the transaction is a summary of the previous month's transactions
-
+	Date     Timestamp //the unix timestamp of the transaction
+	Amount   USD       //the amount of the transaction in cents
+	Tags     []string  //tags for the transaction
+	Note     string    //notes related to the transaction
+	User     string    //name of user who submitted the tx
+	Summary  bool      //whether the transaction is a starting balance, or a period summary recorded by older versions
+	Account  string    //the account the money moved in, empty for the default account
+	Transfer bool      //whether the transaction is one side of a transfer between accounts
+	Cleared  bool      //whether the transaction has shown up on a bank statement
+	ID       int64     `json:"-"` //the row the transaction is stored in, set when it's read
+	Receipt  *Receipt  //the photo of a receipt the transaction was recorded with, if any
 }
 
 //String returns the default string representation of a Txn
@@ -102,6 +118,14 @@ func (t *Txn) Action() string {
 	return "received"
 }
 
+//AccountName returns the account the transaction is in
+func (t *Txn) AccountName() string {
+	if t.Account == "" {
+		return defaultAccount
+	}
+	return t.Account
+}
+
 //Json returns the Txn as a Json Encoded string
 func (t *Txn) Json() (string, error) {
 	return toJsonString(t)
@@ -114,6 +138,42 @@ func ActionString(amt USD) string {
 	return "received " + amt.Abs().String() + " from"
 }
 
+//Receipt is a photo of a receipt attached to the message a transaction was
+//recorded with
+type Receipt struct {
+	ConvID   chat1.ConvIDStr
+	Channel  chat1.ChatChannel
+	MsgID    chat1.MessageID //the message the photo was attached to
+	Filename string          //the name the photo was uploaded with
+	Path     string          //where the photo was saved, empty if only the message is known
+}
+
+//PendingTxn is a transaction waiting to be confirmed by a reaction to the
+//prompt asking about it
+type PendingTxn struct {
+	ConvID   chat1.ConvIDStr
+	PromptID chat1.MessageID //the message asking for confirmation
+	CmdID    chat1.MessageID //the message the transaction was entered with
+	Txn      Txn
+	Sender   string    //who entered the transaction, they or an admin may confirm it
+	Created  Timestamp //when it was asked about, it expires pendingExpiry later
+}
+
+//Cursor is the last message the bot processed in a conversation
+type Cursor struct {
+	ConvID  chat1.ConvIDStr
+	Channel chat1.ChatChannel
+	MsgID   chat1.MessageID
+}
+
+//Ledger is a conversation the bot keeps the books in
+type Ledger struct {
+	ConvID  chat1.ConvIDStr
+	Channel chat1.ChatChannel
+	Creator string
+	Created Timestamp
+}
+
 type TagBalance struct {
 	usrs  map[string]USD
 	total USD
@@ -133,6 +193,20 @@ func (tb *TagBalance) Add(usr string, bal USD) {
 	tb.total += bal
 }
 
+//Total returns the balance of the tag across every user
+func (tb *TagBalance) Total() USD {
+	return tb.total
+}
+
+//Shares returns how much each user spent or received, largest first
+func (tb *TagBalance) Shares() []Amount {
+	abs := make(map[string]USD, len(tb.usrs))
+	for usr, bal := range tb.usrs {
+		abs[usr] = bal.Abs()
+	}
+	return sortedAmounts(abs)
+}
+
 func (tb TagBalance) String() string {
 	str := fmt.Sprintln(ActionString(tb.total), tb.tag)
 	for usr, bal := range tb.usrs {
@@ -142,21 +216,107 @@ func (tb TagBalance) String() string {
 	return str
 }
 
+//AuthorizedUsers is the set of keybase usernames allowed to use the bot
 type AuthorizedUsers map[string]struct{}
 
-//NewAutorizedUsers takes in a string of comma separated usernames
-func NewAuthorizedUsers(usrstr string) (AuthorizedUsers, error) {
-	users := strings.Split(usrstr, ",")
-	//do some basic validation...
-	if len(users) == 1 {
-		//keybase usernames cannot be more than 15 chars long or contain spaces
-		if len(users[0]) > 15 || strings.Contains(users[0], " ") {
-			return nil, errors.New(fmt.Sprint("Invalid authorized users string:", users[0]))
+//teamPrefix marks an entry in the users string as a keybase team whose
+//members are all authorized, ie: team:ourfamily
+const teamPrefix = "team:"
+
+var (
+	//keybase usernames are 2-16 chars of lowercase letters, digits and underscores
+	//and cannot start with an underscore
+	usernameExp = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{1,15}$`)
+	//team names follow the same rules as usernames with subteams separated by dots
+	teamNameExp = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{1,15}(\.[a-z0-9][a-z0-9_]{1,15})*$`)
+)
+
+//TeamLister resolves the members of a keybase team
+type TeamLister interface {
+	ListMembersOfTeam(teamName string) (keybase1.TeamMembersDetails, error)
+}
+
+//UserList is the parsed form of an authorized users string
+type UserList struct {
+	Users []string
+	Teams []string
+}
+
+//mayInclude returns whether username is authorized by the list. Members of
+//the teams aren't known until the bot connects to keybase, so with any teams
+//every username may be.
+func (l *UserList) mayInclude(username string) bool {
+	for _, usr := range l.Users {
+		if usr == username {
+			return true
+		}
+	}
+	return len(l.Teams) > 0
+}
+
+//ParseUserList parses a string of comma separated usernames and team:name entries.
+//Surrounding whitespace is trimmed and names are lower cased. Empty entries,
+//invalid names and an empty string are errors.
+func ParseUserList(usrstr string) (*UserList, error) {
+	if strings.TrimSpace(usrstr) == "" {
+		return nil, errors.New("no authorized users given")
+	}
+	l := new(UserList)
+	for i, entry := range strings.Split(usrstr, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			return nil, fmt.Errorf("authorized users: entry %d is empty", i+1)
+		case strings.HasPrefix(entry, teamPrefix):
+			team := strings.TrimSpace(strings.TrimPrefix(entry, teamPrefix))
+			if !teamNameExp.MatchString(team) {
+				return nil, fmt.Errorf("authorized users: invalid team name %q", team)
+			}
+			l.Teams = append(l.Teams, team)
+		case !usernameExp.MatchString(entry):
+			return nil, fmt.Errorf("authorized users: invalid username %q", entry)
+		default:
+			l.Users = append(l.Users, entry)
 		}
 	}
+	return l, nil
+}
+
+//Resolve returns the authorized users including the current members of
+//every team in the list. tl may be nil if the list contains no teams.
+func (l *UserList) Resolve(tl TeamLister) (AuthorizedUsers, error) {
 	usrmap := make(AuthorizedUsers)
-	for _, usr := range users {
+	for _, usr := range l.Users {
 		usrmap[usr] = struct{}{}
 	}
+	for _, team := range l.Teams {
+		if tl == nil {
+			return nil, fmt.Errorf("authorized users: can't resolve team %s without a keybase connection", team)
+		}
+		members, err := tl.ListMembersOfTeam(team)
+		if err != nil {
+			return nil, fmt.Errorf("authorized users: listing members of team %s: %v", team, err)
+		}
+		for _, group := range [][]keybase1.TeamMemberDetails{
+			members.Owners,
+			members.Admins,
+			members.Writers,
+			members.Readers,
+		} {
+			for _, m := range group {
+				usrmap[m.Username] = struct{}{}
+			}
+		}
+	}
 	return usrmap, nil
 }
+
+//NewAutorizedUsers takes in a string of comma separated usernames.
+//Use ParseUserList and Resolve when the string may contain teams.
+func NewAuthorizedUsers(usrstr string) (AuthorizedUsers, error) {
+	l, err := ParseUserList(usrstr)
+	if err != nil {
+		return nil, err
+	}
+	return l.Resolve(nil)
+}
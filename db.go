@@ -4,19 +4,47 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"sort"
+	"sync"
 	"time"
 )
 
 const date string = `json_extract(txs.tx, '$.Date')`
 
+//notPeriodSummary leaves out the period summaries older versions recorded.
+//It takes summaryUser as a parameter.
+const notPeriodSummary string = `NOT (json_extract(txs.tx, '$.Summary') AND json_extract(txs.tx, '$.User') = (?))`
+
+//notTransfer leaves out transfers between accounts, which aren't spending or
+//income. Transactions from before accounts don't have the field.
+const notTransfer string = `NOT IFNULL(json_extract(txs.tx, '$.Transfer'), 0)`
+
 type closer interface {
 	Close() error
 }
 
-//DB describes a low level sqlite3 database implementation
-type DB string
+//ErrDBClosed is returned by queries made after the database is closed
+var ErrDBClosed = errors.New("database is closed")
+
+//DB describes a low level sqlite3 database implementation.
+//A single connection is shared by all queries and guarded by a mutex,
+//so a query in progress finishes before Close returns.
+type DB struct {
+	path   string
+	mu     sync.Mutex
+	c      *sqlite3.Conn
+	closed bool
+}
+
+//NewDB returns a DB for the sqlite database at path. The connection
+//is opened on first use.
+func NewDB(path string) *DB {
+	return &DB{path: path}
+}
 
 func betweenTimes() string {
 	return fmt.Sprintf("%s >= (?) AND %s <= (?)", date, date)
@@ -29,6 +57,7 @@ func handleClose(c closer) {
 	}
 }
 
+//txRowsToSlice reads the rowid and tx columns of each row into a Txn
 func txRowsToSlice(stmt *sqlite3.Stmt) ([]Txn, error) {
 	var txs []Txn
 	for {
@@ -40,13 +69,16 @@ func txRowsToSlice(stmt *sqlite3.Stmt) ([]Txn, error) {
 			break
 		}
 
-		var tx string
-		err = stmt.Scan(&tx)
+		var (
+			id int64
+			tx string
+		)
+		err = stmt.Scan(&id, &tx)
 		if err != nil {
 			return nil, err
 		}
 
-		var t Txn
+		t := Txn{ID: id}
 		if err := json.Unmarshal([]byte(tx), &t); err != nil {
 			return nil, err
 		}
@@ -55,119 +87,576 @@ func txRowsToSlice(stmt *sqlite3.Stmt) ([]Txn, error) {
 	return txs, nil
 }
 
-func (db DB) conn() (*sqlite3.Conn, error) {
-	return sqlite3.Open(string(db))
+//conn locks the database and returns the shared connection, opening it
+//if needed. release must be called once the connection is no longer used.
+func (db *DB) conn() (*sqlite3.Conn, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, ErrDBClosed
+	}
+	if db.c == nil {
+		c, err := sqlite3.Open(db.path)
+		if err != nil {
+			db.mu.Unlock()
+			return nil, err
+		}
+		db.c = c
+	}
+	return db.c, nil
+}
+
+//release unlocks the connection returned by conn
+func (db *DB) release() {
+	db.mu.Unlock()
+}
+
+//Close waits for the query in progress, if any, and closes the connection.
+//Any later queries return ErrDBClosed.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if db.c == nil {
+		return nil
+	}
+	return db.c.Close()
 }
 
-//String casts db as a string
-func (db DB) String() string {
-	return string(db)
+//String returns the location of the database
+func (db *DB) String() string {
+	return db.path
 }
 
-func (db DB) Init() error {
+func (db *DB) Init() error {
 	conn, err := db.conn()
 	if err != nil {
 		return err
 	}
-	defer handleClose(conn)
-	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS txs(tx JSON)`); err != nil {
+	defer db.release()
+	//entry is the journal entry the transaction was recorded with
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS txs(tx JSON, entry INTEGER)`); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS cursors(conv TEXT PRIMARY KEY, msgid INTEGER, channel JSON)`); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS ledgers(conv TEXT PRIMARY KEY, ledger JSON)`); err != nil {
+		return err
+	}
+	//sender is who may confirm the transaction besides admins, created is when it was asked about
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS pending(conv TEXT, prompt INTEGER, cmd INTEGER, tx JSON, sender TEXT, created INTEGER, PRIMARY KEY(conv, prompt))`); err != nil {
+		return err
+	}
+	if err = pendingSenders(conn); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS goals(name TEXT PRIMARY KEY, goal JSON)`); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS accounts(name TEXT PRIMARY KEY, account JSON)`); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS entries(id INTEGER PRIMARY KEY, date INTEGER, user TEXT, note TEXT)`); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS postings(entry INTEGER, account TEXT, amount INTEGER, date INTEGER)`); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE INDEX IF NOT EXISTS postings_account ON postings(account, date)`); err != nil {
+		return err
+	}
+	if err = linkJournal(conn); err != nil {
+		return err
+	}
+	if err = backfillJournal(conn); err != nil {
+		return err
+	}
+	if err = conn.Exec(`CREATE TABLE IF NOT EXISTS settings(user TEXT, key TEXT, value TEXT, PRIMARY KEY(user, key))`); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (db *DB) PutTransaction(t Txn) error {
+	_, err := db.InsertTransaction(t)
+	return err
+}
+
+//InsertTransaction records t and returns the ID it was stored with
+func (db *DB) InsertTransaction(t Txn) (int64, error) {
 	conn, err := db.conn()
 	if err != nil {
+		return 0, err
+	}
+	defer db.release()
+
+	var id int64
+	err = conn.WithTx(func() error {
+		id, err = putTransactions(conn, []Txn{t})
+		return err
+	})
+	return id, err
+}
+
+//putTransactions records txns and the journal entry they translate to. It
+//returns the ID of the last transaction.
+func putTransactions(conn *sqlite3.Conn, txns []Txn) (int64, error) {
+	//period summaries aren't part of the journal
+	var entry interface{}
+	if e, ok := journalEntry(txns...); ok {
+		if err := insertEntry(conn, &e); err != nil {
+			return 0, err
+		}
+		entry = e.ID
+	}
+	var id int64
+	for _, t := range txns {
+		tjson, err := t.Json()
+		if err != nil {
+			return 0, err
+		}
+		if err := conn.Exec(`INSERT INTO txs(tx, entry) VALUES (?, ?)`, tjson, entry); err != nil {
+			return 0, err
+		}
+		id = conn.LastInsertRowID()
+	}
+	return id, nil
+}
+
+//linkEntry records that txns were recorded with the journal entry e
+func linkEntry(conn *sqlite3.Conn, e *Entry, txns []Txn) error {
+	for _, t := range txns {
+		if err := conn.Exec(`UPDATE txs SET entry = (?) WHERE rowid = (?)`, e.ID, t.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//insertEntry records a journal entry, setting its ID
+func insertEntry(conn *sqlite3.Conn, e *Entry) error {
+	if !e.Balanced() {
+		return ErrUnbalanced
+	}
+	date := e.Date.Time().UnixNano()
+	if err := conn.Exec(`INSERT INTO entries(date, user, note) VALUES (?, ?, ?)`, date, e.User, e.Note); err != nil {
 		return err
 	}
-	defer handleClose(conn)
+	e.ID = conn.LastInsertRowID()
+	for _, p := range e.Postings {
+		if err := conn.Exec(`INSERT INTO postings VALUES (?, ?, ?, ?)`, e.ID, p.Account, int64(p.Amount), date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//backfillJournal translates the transactions recorded before the journal
+//existed into journal entries. The two sides of a transfer were recorded
+//one after the other with the same date.
+func backfillJournal(conn *sqlite3.Conn) error {
+	txns, err := unjournaledTxns(conn)
+	if err != nil || len(txns) == 0 {
+		return err
+	}
+	return conn.WithTx(func() error {
+		for _, group := range recordedTogether(txns) {
+			e, ok := journalEntry(group...)
+			if !ok {
+				continue
+			}
+			if err := insertEntry(conn, &e); err != nil {
+				return err
+			}
+			if err := linkEntry(conn, &e, group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	tjson, err := t.Json()
+//pendingSenders adds the sender and created columns to the pending table of
+//databases created before they existed. Transactions already waiting have
+//no creation time, so they've expired.
+func pendingSenders(conn *sqlite3.Conn) error {
+	stmt, err := conn.Prepare(`SELECT 1 FROM pragma_table_info('pending') WHERE name = 'sender'`)
 	if err != nil {
 		return err
 	}
-	stmt, err := conn.Prepare(`Insert INTO txs VALUES (?)`, tjson)
+	hasColumn, err := stmt.Step()
+	handleClose(stmt)
+	if err != nil || hasColumn {
+		return err
+	}
+	return conn.WithTx(func() error {
+		if err := conn.Exec(`ALTER TABLE pending ADD COLUMN sender TEXT`); err != nil {
+			return err
+		}
+		return conn.Exec(`ALTER TABLE pending ADD COLUMN created INTEGER`)
+	})
+}
+
+//linkJournal adds the entry column to the transactions of databases
+//journaled before it existed, matching each transaction to the first entry
+//left with the same date and user. Entries that aren't for a transaction
+//and transactions that were never journaled are left alone.
+func linkJournal(conn *sqlite3.Conn) error {
+	stmt, err := conn.Prepare(`SELECT 1 FROM pragma_table_info('txs') WHERE name = 'entry'`)
 	if err != nil {
 		return err
 	}
+	hasColumn, err := stmt.Step()
+	handleClose(stmt)
+	if err != nil || hasColumn {
+		return err
+	}
+	return conn.WithTx(func() error {
+		if err := conn.Exec(`ALTER TABLE txs ADD COLUMN entry INTEGER`); err != nil {
+			return err
+		}
+		stmt, err := conn.Prepare(`SELECT rowid, tx FROM txs ORDER BY rowid`)
+		if err != nil {
+			return err
+		}
+		txns, err := txRowsToSlice(stmt)
+		handleClose(stmt)
+		if err != nil {
+			return err
+		}
+		//the ids of the entries recorded at each date by each user, in order
+		type key struct {
+			date int64
+			user string
+		}
+		ids := make(map[key][]int64)
+		stmt, err = conn.Prepare(`SELECT id, date, user FROM entries ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		defer handleClose(stmt)
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				break
+			}
+			var (
+				id, date int64
+				user     string
+			)
+			if err := stmt.Scan(&id, &date, &user); err != nil {
+				return err
+			}
+			ids[key{date, user}] = append(ids[key{date, user}], id)
+		}
+		for _, group := range recordedTogether(txns) {
+			want, ok := journalEntry(group...)
+			if !ok {
+				continue
+			}
+			k := key{want.Date.Time().UnixNano(), want.User}
+			if len(ids[k]) == 0 {
+				continue
+			}
+			e := Entry{ID: ids[k][0], User: want.User}
+			ids[k] = ids[k][1:]
+			if err := linkEntry(conn, &e, group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//recordedTogether groups txns in the order recorded into the transactions
+//that make up one journal entry, pairing the two sides of each transfer
+func recordedTogether(txns []Txn) [][]Txn {
+	var groups [][]Txn
+	for i := 0; i < len(txns); i++ {
+		group := txns[i : i+1]
+		if txns[i].Transfer && i+1 < len(txns) && txns[i+1].Transfer && txns[i+1].Date.Time().Equal(txns[i].Date.Time()) {
+			group = txns[i : i+2]
+			i++
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+//unjournaledTxns returns every transaction in the order recorded if the
+//journal is empty
+func unjournaledTxns(conn *sqlite3.Conn) ([]Txn, error) {
+	stmt, err := conn.Prepare(`SELECT rowid, tx FROM txs WHERE NOT EXISTS(SELECT 1 FROM entries) ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
 	defer handleClose(stmt)
-	return stmt.Exec()
+	return txRowsToSlice(stmt)
 }
 
-//GetTransactions returns a slice of Txns within the given time range.
-//Ignores Summary transactions
-func (db *DB) GetTransactions(t1 time.Time, t2 time.Time) ([]Txn, error) {
+//PutEntry records a journal entry that isn't a transaction, setting its ID
+func (db *DB) PutEntry(e *Entry) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return conn.WithTx(func() error {
+		return insertEntry(conn, e)
+	})
+}
 
-	sql := `SELECT tx FROM txs
-WHERE %s AND NOT json_extract(txs.tx, '$.Summary')`
+//GetEntries returns the journal entries between t1 and t2 in the order
+//they were recorded
+func (db *DB) GetEntries(t1 time.Time, t2 time.Time) ([]Entry, error) {
+	sql := `SELECT entries.id, entries.date, entries.user, entries.note, postings.account, postings.amount
+FROM entries JOIN postings ON postings.entry = entries.id
+WHERE entries.date >= (?) AND entries.date <= (?)
+ORDER BY entries.id, postings.rowid`
 
 	conn, err := db.conn()
 	if err != nil {
 		return nil, err
 	}
-	defer handleClose(conn)
+	defer db.release()
 
-	stmt, err := conn.Prepare(fmt.Sprintf(sql, betweenTimes()), t1.UnixNano(), t2.UnixNano())
+	stmt, err := conn.Prepare(sql, t1.UnixNano(), t2.UnixNano())
 	if err != nil {
 		return nil, err
 	}
 	defer handleClose(stmt)
 
-	return txRowsToSlice(stmt)
+	var entries []Entry
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			id, date, amt       int64
+			user, note, account string
+		)
+		if err := stmt.Scan(&id, &date, &user, &note, &account, &amt); err != nil {
+			return nil, err
+		}
+		if n := len(entries); n == 0 || entries[n-1].ID != id {
+			entries = append(entries, Entry{ID: id, Date: Timestamp(time.Unix(0, date)), User: user, Note: note})
+		}
+		e := &entries[len(entries)-1]
+		e.Postings = append(e.Postings, Posting{account, USD(amt)})
+	}
+	return entries, nil
 }
 
-func (db *DB) GetTransactionsSince(t time.Time) ([]Txn, error) {
+//GetEntryTransactions returns the transactions recorded with each journal
+//entry, by the entry's ID
+func (db *DB) GetEntryTransactions() (map[int64][]Txn, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT rowid, tx, entry FROM txs WHERE entry IS NOT NULL ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	txns := make(map[int64][]Txn)
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			id, entry int64
+			tx        string
+		)
+		if err := stmt.Scan(&id, &tx, &entry); err != nil {
+			return nil, err
+		}
+		t := Txn{ID: id}
+		if err := json.Unmarshal([]byte(tx), &t); err != nil {
+			return nil, err
+		}
+		txns[entry] = append(txns[entry], t)
+	}
+	return txns, nil
+}
+
+//GetAccountBalance returns the balance of a journal account at t
+func (db *DB) GetAccountBalance(account string, t time.Time) (USD, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT IFNULL(SUM(amount), 0) FROM postings WHERE account = (?) AND date <= (?)`, account, t.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	defer handleClose(stmt)
 
-	sql := `SELECT tx FROM txs
-WHERE %s >= (?) AND NOT json_extract(txs.tx, '$.Summary')`
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	var bal int64
+	err = stmt.Scan(&bal)
+	return USD(bal), err
+}
+
+//PutTransactions records every transaction in txns as a single journal
+//entry, or none of them if any fails
+func (db *DB) PutTransactions(txns []Txn) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return conn.WithTx(func() error {
+		_, err := putTransactions(conn, txns)
+		return err
+	})
+}
+
+//ImportTransactions adds accounts and records txns in order along with their
+//journal entries. Either everything is recorded or nothing is.
+func (db *DB) ImportTransactions(accounts []Account, txns []Txn) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return conn.WithTx(func() error {
+		for _, a := range accounts {
+			if err := putAccount(conn, a); err != nil {
+				return err
+			}
+		}
+		for _, group := range recordedTogether(txns) {
+			if _, err := putTransactions(conn, group); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
+//GetAllTransactions returns every transaction in the order recorded,
+//including starting balances, period summaries and transfers
+func (db *DB) GetAllTransactions() ([]Txn, error) {
 	conn, err := db.conn()
 	if err != nil {
 		return nil, err
 	}
-	defer handleClose(conn)
+	defer db.release()
 
-	stmt, err := conn.Prepare(fmt.Sprintf(sql, date), t.UnixNano())
+	stmt, err := conn.Prepare(`SELECT rowid, tx FROM txs ORDER BY rowid`)
 	if err != nil {
 		return nil, err
 	}
 	defer handleClose(stmt)
-
 	return txRowsToSlice(stmt)
 }
 
-//GetBalance returns the sum of transaction amounts since a given time.
-func (db DB) GetBalance(t time.Time) (USD, error) {
-	sql := `SELECT SUM(json_extract(txs.tx, '$.Amount')) AS amt FROM txs WHERE %s >= (?)`
+//Backup writes a consistent copy of the database to path, which must not exist
+func (db *DB) Backup(path string) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return conn.Exec(`VACUUM INTO (?)`, path)
+}
 
+//HasTransactions returns whether any transactions have been recorded
+func (db *DB) HasTransactions() (bool, error) {
 	conn, err := db.conn()
 	if err != nil {
-		return -1, err
+		return false, err
 	}
-	defer handleClose(conn)
+	defer db.release()
 
-	stmt, err := conn.Prepare(fmt.Sprintf(sql, date), t.UnixNano())
+	stmt, err := conn.Prepare(`SELECT EXISTS(SELECT 1 FROM txs)`)
 	if err != nil {
-		return -1, err
+		return false, err
 	}
 	defer handleClose(stmt)
 
-	hasRow, err := stmt.Step()
-	if !hasRow {
-		return 0, nil
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	var exists int64
+	if err := stmt.Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists == 1, nil
+}
+
+//GetTransactions returns a slice of Txns within the given time range, oldest first.
+//Ignores Summary transactions
+func (db *DB) GetTransactions(t1 time.Time, t2 time.Time) ([]Txn, error) {
+
+	sql := `SELECT rowid, tx FROM txs
+WHERE %s AND NOT json_extract(txs.tx, '$.Summary') AND %s
+ORDER BY %s, rowid`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, betweenTimes(), notTransfer, date), t1.UnixNano(), t2.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	return txRowsToSlice(stmt)
+}
+
+func (db *DB) GetTransactionsSince(t time.Time) ([]Txn, error) {
+
+	sql := `SELECT rowid, tx FROM txs
+WHERE %s >= (?) AND NOT json_extract(txs.tx, '$.Summary') AND %s`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
 	}
+	defer db.release()
 
-	var amt int64
-	err = stmt.Scan(&amt)
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, date, notTransfer), t.UnixNano())
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	return USD(amt), nil
+	defer handleClose(stmt)
+
+	return txRowsToSlice(stmt)
 }
 
 //GetBalance returns the sum of transaction amounts grouped by username between two timestamps
-func (db DB) GetTagBalance(tag string, t1 time.Time, t2 time.Time) (*TagBalance, error) {
+func (db *DB) GetTagBalance(tag string, t1 time.Time, t2 time.Time) (*TagBalance, error) {
 	sql := `Select json_extract(txs.tx, '$.User'), SUM(json_extract(txs.tx, '$.Amount')) as amt 
 From txs, json_each(json_extract(txs.tx, '$.Tags'))
 WHERE %s AND json_each.value = (?)
@@ -178,7 +667,7 @@ ORDER BY amt`
 	if err != nil {
 		return nil, err
 	}
-	defer handleClose(conn)
+	defer db.release()
 
 	stmt, err := conn.Prepare(fmt.Sprintf(sql, betweenTimes()), t1.UnixNano(), t2.UnixNano(), tag)
 	if err != nil {
@@ -210,15 +699,60 @@ ORDER BY amt`
 	return tb, nil
 }
 
+//GetTagBalances returns the balance of every tag used between t1 and t2 by
+//each user, in alphabetical order of the tags
+func (db *DB) GetTagBalances(t1 time.Time, t2 time.Time) ([]*TagBalance, error) {
+	sql := `SELECT json_each.value AS tag, json_extract(txs.tx, '$.User'), SUM(json_extract(txs.tx, '$.Amount'))
+FROM txs, json_each(json_extract(txs.tx, '$.Tags'))
+WHERE %s
+GROUP BY tag, json_extract(txs.tx, '$.User')
+ORDER BY tag`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, betweenTimes()), t1.UnixNano(), t2.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	var tbs []*TagBalance
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			tag, usr string
+			bal      int64
+		)
+		if err = stmt.Scan(&tag, &usr, &bal); err != nil {
+			return nil, err
+		}
+		if n := len(tbs); n == 0 || tbs[n-1].tag != tag {
+			tbs = append(tbs, NewTagBalance(tag))
+		}
+		tbs[len(tbs)-1].Add(usr, USD(bal))
+	}
+	return tbs, nil
+}
+
 //GetTags returns a list of distinct tags
-func (db DB) GetTags() ([]string, error) {
+func (db *DB) GetTags() ([]string, error) {
 	sql := `SELECT DISTINCT json_each.value FROM txs, json_each(json_extract(txs.tx, '$.Tags'))`
 
 	conn, err := db.conn()
 	if err != nil {
 		return nil, err
 	}
-	defer handleClose(conn)
+	defer db.release()
 
 	stmt, err := conn.Prepare(sql)
 	if err != nil {
@@ -242,3 +776,695 @@ func (db DB) GetTags() ([]string, error) {
 	}
 	return tags, nil
 }
+
+//AdvanceCursor records c as the last message processed in its conversation.
+//It returns false without changing anything if a later message was already recorded.
+func (db *DB) AdvanceCursor(c Cursor) (bool, error) {
+	sql := `INSERT INTO cursors VALUES (?, ?, ?)
+ON CONFLICT(conv) DO UPDATE SET msgid = excluded.msgid, channel = excluded.channel
+WHERE excluded.msgid > cursors.msgid`
+
+	channel, err := toJsonString(c.Channel)
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := db.conn()
+	if err != nil {
+		return false, err
+	}
+	defer db.release()
+
+	if err := conn.Exec(sql, string(c.ConvID), int64(c.MsgID), channel); err != nil {
+		return false, err
+	}
+	return conn.Changes() > 0, nil
+}
+
+//GetCursors returns the last message processed in every known conversation
+func (db *DB) GetCursors() ([]Cursor, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT conv, msgid, channel FROM cursors`)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	var cursors []Cursor
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+
+		var (
+			conv    string
+			msgid   int64
+			channel string
+			c       Cursor
+		)
+		if err := stmt.Scan(&conv, &msgid, &channel); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(channel), &c.Channel); err != nil {
+			return nil, err
+		}
+		c.ConvID = chat1.ConvIDStr(conv)
+		c.MsgID = chat1.MessageID(msgid)
+		cursors = append(cursors, c)
+	}
+	return cursors, nil
+}
+
+//PutLedger registers a conversation as a ledger. Registering a
+//conversation again keeps the original registration.
+func (db *DB) PutLedger(l Ledger) error {
+	ljson, err := toJsonString(l)
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return conn.Exec(`INSERT OR IGNORE INTO ledgers VALUES (?, ?)`, string(l.ConvID), ljson)
+}
+
+//GetLedgers returns every conversation registered as a ledger
+func (db *DB) GetLedgers() ([]Ledger, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT ledger FROM ledgers`)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	var ledgers []Ledger
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+
+		var ljson string
+		if err := stmt.Scan(&ljson); err != nil {
+			return nil, err
+		}
+		var l Ledger
+		if err := json.Unmarshal([]byte(ljson), &l); err != nil {
+			return nil, err
+		}
+		ledgers = append(ledgers, l)
+	}
+	return ledgers, nil
+}
+
+//PutSetting sets a per user setting
+func (db *DB) PutSetting(user, key, value string) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return conn.Exec(`INSERT OR REPLACE INTO settings VALUES (?, ?, ?)`, user, key, value)
+}
+
+//GetSetting returns a per user setting, or an empty string if it isn't set
+func (db *DB) GetSetting(user, key string) (string, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return "", err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT value FROM settings WHERE user = (?) AND key = (?)`, user, key)
+	if err != nil {
+		return "", err
+	}
+	defer handleClose(stmt)
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return "", err
+	}
+	var value string
+	err = stmt.Scan(&value)
+	return value, err
+}
+
+//GetTagForNote returns the first tag of the latest transaction with the
+//given note, ignoring case, or an empty string if there's none
+func (db *DB) GetTagForNote(note string) (string, error) {
+	sql := `SELECT json_extract(txs.tx, '$.Tags[0]') FROM txs
+WHERE lower(json_extract(txs.tx, '$.Note')) = lower(?) AND json_array_length(txs.tx, '$.Tags') > 0
+ORDER BY rowid DESC LIMIT 1`
+
+	conn, err := db.conn()
+	if err != nil {
+		return "", err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(sql, note)
+	if err != nil {
+		return "", err
+	}
+	defer handleClose(stmt)
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return "", err
+	}
+	var tag string
+	err = stmt.Scan(&tag)
+	return tag, err
+}
+
+//GetTagAverage returns the average spent by the transactions tagged with tag
+//and how many there are, leaving out income, transfers and summaries
+func (db *DB) GetTagAverage(tag string) (USD, int, error) {
+	sql := `SELECT CAST(AVG(-json_extract(txs.tx, '$.Amount')) AS INTEGER), COUNT(*)
+FROM txs, json_each(json_extract(txs.tx, '$.Tags'))
+WHERE json_each.value = (?) AND NOT json_extract(txs.tx, '$.Summary') AND %s AND json_extract(txs.tx, '$.Amount') < 0`
+
+	conn, err := db.conn()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, notTransfer), tag)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer handleClose(stmt)
+
+	if _, err = stmt.Step(); err != nil {
+		return 0, 0, err
+	}
+	var (
+		avg int64
+		n   int
+	)
+	err = stmt.Scan(&avg, &n)
+	return USD(avg), n, err
+}
+
+//PutPending stores a transaction until it's confirmed
+func (db *DB) PutPending(p PendingTxn) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	tjson, err := p.Txn.Json()
+	if err != nil {
+		return err
+	}
+	return conn.Exec(`INSERT OR REPLACE INTO pending VALUES (?, ?, ?, ?, ?, ?)`, string(p.ConvID), int64(p.PromptID), int64(p.CmdID), tjson,
+		p.Sender, p.Created.Time().UnixNano())
+}
+
+//GetPending returns the transaction waiting on the prompt with the given id,
+//or nil if there isn't one
+func (db *DB) GetPending(convID chat1.ConvIDStr, promptID chat1.MessageID) (*PendingTxn, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	return getPending(conn, convID, promptID)
+}
+
+//TakePending removes and returns the transaction waiting on the prompt with
+//the given id, or nil if there isn't one
+func (db *DB) TakePending(convID chat1.ConvIDStr, promptID chat1.MessageID) (*PendingTxn, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	p, err := getPending(conn, convID, promptID)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	if err = conn.Exec(`DELETE FROM pending WHERE conv = (?) AND prompt = (?)`, string(convID), int64(promptID)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func getPending(conn *sqlite3.Conn, convID chat1.ConvIDStr, promptID chat1.MessageID) (*PendingTxn, error) {
+	stmt, err := conn.Prepare(`SELECT cmd, tx, IFNULL(sender, ''), IFNULL(created, 0) FROM pending WHERE conv = (?) AND prompt = (?)`,
+		string(convID), int64(promptID))
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	hasRow, err := stmt.Step()
+	if err != nil || !hasRow {
+		return nil, err
+	}
+	var (
+		cmd     int64
+		tjson   string
+		sender  string
+		created int64
+	)
+	if err = stmt.Scan(&cmd, &tjson, &sender, &created); err != nil {
+		return nil, err
+	}
+	p := &PendingTxn{ConvID: convID, PromptID: promptID, CmdID: chat1.MessageID(cmd), Sender: sender, Created: Timestamp(time.Unix(0, created))}
+	if err = json.Unmarshal([]byte(tjson), &p.Txn); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//GetTagBreakdown returns what was spent on every tag between t1 and t2 by
+//each user, and the total spent. A transaction counts towards its first tag
+//only, so the tags add up to the total.
+func (db *DB) GetTagBreakdown(t1 time.Time, t2 time.Time) ([]*TagBalance, USD, error) {
+	sql := `SELECT json_extract(txs.tx, '$.Tags[0]') AS tag, json_extract(txs.tx, '$.User'), SUM(json_extract(txs.tx, '$.Amount')),
+	(SELECT SUM(json_extract(txs.tx, '$.Amount')) FROM txs
+		WHERE %[1]s AND NOT json_extract(txs.tx, '$.Summary') AND %[2]s AND json_extract(txs.tx, '$.Amount') < 0)
+FROM txs
+WHERE %[1]s AND NOT json_extract(txs.tx, '$.Summary') AND %[2]s AND json_extract(txs.tx, '$.Amount') < 0 AND tag IS NOT NULL
+GROUP BY tag, json_extract(txs.tx, '$.User')`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, betweenTimes(), notTransfer), t1.UnixNano(), t2.UnixNano(), t1.UnixNano(), t2.UnixNano())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer handleClose(stmt)
+
+	tbs := make(map[string]*TagBalance)
+	var total int64
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !hasRow {
+			break
+		}
+
+		var (
+			tag, usr string
+			bal      int64
+		)
+		if err = stmt.Scan(&tag, &usr, &bal, &total); err != nil {
+			return nil, 0, err
+		}
+		if tbs[tag] == nil {
+			tbs[tag] = NewTagBalance(tag)
+		}
+		tbs[tag].Add(usr, USD(bal))
+	}
+
+	breakdown := make([]*TagBalance, 0, len(tbs))
+	for _, tb := range tbs {
+		breakdown = append(breakdown, tb)
+	}
+	//most spent first
+	sort.Slice(breakdown, func(i, j int) bool {
+		if breakdown[i].total == breakdown[j].total {
+			return breakdown[i].tag < breakdown[j].tag
+		}
+		return breakdown[i].total < breakdown[j].total
+	})
+	return breakdown, USD(-total), nil
+}
+
+//PutGoal stores a savings goal, replacing any goal with the same name
+func (db *DB) PutGoal(g Goal) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	gjson, err := g.Json()
+	if err != nil {
+		return err
+	}
+	return conn.Exec(`INSERT OR REPLACE INTO goals VALUES (?, ?)`, g.Name, gjson)
+}
+
+//GetGoal returns the goal with the given name, or nil if there isn't one
+func (db *DB) GetGoal(name string) (*Goal, error) {
+	goals, err := db.getGoals(`SELECT goal FROM goals WHERE name = (?)`, name)
+	if err != nil || len(goals) == 0 {
+		return nil, err
+	}
+	return &goals[0], nil
+}
+
+//GetGoals returns every savings goal ordered by deadline
+func (db *DB) GetGoals() ([]Goal, error) {
+	return db.getGoals(`SELECT goal FROM goals ORDER BY json_extract(goal, '$.Deadline')`)
+}
+
+func (db *DB) getGoals(sql string, args ...interface{}) ([]Goal, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	var goals []Goal
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var gjson string
+		if err := stmt.Scan(&gjson); err != nil {
+			return nil, err
+		}
+		var g Goal
+		if err := json.Unmarshal([]byte(gjson), &g); err != nil {
+			return nil, err
+		}
+		goals = append(goals, g)
+	}
+	return goals, nil
+}
+
+//PutAccount adds an account
+func (db *DB) PutAccount(a Account) error {
+	conn, err := db.conn()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	return putAccount(conn, a)
+}
+
+func putAccount(conn *sqlite3.Conn, a Account) error {
+	ajson, err := a.Json()
+	if err != nil {
+		return err
+	}
+	return conn.Exec(`INSERT INTO accounts VALUES (?, ?)`, a.Name, ajson)
+}
+
+//GetAccount returns the account with the given name, or nil if there isn't one
+func (db *DB) GetAccount(name string) (*Account, error) {
+	accounts, err := db.getAccounts(`SELECT account FROM accounts WHERE name = (?)`, name)
+	if err != nil || len(accounts) == 0 {
+		return nil, err
+	}
+	return &accounts[0], nil
+}
+
+//GetAccounts returns every account that was added ordered by name
+func (db *DB) GetAccounts() ([]Account, error) {
+	return db.getAccounts(`SELECT account FROM accounts ORDER BY name`)
+}
+
+func (db *DB) getAccounts(sql string, args ...interface{}) ([]Account, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	var accounts []Account
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var ajson string
+		if err := stmt.Scan(&ajson); err != nil {
+			return nil, err
+		}
+		var a Account
+		if err := json.Unmarshal([]byte(ajson), &a); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+//GetAccountBalances returns the balance at t of every account with
+//transactions, from the journal
+func (db *DB) GetAccountBalances(t time.Time) (map[string]USD, error) {
+	sql := `SELECT substr(account, (?)), SUM(amount) FROM postings
+WHERE substr(account, 1, (?)) = (?) AND date <= (?)
+GROUP BY account`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(sql, len(assetsPrefix)+1, len(assetsPrefix), assetsPrefix, t.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	balances := make(map[string]USD)
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var (
+			name string
+			bal  int64
+		)
+		if err := stmt.Scan(&name, &bal); err != nil {
+			return nil, err
+		}
+		balances[name] = USD(bal)
+	}
+	return balances, nil
+}
+
+//GetNetWorth returns the total of every asset account at t, from the journal
+func (db *DB) GetNetWorth(t time.Time) (USD, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT IFNULL(SUM(amount), 0) FROM postings WHERE substr(account, 1, (?)) = (?) AND date <= (?)`,
+		len(assetsPrefix), assetsPrefix, t.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	defer handleClose(stmt)
+
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	var bal int64
+	err = stmt.Scan(&bal)
+	return USD(bal), err
+}
+
+//GetUnjournaledTransactions returns the transactions that weren't recorded
+//with a journal entry, oldest first. Period summaries are left out.
+func (db *DB) GetUnjournaledTransactions() ([]Txn, error) {
+	sql := `SELECT rowid, tx FROM txs WHERE entry IS NULL AND %s ORDER BY %s, rowid`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, notPeriodSummary, date), summaryUser)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	return txRowsToSlice(stmt)
+}
+
+//GetUnbalancedEntries returns the ids of the journal entries whose postings
+//don't add up to zero
+func (db *DB) GetUnbalancedEntries() ([]int64, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT entry FROM postings GROUP BY entry HAVING SUM(amount) != 0 ORDER BY entry`)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	var ids []int64
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		var id int64
+		if err := stmt.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+//GetPeriodSummaries returns the period summaries older versions recorded
+func (db *DB) GetPeriodSummaries() ([]Txn, error) {
+	sql := `SELECT rowid, tx FROM txs
+WHERE json_extract(txs.tx, '$.Summary') AND json_extract(txs.tx, '$.User') = (?)
+ORDER BY %s`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, date), summaryUser)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	return txRowsToSlice(stmt)
+}
+
+//GetUnclearedTransactions returns the transactions in an account up to t that
+//haven't shown up on a bank statement, oldest first. Starting balances and
+//period summaries are left out.
+func (db *DB) GetUnclearedTransactions(account string, t time.Time) ([]Txn, error) {
+	sql := `SELECT rowid, tx FROM txs
+WHERE %s <= (?) AND NOT json_extract(txs.tx, '$.Summary') AND NOT IFNULL(json_extract(txs.tx, '$.Cleared'), 0)
+	AND IFNULL(NULLIF(json_extract(txs.tx, '$.Account'), ''), (?)) = (?)
+ORDER BY %s, rowid`
+
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(fmt.Sprintf(sql, date, date), t.UnixNano(), defaultAccount, account)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	return txRowsToSlice(stmt)
+}
+
+//GetTransaction returns the transaction with the given id, or nil if there
+//isn't one
+func (db *DB) GetTransaction(id int64) (*Txn, error) {
+	conn, err := db.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+
+	stmt, err := conn.Prepare(`SELECT rowid, tx FROM txs WHERE rowid = (?)`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer handleClose(stmt)
+
+	txns, err := txRowsToSlice(stmt)
+	if err != nil || len(txns) == 0 {
+		return nil, err
+	}
+	return &txns[0], nil
+}
+
+//ClearTransactions marks the transactions in account with the given ids as
+//having shown up on a bank statement. It returns how many were cleared, ids
+//of starting balances, period summaries, transactions in other accounts and
+//transactions that were already cleared aren't counted.
+func (db *DB) ClearTransactions(account string, ids []int64) (int, error) {
+	sql := `UPDATE txs SET tx = json_set(tx, '$.Cleared', json('true'))
+WHERE rowid = (?) AND NOT json_extract(txs.tx, '$.Summary') AND NOT IFNULL(json_extract(txs.tx, '$.Cleared'), 0)
+	AND IFNULL(NULLIF(json_extract(txs.tx, '$.Account'), ''), (?)) = (?)`
+
+	conn, err := db.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer db.release()
+
+	var cleared int
+	err = conn.WithTx(func() error {
+		for _, id := range ids {
+			if err := conn.Exec(sql, id, defaultAccount, account); err != nil {
+				return err
+			}
+			cleared += conn.Changes()
+		}
+		return nil
+	})
+	return cleared, err
+}
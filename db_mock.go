@@ -3,7 +3,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"log"
 	"os"
 	"time"
@@ -13,14 +15,23 @@ type closer interface {
 	Close() error
 }
 
+//ErrDBClosed is returned by queries made after the database is closed
+var ErrDBClosed = errors.New("database is closed")
+
 //DB describes a low level sqlite3 database implementation
-type DB string
+type DB struct {
+	path string
+}
+
+func NewDB(path string) *DB {
+	return &DB{path: path}
+}
 
 func handleClose(c closer) {
 	fmt.Print("mockdb: handle close")
 }
 
-func (db DB) conn() {
+func (db *DB) conn() {
 	f, err := os.Create(db.String())
 	defer f.Close()
 	if err != nil {
@@ -28,15 +39,20 @@ func (db DB) conn() {
 	}
 }
 
-func (db DB) Init() error {
+func (db *DB) Init() error {
 	log.Println("mockdb: initialize")
 	db.conn()
 	return nil
 }
 
-//String casts db as a string
-func (db DB) String() string {
-	return string(db)
+func (db *DB) Close() error {
+	log.Println("mockdb: close")
+	return nil
+}
+
+//String returns the location of the database
+func (db *DB) String() string {
+	return db.path
 }
 
 func (db *DB) PutTransaction(t Txn) error {
@@ -45,60 +61,75 @@ func (db *DB) PutTransaction(t Txn) error {
 	return nil
 }
 
+func (db *DB) InsertTransaction(t Txn) (int64, error) {
+	log.Println("MockDb: Insert Txn:", t)
+	return 1, nil
+}
+
 //GetTransactions returns a slice of Txns within the given time range.
 //Ignores Summary transactions
 func (db *DB) GetTransactions(t1 time.Time, t2 time.Time) ([]Txn, error) {
 	log.Println(fmt.Sprintf("MockDb: GetTxns: tx1: %v, tx2: %v", t1, t2))
 	return []Txn{
 		Txn{
-			Timestamp(t1),
-			USD(1000),
-			[]string{"mock_db"},
-			"mock_db GetTxn",
-			"mocker",
-			false,
+			Date:   Timestamp(t1),
+			Amount: USD(1000),
+			Tags:   []string{"mock_db"},
+			Note:   "mock_db GetTxn",
+			User:   "mocker",
 		},
 		Txn{
-			Timestamp(t2),
-			USD(-2000),
-			[]string{"mock_db"},
-			"mock_db GetTxn",
-			"mocker",
-			false,
+			Date:   Timestamp(t2),
+			Amount: USD(-2000),
+			Tags:   []string{"mock_db"},
+			Note:   "mock_db GetTxn",
+			User:   "mocker",
 		},
 	}, nil
 }
 
+func (db *DB) PutTransactions(txns []Txn) error {
+	log.Println("MockDb: Put Txns:", len(txns))
+	return nil
+}
+
+func (db *DB) ImportTransactions(accounts []Account, txns []Txn) error {
+	log.Println("MockDb: Import Txns:", len(accounts), len(txns))
+	return nil
+}
+
+func (db *DB) GetAllTransactions() ([]Txn, error) {
+	log.Println("MockDb: GetAllTxns")
+	return []Txn{{Date: TimestampNow(), Amount: -1000, Tags: []string{"mock_db"}, User: "mocker", ID: 1}}, nil
+}
+
+func (db *DB) Backup(path string) error {
+	log.Println("MockDb: Backup:", path)
+	return nil
+}
+
 func (db *DB) GetTransactionsSince(t time.Time) ([]Txn, error) {
 	log.Println("MockDb: GetTxnsSince: tx1:", t)
 	return []Txn{
 		Txn{
-			Timestamp(t.Add(1 * time.Hour)),
-			USD(1000),
-			[]string{"mock_db"},
-			"mock_db GetTxn",
-			"mocker",
-			false,
+			Date:   Timestamp(t.Add(1 * time.Hour)),
+			Amount: USD(1000),
+			Tags:   []string{"mock_db"},
+			Note:   "mock_db GetTxn",
+			User:   "mocker",
 		},
 		Txn{
-			Timestamp(t),
-			USD(-2000),
-			[]string{"mock_db"},
-			"mock_db GetTxn",
-			"mocker",
-			false,
+			Date:   Timestamp(t),
+			Amount: USD(-2000),
+			Tags:   []string{"mock_db"},
+			Note:   "mock_db GetTxn",
+			User:   "mocker",
 		},
 	}, nil
 }
 
-//GetBalance returns the sum of transaction amounts since a given time.
-func (db DB) GetBalance(t time.Time) (USD, error) {
-	log.Println("MockDb: GetBalance:", t)
-	return USD(300), nil
-}
-
 //GetBalance returns the sum of transaction amounts grouped by username between two timestamps
-func (db DB) GetTagBalance(tag string, t1 time.Time, t2 time.Time) (*TagBalance, error) {
+func (db *DB) GetTagBalance(tag string, t1 time.Time, t2 time.Time) (*TagBalance, error) {
 	log.Printf("MockDb: GetTagBalance: tag:%s, t1-%v, t2-%v", tag, t1, t2)
 	tb := NewTagBalance(tag)
 	tb.Add("user1", 100)
@@ -106,8 +137,16 @@ func (db DB) GetTagBalance(tag string, t1 time.Time, t2 time.Time) (*TagBalance,
 	return tb, nil
 }
 
+func (db *DB) GetTagBalances(t1 time.Time, t2 time.Time) ([]*TagBalance, error) {
+	log.Printf("MockDb: GetTagBalances: t1-%v, t2-%v", t1, t2)
+	tb := NewTagBalance("mock_db")
+	tb.Add("user1", 100)
+	tb.Add("user2", 200)
+	return []*TagBalance{tb}, nil
+}
+
 //GetTags returns a list of distinct tags
-func (db DB) GetTags() ([]string, error) {
+func (db *DB) GetTags() ([]string, error) {
 	log.Print("mockDb: GetTags")
 	return []string{
 		"tag1",
@@ -115,3 +154,166 @@ func (db DB) GetTags() ([]string, error) {
 		"tag3",
 	}, nil
 }
+
+func (db *DB) AdvanceCursor(c Cursor) (bool, error) {
+	log.Printf("mockDb: AdvanceCursor: conv: %s, msg: %v", c.ConvID, c.MsgID)
+	return true, nil
+}
+
+func (db *DB) GetCursors() ([]Cursor, error) {
+	log.Print("mockDb: GetCursors")
+	return nil, nil
+}
+
+func (db *DB) HasTransactions() (bool, error) {
+	log.Print("mockDb: HasTransactions")
+	return true, nil
+}
+
+func (db *DB) PutLedger(l Ledger) error {
+	log.Println("mockDb: PutLedger:", l.ConvID)
+	return nil
+}
+
+func (db *DB) GetLedgers() ([]Ledger, error) {
+	log.Print("mockDb: GetLedgers")
+	return nil, nil
+}
+
+func (db *DB) PutSetting(user, key, value string) error {
+	log.Printf("mockDb: PutSetting: %s %s=%s", user, key, value)
+	return nil
+}
+
+func (db *DB) GetSetting(user, key string) (string, error) {
+	log.Printf("mockDb: GetSetting: %s %s", user, key)
+	return "", nil
+}
+
+func (db *DB) GetTagAverage(tag string) (USD, int, error) {
+	log.Printf("mockDb: GetTagAverage: %s", tag)
+	return 1000, 10, nil
+}
+
+func (db *DB) PutPending(p PendingTxn) error {
+	log.Printf("mockDb: PutPending: %s %v", p.ConvID, p.PromptID)
+	return nil
+}
+
+func (db *DB) GetPending(convID chat1.ConvIDStr, promptID chat1.MessageID) (*PendingTxn, error) {
+	log.Printf("mockDb: GetPending: %s %v", convID, promptID)
+	return mockPending(convID, promptID), nil
+}
+
+func (db *DB) TakePending(convID chat1.ConvIDStr, promptID chat1.MessageID) (*PendingTxn, error) {
+	log.Printf("mockDb: TakePending: %s %v", convID, promptID)
+	return mockPending(convID, promptID), nil
+}
+
+func mockPending(convID chat1.ConvIDStr, promptID chat1.MessageID) *PendingTxn {
+	txn := Txn{Date: TimestampNow(), Amount: -1000, Tags: []string{"tag"}, User: "user"}
+	return &PendingTxn{ConvID: convID, PromptID: promptID, CmdID: 1, Txn: txn, Sender: "user", Created: TimestampNow()}
+}
+
+func (db *DB) GetTagBreakdown(t1 time.Time, t2 time.Time) ([]*TagBalance, USD, error) {
+	log.Printf("mockDb: GetTagBreakdown: %s - %s", t1, t2)
+	tb := NewTagBalance("tag")
+	tb.Add("user", -1000)
+	return []*TagBalance{tb}, 1000, nil
+}
+
+func (db *DB) PutGoal(g Goal) error {
+	log.Printf("mockDb: PutGoal: %s", g.Name)
+	return nil
+}
+
+func (db *DB) GetGoal(name string) (*Goal, error) {
+	log.Printf("mockDb: GetGoal: %s", name)
+	return &Goal{name, 300000, Timestamp(time.Now().AddDate(1, 0, 0)), TimestampNow(), "user"}, nil
+}
+
+func (db *DB) GetGoals() ([]Goal, error) {
+	log.Printf("mockDb: GetGoals")
+	return []Goal{{"goal", 300000, Timestamp(time.Now().AddDate(1, 0, 0)), TimestampNow(), "user"}}, nil
+}
+
+func (db *DB) PutAccount(a Account) error {
+	log.Printf("mockDb: PutAccount: %s", a.Name)
+	return nil
+}
+
+func (db *DB) GetAccount(name string) (*Account, error) {
+	log.Printf("mockDb: GetAccount: %s", name)
+	return &Account{name, TimestampNow(), "user"}, nil
+}
+
+func (db *DB) GetAccounts() ([]Account, error) {
+	log.Printf("mockDb: GetAccounts")
+	return []Account{{"checking", TimestampNow(), "user"}}, nil
+}
+
+func (db *DB) GetAccountBalances(t time.Time) (map[string]USD, error) {
+	log.Printf("mockDb: GetAccountBalances: %s", t)
+	return map[string]USD{defaultAccount: 300, "checking": 1000}, nil
+}
+
+func (db *DB) PutEntry(e *Entry) error {
+	log.Printf("mockDb: PutEntry: %s", e)
+	e.ID = 1
+	return nil
+}
+
+func (db *DB) GetEntries(t1 time.Time, t2 time.Time) ([]Entry, error) {
+	log.Printf("mockDb: GetEntries: %s - %s", t1, t2)
+	return []Entry{{1, Timestamp(t1), "mocker", "mock_db GetEntries", []Posting{{assetAccount(""), -1000}, {"expenses:mock_db", 1000}}}}, nil
+}
+
+func (db *DB) GetEntryTransactions() (map[int64][]Txn, error) {
+	log.Println("mockDb: GetEntryTransactions")
+	return map[int64][]Txn{1: {{Date: TimestampNow(), Amount: -1000, Tags: []string{"mock_db"}, User: "mocker", ID: 1}}}, nil
+}
+
+func (db *DB) GetAccountBalance(account string, t time.Time) (USD, error) {
+	log.Printf("mockDb: GetAccountBalance: %s %s", account, t)
+	return 300, nil
+}
+
+func (db *DB) GetNetWorth(t time.Time) (USD, error) {
+	log.Printf("mockDb: GetNetWorth: %s", t)
+	return 1300, nil
+}
+
+func (db *DB) GetUnjournaledTransactions() ([]Txn, error) {
+	log.Printf("mockDb: GetUnjournaledTransactions")
+	return nil, nil
+}
+
+func (db *DB) GetUnbalancedEntries() ([]int64, error) {
+	log.Printf("mockDb: GetUnbalancedEntries")
+	return nil, nil
+}
+
+func (db *DB) GetPeriodSummaries() ([]Txn, error) {
+	log.Printf("mockDb: GetPeriodSummaries")
+	return nil, nil
+}
+
+func (db *DB) GetUnclearedTransactions(account string, t time.Time) ([]Txn, error) {
+	log.Printf("mockDb: GetUnclearedTransactions: %s %s", account, t)
+	return []Txn{{Date: Timestamp(t), Amount: -1000, Tags: []string{"mock_db"}, User: "mocker", ID: 1}}, nil
+}
+
+func (db *DB) GetTagForNote(note string) (string, error) {
+	log.Printf("mockDb: GetTagForNote: %s", note)
+	return "mock_db", nil
+}
+
+func (db *DB) GetTransaction(id int64) (*Txn, error) {
+	log.Printf("mockDb: GetTransaction: %v", id)
+	return &Txn{Date: TimestampNow(), Amount: -1000, Tags: []string{"tag"}, User: "user", ID: id}, nil
+}
+
+func (db *DB) ClearTransactions(account string, ids []int64) (int, error) {
+	log.Printf("mockDb: ClearTransactions: %s %v", account, ids)
+	return len(ids), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	//minRecurringPeriods is how many of the history periods a transaction must
+	//appear in to be treated as recurring
+	minRecurringPeriods = 3
+	//recurringTolerance is how far a transaction's amount may stray from the
+	//usual amount and still count as the recurring transaction
+	recurringTolerance = 0.1
+)
+
+//RecurringRule is a transaction that happens about once every period, like
+//rent or a salary, detected from history
+type RecurringRule struct {
+	Tag    string
+	Amount USD           //the usual amount, negative if spent
+	Offset time.Duration //how long after the start of a period it usually happens
+}
+
+//matches returns whether txn is an occurrence of the rule
+func (r RecurringRule) matches(txn Txn) bool {
+	if len(txn.Tags) == 0 || txn.Tags[0] != r.Tag || (txn.Amount < 0) != (r.Amount < 0) {
+		return false
+	}
+	return math.Abs(float64(txn.Amount-r.Amount)) <= math.Abs(float64(r.Amount))*recurringTolerance
+}
+
+//String describes the rule ie: +$2500.00 salary
+func (r RecurringRule) String() string {
+	return fmt.Sprintf("%s %s", signedChange(r.Amount), r.Tag)
+}
+
+//signedChange formats an amount with a + or - in front
+func signedChange(m USD) string {
+	if m < 0 {
+		return "-" + m.Abs().String()
+	}
+	return "+" + m.String()
+}
+
+func median(xs []float64) float64 {
+	s := append([]float64(nil), xs...)
+	sort.Float64s(s)
+	return s[len(s)/2]
+}
+
+//periodOf returns the index of the period starting at starts that t is in,
+//or -1 if t is before all of them
+func periodOf(starts []time.Time, t time.Time) int {
+	return sort.Search(len(starts), func(i int) bool { return starts[i].After(t) }) - 1
+}
+
+//detectRecurring finds the transactions that happen in most of the periods
+//starting at starts, grouped by their first tag and whether they're spent
+func detectRecurring(txns []Txn, starts []time.Time) []RecurringRule {
+	type group struct {
+		tag   string
+		spent bool
+	}
+	groups := make(map[group][]Txn)
+	for _, txn := range txns {
+		if len(txn.Tags) == 0 || periodOf(starts, txn.Date.Time()) < 0 {
+			continue
+		}
+		g := group{txn.Tags[0], txn.Amount < 0}
+		groups[g] = append(groups[g], txn)
+	}
+
+	var rules []RecurringRule
+	for g, txns := range groups {
+		//the amount that recurs in the most periods, there may be other
+		//transactions with the same tag that don't recur
+		var (
+			best    RecurringRule
+			matched []Txn
+		)
+		for _, candidate := range txns {
+			rule := RecurringRule{Tag: g.tag, Amount: candidate.Amount}
+			if m := occurrences(rule, txns, starts); len(m) > len(matched) {
+				best, matched = rule, m
+			}
+		}
+		if len(matched) < minRecurringPeriods {
+			continue
+		}
+		amts := make([]float64, len(matched))
+		offsets := make([]float64, len(matched))
+		for i, txn := range matched {
+			amts[i] = float64(txn.Amount)
+			offsets[i] = float64(txn.Date.Time().Sub(starts[periodOf(starts, txn.Date.Time())]))
+		}
+		best.Amount = USD(median(amts))
+		best.Offset = time.Duration(median(offsets))
+		rules = append(rules, best)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Offset < rules[j].Offset })
+	return rules
+}
+
+//occurrences returns the first transaction matching rule in each of the
+//periods starting at starts
+func occurrences(rule RecurringRule, txns []Txn, starts []time.Time) []Txn {
+	seen := make(map[int]bool)
+	var matched []Txn
+	for _, txn := range txns {
+		i := periodOf(starts, txn.Date.Time())
+		if i >= 0 && !seen[i] && rule.matches(txn) {
+			seen[i] = true
+			matched = append(matched, txn)
+		}
+	}
+	return matched
+}
+
+//Forecast is the projected balance at the end of the current period
+type Forecast struct {
+	End       time.Time
+	Balance   USD             //the balance now
+	Upcoming  []RecurringRule //recurring transactions expected before the end of the period
+	Spent     USD             //spending so far this period that isn't recurring
+	Remaining USD             //the spending that isn't recurring expected for the rest of the period
+	Expected  USD             //the projected balance
+	Low       USD             //the projected balance if spending is high
+	High      USD             //the projected balance if spending is low
+}
+
+//forecast projects bal at now to the end of the period from txns, which must
+//cover the history periods before the current one as well as the current one
+func forecast(bal USD, txns []Txn, now time.Time) *Forecast {
+	current := period.Start(now)
+	f := &Forecast{End: period.End(now), Balance: bal}
+	starts := []time.Time{current}
+	for i := 0; i < historyPeriods; i++ {
+		starts = append([]time.Time{period.Previous(starts[0])}, starts...)
+	}
+	history := starts[:historyPeriods]
+	var past []Txn
+	for _, txn := range txns {
+		if txn.Date.Time().Before(current) {
+			past = append(past, txn)
+		}
+	}
+	rules := detectRecurring(past, history)
+
+	//spending that isn't recurring in each period, the current one last
+	spent := make([]float64, len(starts))
+	happened := make(map[int]bool)
+	for _, txn := range txns {
+		i := periodOf(starts, txn.Date.Time())
+		if i < 0 || txn.Date.Time().After(now) {
+			continue
+		}
+		recurring := false
+		for r, rule := range rules {
+			if rule.matches(txn) {
+				recurring = true
+				if i == historyPeriods {
+					happened[r] = true
+				}
+				break
+			}
+		}
+		if !recurring && txn.Amount < 0 {
+			spent[i] -= txn.Amount.InDollars()
+		}
+	}
+	var upcoming USD
+	for r, rule := range rules {
+		if !happened[r] && current.Add(rule.Offset).After(now) {
+			f.Upcoming = append(f.Upcoming, rule)
+			upcoming += rule.Amount
+		}
+	}
+
+	//project the rest of the period from the pace so far and from history
+	length := f.End.Sub(current).Seconds()
+	left := f.End.Sub(now).Seconds() / length
+	f.Spent = ToUSD(spent[historyPeriods])
+	pace := spent[historyPeriods] / math.Max(1-left, 0.01) * left
+	low, high := pace, pace
+	if s := statsOf(spent[:historyPeriods]); s.mean > 0 {
+		usual := s.mean * left
+		low = math.Min(pace, math.Max(usual-s.stddev*left, 0))
+		high = math.Max(pace, usual+s.stddev*left)
+		pace = (pace + usual) / 2
+	}
+	f.Remaining = ToUSD(pace)
+	f.Expected = bal + upcoming - f.Remaining
+	f.Low = bal + upcoming - ToUSD(high)
+	f.High = bal + upcoming - ToUSD(low)
+	return f
+}
+
+//String formats the forecast in keybase markdown
+func (f *Forecast) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Forecast for the end of %s*\n", rangeTitle(period.Start(f.End), f.End))
+	fmt.Fprintf(&b, ">balance now: %s\n", signed(f.Balance))
+	if len(f.Upcoming) > 0 {
+		upcoming := make([]string, len(f.Upcoming))
+		for i, r := range f.Upcoming {
+			upcoming[i] = r.String()
+		}
+		fmt.Fprintf(&b, ">recurring still to come: %s\n", strings.Join(upcoming, ", "))
+	}
+	fmt.Fprintf(&b, ">other spending: %s so far, about %s more expected\n", f.Spent, f.Remaining)
+	fmt.Fprintf(&b, ">projected balance: *%s* (between %s and %s)", signed(f.Expected), signed(f.Low), signed(f.High))
+	switch {
+	case f.Expected < 0:
+		b.WriteString("\n*Warning:* the balance is projected to go negative")
+	case f.Low < 0:
+		b.WriteString("\n*Warning:* the balance could go negative if spending stays high")
+	}
+	return b.String()
+}
+
+//HandleForecast projects the balance at the end of the current period
+func (h *Handler) HandleForecast(args *Args, msg chat1.MsgSummary) error {
+	now := time.Now()
+	bal, err := h.db.GetNetWorth(now)
+	if err != nil {
+		return err
+	}
+	start := period.Start(now)
+	for i := 0; i < historyPeriods; i++ {
+		start = period.Previous(start)
+	}
+	txns, err := h.db.GetTransactions(start, now)
+	if err != nil {
+		return err
+	}
+	h.ChatEcho(msg.ConvID, "%s", forecast(bal, txns, now).String())
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//goalTagPrefix starts the tag of contributions to a goal ie: goal-vacation
+const goalTagPrefix = "goal-"
+
+//Goal is an amount being saved towards by a date
+type Goal struct {
+	Name     string
+	Target   USD
+	Deadline Timestamp //the last nanosecond the goal should be reached by
+	Created  Timestamp
+	Creator  string
+}
+
+//Tag returns the tag contributions to the goal are recorded with
+func (g *Goal) Tag() string {
+	return goalTagPrefix + g.Name
+}
+
+//Json returns the Goal as a Json Encoded string
+func (g *Goal) Json() (string, error) {
+	return toJsonString(g)
+}
+
+//GoalProgress is how far along a goal is
+type GoalProgress struct {
+	Goal    Goal
+	Saved   USD
+	Monthly USD        //the monthly contribution needed to reach the target by the deadline
+	Average USD        //the average monthly contribution so far
+	ETA     *time.Time //when the target will be reached at the average, nil if nothing's been saved
+}
+
+//monthsBetween returns the number of months from a to b, counting part months
+func monthsBetween(a, b time.Time) float64 {
+	return b.Sub(a).Hours() / 24 / (365.25 / 12)
+}
+
+//progress works out how far along g is at now from the contributions made to
+//it, the amounts put towards it
+func progress(g Goal, contributions []Txn, now time.Time) *GoalProgress {
+	p := &GoalProgress{Goal: g}
+	first := now
+	for _, txn := range contributions {
+		p.Saved += txn.Amount
+		if d := txn.Date.Time(); d.Before(first) {
+			first = d
+		}
+	}
+	left := g.Target - p.Saved
+	if left <= 0 {
+		return p
+	}
+	p.Monthly = left
+	if months := monthsBetween(now, g.Deadline.Time()); months > 1 {
+		p.Monthly = ToUSD(left.InDollars() / months)
+	}
+	if p.Saved > 0 {
+		//at least a month so a first contribution doesn't look like a monthly rate
+		p.Average = ToUSD(p.Saved.InDollars() / math.Max(monthsBetween(first, now), 1))
+		eta := now.Add(time.Duration(left.InDollars() / p.Average.InDollars() * float64(time.Hour) * 24 * 365.25 / 12))
+		p.ETA = &eta
+	}
+	return p
+}
+
+//String formats the progress in keybase markdown
+func (p *GoalProgress) String() string {
+	g := p.Goal
+	str := fmt.Sprintf("*%s*: %s of %s (%.0f%%) by %s\n", g.Name, p.Saved, g.Target,
+		p.Saved.InDollars()/g.Target.InDollars()*100, g.Deadline.Time().Format("Jan 2006"))
+	switch {
+	case p.Saved >= g.Target:
+		return str + ">reached!"
+	case p.ETA == nil:
+		return str + fmt.Sprintf(">needs %s a month, nothing saved yet", p.Monthly)
+	}
+	pace := "on track"
+	if p.ETA.After(g.Deadline.Time()) {
+		pace = "*behind*"
+	}
+	return str + fmt.Sprintf(">needs %s a month, averaging %s a month, on pace to finish %s, %s",
+		p.Monthly, p.Average, p.ETA.Format("Jan 2006"), pace)
+}
+
+//goalProgress loads the contributions to g and works out its progress.
+//Contributions are moved into the goal's account, older versions recorded
+//them as spending on the goal's tag.
+func (h *Handler) goalProgress(g Goal) (*GoalProgress, error) {
+	entries, err := h.db.GetEntries(g.Created.Time(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var contributions []Txn
+	for _, e := range entries {
+		for _, p := range e.Postings {
+			if p.Account == assetAccount(g.Tag()) || p.Account == expensesPrefix+g.Tag() {
+				contributions = append(contributions, Txn{Date: e.Date, Amount: p.Amount})
+			}
+		}
+	}
+	return progress(g, contributions, time.Now()), nil
+}
+
+//HandleGoalCreate creates a savings goal
+func (h *Handler) HandleGoalCreate(args *Args, msg chat1.MsgSummary) error {
+	name := strings.ToLower(args.Tags[0])
+	if g, err := h.db.GetGoal(name); err != nil || g != nil {
+		if err == nil {
+			h.ReactQuestion(msg)
+			h.ChatEcho(msg.ConvID, "There's already a goal called `%s`.", name)
+		}
+		return err
+	}
+	if args.Amount <= 0 || !args.Range[1].After(time.Now()) {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "%s", "A goal needs an amount to save and a date in the future to save it by.")
+		return nil
+	}
+	g := Goal{name, args.Amount, Timestamp(args.Range[1]), TimestampNow(), msg.Sender.Username}
+	if err := h.db.PutGoal(g); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactSuccess(msg)
+	p, err := h.goalProgress(g)
+	if err != nil {
+		return err
+	}
+	h.ChatEcho(msg.ConvID, "%s", p.String())
+	return nil
+}
+
+//HandleGoalAdd records a contribution to a goal. It's a transfer from the
+//default account to the goal's own account, so it isn't spending and doesn't
+//change the net worth.
+func (h *Handler) HandleGoalAdd(args *Args, msg chat1.MsgSummary) error {
+	g, err := h.db.GetGoal(strings.ToLower(args.Tags[0]))
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "There's no goal called `%s`, create it with `goal create %s <amount> by <month>`.", args.Tags[0], args.Tags[0])
+		return nil
+	}
+	now, note := TimestampNow(), "contribution to "+g.Name
+	txns := []Txn{
+		{Date: now, Amount: -args.Amount, Tags: []string{g.Tag()}, Note: note, User: msg.Sender.Username, Transfer: true},
+		{Date: now, Amount: args.Amount, Tags: []string{g.Tag()}, Note: note, User: msg.Sender.Username, Account: g.Tag(), Transfer: true},
+	}
+	if err := h.db.PutTransactions(txns); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactSuccess(msg)
+	return nil
+}
+
+//HandleGoals shows the progress of every goal
+func (h *Handler) HandleGoals(args *Args, msg chat1.MsgSummary) error {
+	goals, err := h.db.GetGoals()
+	if err != nil {
+		return err
+	}
+	if len(goals) == 0 {
+		h.ChatEcho(msg.ConvID, "%s", "There are no goals yet, create one with `goal create vacation 3000 by 2027-06`.")
+		return nil
+	}
+	var str string
+	for _, g := range goals {
+		p, err := h.goalProgress(g)
+		if err != nil {
+			return err
+		}
+		str += p.String() + "\n"
+	}
+	h.ChatEcho(msg.ConvID, "%s", str)
+	return nil
+}
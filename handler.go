@@ -1,100 +1,331 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
-const(
-	//SPACE is a whitespace
-	SPACE = `\s`
-	//WORD is a space followed by a word
-	WORD = `\s\w+`
-	//MONEY is a currency decimal ie 100.00
-	MONEY = SPACE + `\d*\.?\d{2}` + SPACE
-	//Tags matches either a single tag or a comma-space separated list of tags
-	//ie: tag1, tag2, tag3
-	TAGS = SPACE + `((\w+,\s)*)?\w+`
-)
-
 type command struct {
-	Name       string
-	Pattern    *regexp.Regexp
-	EntryPoint func(cmd []string, msg chat1.MsgSummary) error
+	Name        string
+	Description string   //a short description of what the command does
+	Examples    []string //example uses of the command
+	Grammar     grammar  //the arguments following the command's name
+	EntryPoint  func(args *Args, msg chat1.MsgSummary) error
+}
+
+//Usage returns the syntax of the command ie: spent <amount> on <tag>
+func (c *command) Usage() string {
+	return c.Grammar.usage(c.Name)
 }
 
-func (c *command) PatternMatches(cmd string) bool {
-	return c.Pattern.MatchString(cmd)
+//Parse parses the arguments of cmd, the full text of a command
+func (c *command) Parse(cmd string) (*Args, error) {
+	tokens, err := lex(cmd)
+	if err != nil {
+		return nil, err
+	}
+	//subcommands like goal create are named by more than one word
+	skip := len(strings.Fields(c.Name))
+	if skip > len(tokens) {
+		skip = len(tokens)
+	}
+	return c.Grammar.parse(cmd, tokens[skip:])
+}
+
+//UsageString returns the command's usage and examples formatted for chat
+func (c *command) UsageString() string {
+	str := fmt.Sprintf("usage: `%s`", c.Usage())
+	for _, ex := range c.Examples {
+		str += fmt.Sprintf("\n>%s", ex)
+	}
+	return str
 }
 
 type cmdMap map[string]command
 
-func (m cmdMap) add(entryPoint func(cmd []string, msg chat1.MsgSummary) error, pattern ...string) {
-	cmd := new(command)
-	cmd.Name = pattern[0]
+//add registers a command documented by doc, with the given name and grammar
+func (m cmdMap) add(doc command, entryPoint func(args *Args, msg chat1.MsgSummary) error, name string, g ...param) {
+	cmd := doc
+	cmd.Name = name
 	cmd.EntryPoint = entryPoint
-	expr := `(?is)^` + strings.Join(pattern, "") + `(:?\s|$)`
-	cmd.Pattern = regexp.MustCompile(expr)
-	m[cmd.Name] = *cmd
+	cmd.Grammar = g
+	m[cmd.Name] = cmd
+}
+
+//Names returns the names of the commands in alphabetical order
+func (m cmdMap) Names() []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//group returns the subcommands of word ie: goal create and goal add for goal
+func (m cmdMap) group(word string) []command {
+	var cmds []command
+	for _, name := range m.Names() {
+		if strings.HasPrefix(name, word+" ") {
+			cmds = append(cmds, m[name])
+		}
+	}
+	return cmds
+}
+
+//Advertisement returns the commands as keybase advertises them for autocomplete.
+//Subcommands are advertised together under their first word.
+func (m cmdMap) Advertisement() kbchat.Advertisement {
+	var inputs []chat1.UserBotCommandInput
+	examples := make(map[string][]string)
+	for _, name := range m.Names() {
+		c := m[name]
+		words := strings.SplitN(c.Name, " ", 2)
+		usage := strings.TrimSpace(strings.TrimPrefix(c.Grammar.usage(c.Name), words[0]))
+		if n := len(inputs); n > 0 && inputs[n-1].Name == words[0] {
+			inputs[n-1].Description += "; " + c.Description
+			inputs[n-1].Usage += " | " + usage
+		} else {
+			inputs = append(inputs, chat1.UserBotCommandInput{
+				Name:        words[0],
+				Description: c.Description,
+				Usage:       usage,
+			})
+		}
+		examples[words[0]] = append(examples[words[0]], c.Examples...)
+	}
+	for i, input := range inputs {
+		if ex := examples[input.Name]; len(ex) > 0 {
+			body := "Examples:\n>!" + strings.Join(ex, "\n>!")
+			inputs[i].ExtendedDescription = &chat1.UserBotExtendedDescription{
+				Title:       "*!" + input.Name + "*",
+				DesktopBody: body,
+				MobileBody:  body,
+			}
+		}
+	}
+	return kbchat.Advertisement{
+		Advertisements: []chat1.AdvertiseCommandAPIParam{{
+			Typ:      "public",
+			Commands: inputs,
+		}},
+	}
+}
+
+//cmdLocks guard the command map, which commands may be registered in while
+//messages are handled
+type cmdLocks struct {
+	sync.RWMutex
+	advertise sync.Mutex //held while advertising, so the latest commands are advertised last
 }
 
 type Handler struct {
 	*Output
-	db   *DB
-	cmds cmdMap
+	db       *DB
+	cmds     cmdMap
+	cmdLocks *cmdLocks
+	insights *insightCache
+	health   *healthSource
 }
 
 func NewHandler(kbc *kbchat.API, db *DB, ErrConvID string) Handler {
 	h := Handler{
-		Output: NewDebugOutput("handler", kbc, ErrConvID),
-		db:     db,
+		Output:   NewDebugOutput("handler", kbc, ErrConvID),
+		db:       db,
+		cmdLocks: new(cmdLocks),
+		insights: new(insightCache),
+		health:   new(healthSource),
 	}
 	cmds := make(cmdMap)
-	cmds.add(h.HandleStart, "start", MONEY, "?")
-	cmds.add(h.HandleSpent, "spent", MONEY, "on", TAGS)
-	cmds.add(h.HandleReceived, "received", MONEY, "from", TAGS)
-	cmds.add(h.HandleBalance, "balance")
-	cmds.add(h.HandleListTags, "list", WORD)
-	cmds.add(h.HandleHowMuch, "howmuch", SPACE, "on|from", WORD)
+	cmds.add(command{
+		Description: "record the starting balance",
+		Examples:    []string{"start 1520.00", "start 300 in cash"},
+	}, h.HandleStart, "start", amount(), optional(account("in")))
+	cmds.add(command{
+		Description: "record money spent",
+		Examples:    []string{"spent 12.50 on food lunch with the team", "spent 40 on car, gas \"oil change\"", "spent 60 on food from visa"},
+	}, h.HandleSpent, "spent", amount(), keyword("on"), tags(), optional(account("from")), optional(note()))
+	cmds.add(command{
+		Description: "record money received",
+		Examples:    []string{"received 500.00 from salary", "received 20.00 from gifts birthday money", "received 2500 from salary into checking"},
+	}, h.HandleReceived, "received", amount(), keyword("from"), tags(), optional(account("from|into")), optional(note()))
+	cmds.add(command{
+		Description: "move money between accounts without counting it as spent or received",
+		Examples:    []string{"transfer 500.00 from checking to savings", "transfer 350 from checking to visa card bill"},
+	}, h.HandleTransfer, "transfer", amount(), keyword("from"), word("account"), keyword("to"), word("account"), optional(note()))
+	cmds.add(command{
+		Description: "add an account like checking, savings, a credit card or cash",
+		Examples:    []string{"account add checking", "account add visa"},
+	}, h.HandleAccountAdd, "account add", tag())
+	cmds.add(command{
+		Description: "show the balance of every account and the net worth, now or at the end of a month or day",
+		Examples:    []string{"balance", "balance sep", "balance 2026-09-14"},
+	}, h.HandleBalance, "balance", optional(dateRange()))
+	cmds.add(command{
+		Description: "check the books, or compare an account with a bank statement and clear its transactions when they match",
+		Examples:    []string{"reconcile", "reconcile checking 1523.44 as of 2026-10-15", "reconcile visa 220.10 adjust"},
+	}, h.HandleReconcile, "reconcile", optional(statement()), optional(asOf()), optional(keyword("adjust")))
+	cmds.add(command{
+		Description: "mark transactions in an account as having shown up on a bank statement",
+		Examples:    []string{"clear checking 12", "clear visa 12, 15, 16"},
+	}, h.HandleClear, "clear", word("account"), ids())
+	cmds.add(command{
+		Description: "post the receipt photo a transaction was recorded with, send a photo captioned with a transaction to keep its receipt or without a caption to have it read",
+		Examples:    []string{"receipt 12"},
+	}, h.HandleReceipt, "receipt", ids())
+	cmds.add(command{
+		Description: "project the balance at the end of the period from recurring transactions and the spending pace",
+		Examples:    []string{"forecast"},
+	}, h.HandleForecast, "forecast")
+	cmds.add(command{
+		Description: "list every tag that has been used",
+		Examples:    []string{"list tags"},
+	}, h.HandleListTags, "list", keyword("tags"))
+	cmds.add(command{
+		Description: "show how much was spent on or received from a tag by each user",
+		Examples:    []string{"howmuch on food", "howmuch from salary jan", "howmuch on car-repairs 2026-09"},
+	}, h.HandleHowMuch, "howmuch", keyword("on|from"), tag(), optional(dateRange()))
+	cmds.add(command{
+		Description: "list what was spent on every tag in a period and by whom",
+		Examples:    []string{"breakdown", "breakdown sep", "breakdown last month", "breakdown 2026-09-14"},
+	}, h.HandleBreakdown, "breakdown", optional(dateRange()), optional(span()))
+	cmds.add(command{
+		Description: "list the commands or show how to use one",
+		Examples:    []string{"help", "help spent"},
+	}, h.HandleHelp, "help", optional(word("command")))
+	cmds.add(command{
+		Description: "show the state of the connection to keybase",
+		Examples:    []string{"health"},
+	}, h.HandleHealth, "health")
+	cmds.add(command{
+		Description: "turn shorthand entry like `-12 food lunch` or `+500 salary` on or off for yourself",
+		Examples:    []string{"shorthand on", "shorthand off"},
+	}, h.HandleShorthandSetting, "shorthand", keyword("on|off"))
+	cmds.add(command{
+		Description: "show the spending report for this period so far, or the last one",
+		Examples:    []string{"report", "report last"},
+	}, h.HandleReport, "report", optional(keyword("last")))
+	cmds.add(command{
+		Description: "point out tags and transactions that are unusually high this period",
+		Examples:    []string{"insights"},
+	}, h.HandleInsights, "insights")
+	cmds.add(command{
+		Description: "create a goal to save an amount by a month or date",
+		Examples:    []string{"goal create vacation 3000 by 2027-06", "goal create car 5000 by dec"},
+	}, h.HandleGoalCreate, "goal create", tag(), amount(), keyword("by"), dateRange())
+	cmds.add(command{
+		Description: "put money towards a goal",
+		Examples:    []string{"goal add vacation 200"},
+	}, h.HandleGoalAdd, "goal add", tag(), amount())
+	cmds.add(command{
+		Description: "show the progress of every goal",
+		Examples:    []string{"goals"},
+	}, h.HandleGoals, "goals")
+	cmds.add(command{
+		Description: "upload a bar, line or pie chart of spending, on a tag if one is given",
+		Examples:    []string{"chart food last 6 months", "chart pie this month", "chart line last 12 weeks"},
+	}, h.HandleChart, "chart", optional(keyword("bar|line|pie")), optional(tag()), optional(span()))
 	h.cmds = cmds
 	return h
 }
 
+//Advertise publishes the registered commands to keybase so chat clients
+//can autocomplete them
+func (h *Handler) Advertise() error {
+	if h.offline() {
+		return nil
+	}
+	h.cmdLocks.advertise.Lock()
+	defer h.cmdLocks.advertise.Unlock()
+	h.cmdLocks.RLock()
+	ad := h.cmds.Advertisement()
+	h.cmdLocks.RUnlock()
+	_, err := h.api().AdvertiseCommands(ad)
+	return err
+}
+
+//Register adds a command after startup and refreshes the advertised commands
+func (h *Handler) Register(doc command, entryPoint func(args *Args, msg chat1.MsgSummary) error, name string, g ...param) error {
+	h.cmdLocks.Lock()
+	h.cmds.add(doc, entryPoint, name, g...)
+	h.cmdLocks.Unlock()
+	return h.Advertise()
+}
+
+//Seen records msg as the latest message processed in its conversation.
+//It returns false if the message was already processed.
+func (h *Handler) Seen(msg chat1.MsgSummary) (bool, error) {
+	return h.db.AdvanceCursor(Cursor{msg.ConvID, msg.Channel, msg.Id})
+}
+
+//Cursors returns the last message processed in every known conversation
+func (h *Handler) Cursors() ([]Cursor, error) {
+	return h.db.GetCursors()
+}
+
+//findCommand returns the command or subcommand named by the first words
+//of a message. Autocompleted commands start with !
+func (h *Handler) findCommand(fields []string) *command {
+	name := strings.ToLower(strings.TrimPrefix(fields[0], "!"))
+	if len(fields) > 1 {
+		if cmd := h.commandExists(name + " " + strings.ToLower(fields[1])); cmd != nil {
+			return cmd
+		}
+	}
+	return h.commandExists(name)
+}
+
 func (h *Handler) commandExists(cmdName string) *command {
+	h.cmdLocks.RLock()
 	cmd := h.cmds[cmdName]
+	h.cmdLocks.RUnlock()
 	if len(cmd.Name) > 0 {
 		return &cmd
 	}
 	return nil
 }
 
-func (h *Handler) HandleReceived(cmd []string, msg chat1.MsgSummary) error {
-	ts := TimestampNow()
-	amt, err := StringToUSD(cmd[1])
-
+func (h *Handler) HandleReceived(args *Args, msg chat1.MsgSummary) error {
+	args, err := h.noteOrAccount(args)
 	if err != nil {
 		h.ReactError(msg)
-		h.ReactDollar(msg)
 		return err
 	}
-	tags, note := parseTagsAndNote(cmd[3:])
-	if tags == nil {
-		h.ReactQuestion(msg)
-		return errors.New("HandleReceived: couldn't parse tag(s)")
+	_, err = h.record(receivedTxn(args, msg), msg)
+	return err
+}
+
+//receivedTxn returns the transaction recording the money args describes
+//being received
+func receivedTxn(args *Args, msg chat1.MsgSummary) Txn {
+	return Txn{
+		Date:    TimestampNow(),
+		Amount:  args.Amount,
+		Tags:    args.Tags,
+		Note:    args.Note,
+		User:    msg.Sender.Username,
+		Account: accountOf(args.Account),
+	}
+}
+
+func (h *Handler) HandleStart(args *Args, msg chat1.MsgSummary) error {
+	if ok, err := h.checkAccounts(msg, args.Account); err != nil || !ok {
+		return err
 	}
 	txn := Txn{
-		ts,
-		amt,
-		tags,
-		note,
-		msg.Sender.Username,
-		false,
+		Date:    TimestampNow(),
+		Amount:  args.Amount,
+		Tags:    []string{},
+		Note:    "Starting transaction",
+		User:    msg.Sender.Username,
+		Summary: true,
+		Account: accountOf(args.Account),
 	}
 	if err := h.db.PutTransaction(txn); err != nil {
 		h.ReactError(msg)
@@ -104,178 +335,245 @@ func (h *Handler) HandleReceived(cmd []string, msg chat1.MsgSummary) error {
 	return nil
 }
 
-func (h *Handler) HandleStart(cmd []string, msg chat1.MsgSummary) error {
-	ts := TimestampNow()
-	amt, err := StringToUSD(cmd[1])
+func (h *Handler) HandleSpent(args *Args, msg chat1.MsgSummary) error {
+	args, err := h.noteOrAccount(args)
 	if err != nil {
 		h.ReactError(msg)
-		h.ReactDollar(msg)
 		return err
 	}
-	txn := Txn{
-		ts,
-		amt,
-		[]string{},
-		"Starting transaction",
-		msg.Sender.Username,
-		true,
-	}
-	err = h.db.PutTransaction(txn)
-	if err != nil {
-		h.ReactError(msg)
-	}
-	h.ReactSuccess(msg)
-	return nil
+	_, err = h.record(spentTxn(args, msg), msg)
+	return err
 }
 
-func (h *Handler) HandleSpent(cmd []string, msg chat1.MsgSummary) error {
-	ts := TimestampNow()
-	amt, err := StringToUSD(cmd[1])
+//spentTxn returns the transaction recording the spending args describes
+func spentTxn(args *Args, msg chat1.MsgSummary) Txn {
+	return Txn{
+		Date:    TimestampNow(),
+		Amount:  -args.Amount,
+		Tags:    args.Tags,
+		Note:    args.Note,
+		User:    msg.Sender.Username,
+		Account: accountOf(args.Account),
+	}
+}
 
+func (h *Handler) HandleBalance(args *Args, msg chat1.MsgSummary) error {
+	accounts, err := h.db.GetAccounts()
 	if err != nil {
-		h.ReactError(msg)
-		h.ReactDollar(msg)
 		return err
 	}
-	tags, note := parseTagsAndNote(cmd[3:])
-	if tags == nil {
-		h.ReactQuestion(msg)
-		return errors.New("HandleSpent: couldn't parse tag(s)")
+	at := time.Now()
+	if args.Range != nil {
+		at = args.Range[1]
 	}
-	txn := Txn{
-		ts,
-		-amt,
-		tags,
-		note,
-		msg.Sender.Username,
-		false,
+	balances, err := h.db.GetAccountBalances(at)
+	if err != nil {
+		return err
 	}
-	if err := h.db.PutTransaction(txn); err != nil {
-		h.ReactError(msg)
+	h.ChatEcho(msg.ConvID, "%s", balancesString(accounts, balances))
+	return nil
+}
+
+func (h *Handler) HandleListTags(args *Args, msg chat1.MsgSummary) error {
+	tags, err := h.db.GetTags()
+	if err != nil {
 		return err
 	}
+	var ts string
+	for _, t := range tags {
+		ts += fmt.Sprintln(t)
+	}
 	h.ReactSuccess(msg)
+	h.ChatEcho(msg.ConvID, ts)
 	return nil
 }
 
-func (h *Handler) HandleBalance(cmd []string, msg chat1.MsgSummary) error {
-	bal, err := h.db.GetBalance(StartOfMonth())
+func (h *Handler) HandleHowMuch(args *Args, msg chat1.MsgSummary) error {
+	m := CurrentMonthRange()
+	if args.Range != nil {
+		m = args.Range
+	}
+	tb, err := h.db.GetTagBalance(args.Tags[0], m[0], m[1])
 	if err != nil {
 		return err
 	}
-	h.ChatEcho(msg.ConvID, fmt.Sprintf("current balance is **%s**", bal))
+	h.ChatEcho(msg.ConvID, tb.String())
 	return nil
 }
 
-func (h *Handler) HandleListTags(cmd []string, msg chat1.MsgSummary) error {
-	if cmd[1] == "tags" {
-		tags, err := h.db.GetTags()
-		if err != nil {
-			return err
-		}
-		var ts string
-		for _, t := range tags {
-			ts += fmt.Sprintln(t)
+//HandleBreakdown lists the spending on every tag in the period given, or
+//the current period
+func (h *Handler) HandleBreakdown(args *Args, msg chat1.MsgSummary) error {
+	start, end := StartOfPeriod(), EndOfPeriod()
+	switch {
+	case args.Range != nil:
+		start, end = args.Range[0], args.Range[1]
+	case args.Span != nil:
+		starts := args.Span.Starts(time.Now())
+		start, end = starts[0], args.Span.Unit.End(starts[len(starts)-1])
+	}
+	breakdown, total, err := h.db.GetTagBreakdown(start, end)
+	if err != nil {
+		return err
+	}
+	title := rangeTitle(start, end)
+	if len(breakdown) == 0 {
+		h.ChatEcho(msg.ConvID, "Nothing was spent in %s.", title)
+		return nil
+	}
+	str := fmt.Sprintf("*Spent %s in %s*\n", total, title)
+	for _, tb := range breakdown {
+		str += fmt.Sprintf(">*%s*: %s (%.1f%%)\n>", tb.tag, tb.total.Abs(), tb.total.Abs().InDollars()/total.InDollars()*100)
+		for i, share := range tb.Shares() {
+			if i > 0 {
+				str += ", "
+			}
+			str += fmt.Sprintf("@%s %s", share.Name, share.Amount)
 		}
-		h.ReactSuccess(msg)
-		h.ChatEcho(msg.ConvID, ts)
+		str += "\n"
 	}
+	h.ChatEcho(msg.ConvID, "%s", str)
 	return nil
 }
 
-func (h *Handler) HandleHowMuch(cmd []string, msg chat1.MsgSummary) error {
-	var m *[2]time.Time
-	m = CurrentMonthRange()
-	if len(cmd) > 4 {
-		var ok bool
-		m, ok = MonthRangeFromString(cmd[4])
-		if !ok {
-			h.ReactQuestion(msg)
-			h.Debug("HandleHowMuch: invalid month given")
-			return nil
+//HandleHelp lists every command, or shows the usage of the command given
+func (h *Handler) HandleHelp(args *Args, msg chat1.MsgSummary) error {
+	if len(args.Words) == 0 {
+		h.ChatEcho(msg.ConvID, h.helpText())
+		return nil
+	}
+	c := h.commandExists(strings.ToLower(args.Words[0]))
+	if group := h.commandGroup(strings.ToLower(args.Words[0])); c == nil && len(group) > 0 {
+		var str string
+		for _, c := range group {
+			str += fmt.Sprintf("*%s*: %s\n%s\n", c.Name, c.Description, c.UsageString())
 		}
+		h.ChatEcho(msg.ConvID, "%s", str)
+		return nil
 	}
-	tb, err := h.db.GetTagBalance(cmd[2], m[0], m[1])
-	if err != nil {
-		return err
+	if c == nil {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "I don't know the command `%s`. Send `help` to see the commands I know.", args.Words[0])
+		return nil
 	}
-	h.ChatEcho(msg.ConvID, tb.String())
+	h.ChatEcho(msg.ConvID, "*%s*: %s\n%s", c.Name, c.Description, c.UsageString())
 	return nil
 }
 
-func (h *Handler) HandleMonthSummary(m time.Month) error {
-	bal, err := h.db.GetBalance(MonthStart(m))
-	if err != nil {
+//commandGroup returns the subcommands of word
+func (h *Handler) commandGroup(word string) []command {
+	h.cmdLocks.RLock()
+	defer h.cmdLocks.RUnlock()
+	return h.cmds.group(word)
+}
+
+//helpText returns the usage and description of every command
+func (h *Handler) helpText() string {
+	h.cmdLocks.RLock()
+	defer h.cmdLocks.RUnlock()
+	var str string
+	for _, name := range h.cmds.Names() {
+		c := h.cmds[name]
+		str += fmt.Sprintf("`%s` %s\n", c.Usage(), c.Description)
+	}
+	return str + "Send `help <command>` for examples.\n" +
+		"With `shorthand on` you can also type `-12 food lunch` for spent, `+500 salary` for received, " +
+		"and `12.50 coffee` which I'll check is spent before recording."
+}
+
+//HandlePeriodSummary posts the report of the period ending at end to every
+//ledger. Nothing is recorded, the next period's opening balance is computed
+//from the journal.
+func (h *Handler) HandlePeriodSummary(end time.Time) error {
+	//a failed report shouldn't stop the next one
+	if err := h.PostReport(end); err != nil {
+		h.Debug("HandlePeriodSummary: unable to post report: %s", err)
+	}
+	return nil
+}
+
+//welcomeMessage introduces the bot to a new conversation
+const welcomeMessage = "Ciao! I'll keep track of spending in this conversation.\nHere's what I understand:\n"
+
+//HandleNewConv greets a new conversation, registers it as a ledger and
+//asks for a starting balance if nothing has been recorded yet
+func (h *Handler) HandleNewConv(conv chat1.ConvSummary) error {
+	ledger := Ledger{
+		ConvID:  conv.Id,
+		Channel: conv.Channel,
+		Created: TimestampNow(),
+	}
+	if conv.CreatorInfo != nil {
+		ledger.Creator = conv.CreatorInfo.Username
+	}
+	if err := h.db.PutLedger(ledger); err != nil {
 		return err
 	}
-	txn := Txn{
-		TimestampNow(),
-		bal,
-		[]string{},
-		"summary txn",
-		"Server",
-		true,
-	}
-	err = h.db.PutTransaction(txn)
+	h.ChatEcho(conv.Id, welcomeMessage+h.helpText())
+
+	hasTxns, err := h.db.HasTransactions()
 	if err != nil {
 		return err
 	}
+	if !hasTxns {
+		h.ChatEcho(conv.Id, "To get started, tell me your current balance with `start <amount>`, ie: `start 1520.00`")
+	}
 	return nil
 }
 
-func (h *Handler) HandleNewConv(conv chat1.ConvSummary) error {
-	h.ChatEcho("Ciao! This convID is:", string(conv.Id))
-	return nil
+//trackLedger registers the conversation msg was sent in as a ledger, so
+//conversations the bot joined before ledgers were recorded get reports too
+func (h *Handler) trackLedger(msg chat1.MsgSummary) {
+	if err := h.db.PutLedger(Ledger{ConvID: msg.ConvID, Channel: msg.Channel, Created: TimestampNow()}); err != nil {
+		h.Debug("trackLedger: unable to record ledger: %s", err)
+	}
 }
 
 func (h *Handler) HandleCommand(msg chat1.MsgSummary) error {
-	if msg.Content.Text == nil {
-		h.Debug("skipping non-text message")
+	//photos of receipts are captioned with the transaction
+	cmdstring, ok := commandText(msg)
+	if !ok && msg.Content.Attachment != nil {
+		h.trackLedger(msg)
+		return h.HandleReceiptPhoto(msg)
+	}
+	if !ok {
+		h.Debug("skipping message without text")
 		return nil
 	}
-	cmdstring := strings.TrimSpace(msg.Content.Text.Body)
-	parts := strings.Split(cmdstring, " ")
-	name := parts[0]
-	//if first word is a command trigger word
-	if cmd := h.commandExists(strings.ToLower(name)); cmd != nil {
+	if cmdstring == "" {
+		return nil
+	}
+	fields := strings.Fields(cmdstring)
+	name := fields[0]
+	//if first words are a command trigger word
+	if cmd := h.findCommand(fields); cmd != nil {
 		// check if required data was given
-		if cmd.PatternMatches(cmdstring) {
+		args, err := cmd.Parse(cmdstring)
+		if err == nil {
+			h.trackLedger(msg)
 			//execute command
-			return cmd.EntryPoint(parts, msg)
+			return cmd.EntryPoint(args, msg)
 		}
-		//command pattern did not match
+		//command did not parse
 		h.ReactQuestion(msg)
-		h.Debug("cmd %v pattern did not match: %s", name, cmd.Pattern)
+		reply := cmd.UsageString()
+		if perr, ok := err.(*ParseError); ok {
+			reply = perr.Pointer() + perr.Msg + "\n" + reply
+		}
+		h.ChatEcho(msg.ConvID, "%s", reply)
+		h.Debug("cmd %v did not parse: %s", name, err)
 		return nil
 	}
-	return nil
-}
-
-func parseTagsAndNote(s []string) ([]string, string) {
-	var note string
-	tags, ntags := parseTagInput(s)
-	if ntags < len(s) {
-		note = strings.Join(s[ntags:], " ")
-	}
-	return tags, note
-}
-
-func parseTagInput(tags []string) ([]string, int) {
-	l := len(tags)
-	switch l {
-	case 0:
-		return nil, -1
-	case 1:
-		return []string{tags[0]}, 1
-	default:
-		tagList := make([]string, 0)
-		for i, val := range tags {
-			tagList = append(tagList, val[:len(val)-1])
-			if !strings.HasSuffix(val, ",") {
-				tagList[len(tagList)-1] = val
-				return tagList, i + 1
-			}
+	//the start of a subcommand without a valid subcommand
+	if group := h.commandGroup(strings.ToLower(strings.TrimPrefix(name, "!"))); len(group) > 0 {
+		h.ReactQuestion(msg)
+		var usages []string
+		for _, c := range group {
+			usages = append(usages, fmt.Sprintf("`%s`", c.Usage()))
 		}
-		return nil, -2
+		h.ChatEcho(msg.ConvID, "%s", "usage: "+strings.Join(usages, " or "))
+		return nil
 	}
-}
\ No newline at end of file
+	//no trigger word, it may be a shorthand transaction
+	return h.handleShorthand(cmdstring, msg)
+}
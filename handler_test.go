@@ -1,61 +1,339 @@
 package main
 
-import(
+import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+func parseCmd(t *testing.T, h Handler, cmdstring string) (*Args, error) {
+	t.Helper()
+	cmd := h.findCommand(strings.Fields(cmdstring))
+	if cmd == nil {
+		t.Fatal("unknown command:", cmdstring)
+	}
+	return cmd.Parse(cmdstring)
+}
+
 func TestSingleTagParsing(t *testing.T) {
-	tlist := []string{"tag"}
-	tags, ntags := parseTagInput(tlist)
-	if ntags < 1 {
-		t.Error("error parsing tags expected ntags 1 got", ntags)
+	h := NewHandler(nil, nil, "")
+	args, err := parseCmd(t, h, "spent 10.00 on tag")
+	if err != nil {
+		t.Fatal("unexpected error parsing tags:", err)
 	}
-	if tags[0] != "tag" {
-		t.Error("error parsing tags expected taglist ", tlist, "got", tags)
+	if len(args.Tags) != 1 || args.Tags[0] != "tag" {
+		t.Error("error parsing tags expected taglist [tag] got", args.Tags)
 	}
 
-	tlist = []string{"tag", "this", "is", "a", "note"}
-	tags, note := parseTagsAndNote(tlist)
-	if tags == nil {
-		t.Error("unexpected tags == nil")
+	args, err = parseCmd(t, h, "spent 10.00 on tag this is a note")
+	if err != nil {
+		t.Fatal("unexpected error parsing tags:", err)
 	}
-	if note != "this is a note" {
-		t.Error("error parsing note from taglist got", note, "expected: this is a note")
+	if len(args.Tags) != 1 {
+		t.Error("unexpected tags:", args.Tags)
+	}
+	if args.Note != "this is a note" {
+		t.Error("error parsing note from taglist got", args.Note, "expected: this is a note")
 	}
 }
 
 func TestMultiTagParsing(t *testing.T) {
-	tlist := []string{"tag1,", "tag2,", "tag3"}
-	tags, ntags := parseTagInput(tlist)
-	if ntags < 3 {
-		t.Error("error parsing tags expected ntags 3 got", ntags)
+	h := NewHandler(nil, nil, "")
+	for _, cmdstring := range []string{
+		"spent 10.00 on tag1, tag2, tag3",
+		"spent 10.00 on tag1,tag2 ,tag3",
+		"spent  10.00\ton   tag1,  tag2,\ttag3",
+	} {
+		args, err := parseCmd(t, h, cmdstring)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %s", cmdstring, err)
+		}
+		if len(args.Tags) != 3 {
+			t.Error("unexpected tag length:", len(args.Tags), "expected: 3")
+		}
+		for i, tag := range args.Tags {
+			if tag != fmt.Sprintf("tag%v", i+1) {
+				t.Error("error parsing tags: unexpected value: ", tag)
+				break
+			}
+		}
+	}
+
+	args, err := parseCmd(t, h, "spent 10.00 on tag1, tag2, tag3 this  is a note")
+	if err != nil {
+		t.Fatal("unexpected error parsing tags:", err)
+	}
+	if len(args.Tags) != 3 {
+		t.Error("ParseMultiTagAndNote: unexpected tag length:", len(args.Tags), "expected: 3")
+	}
+	if args.Note != "this is a note" {
+		t.Error("error parsing note from taglist got", args.Note, "expected: this is a note")
+	}
+}
+
+func TestArgParsing(t *testing.T) {
+	h := NewHandler(nil, nil, "")
+	args, err := parseCmd(t, h, `spent $12.5 on car-repairs, gas "oil, filter and \"extras\""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Amount != 1250 {
+		t.Error("unexpected amount:", args.Amount)
+	}
+	if len(args.Tags) != 2 || args.Tags[0] != "car-repairs" || args.Tags[1] != "gas" {
+		t.Error("unexpected tags:", args.Tags)
+	}
+	if args.Note != `oil, filter and "extras"` {
+		t.Error("unexpected quoted note:", args.Note)
+	}
+
+	args, err = parseCmd(t, h, "howmuch FROM salary feb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Keywords[0] != "from" || args.Tags[0] != "salary" || args.Range == nil || args.Range[0].Month() != 2 {
+		t.Errorf("unexpected args: %+v", args)
+	}
+	args, err = parseCmd(t, h, "howmuch on food 2026-09-14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Range[0].Day() != 14 || args.Range[1].Day() != 14 {
+		t.Error("unexpected range for a day:", args.Range)
+	}
+
+	args, err = parseCmd(t, h, "received 1,200.00 from salary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Amount != 120000 {
+		t.Error("unexpected amount with thousands separator:", args.Amount)
+	}
+
+	args, err = parseCmd(t, h, "spent 60 on food, drinks from Visa dinner out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Account != "visa" || len(args.Tags) != 2 || args.Note != "dinner out" {
+		t.Errorf("unexpected account args: %+v", args)
+	}
+	args, err = parseCmd(t, h, "transfer 500 from checking to savings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args.Words) != 2 || args.Words[0] != "checking" || args.Words[1] != "savings" || args.Account != "" {
+		t.Errorf("unexpected transfer args: %+v", args)
+	}
+
+	args, err = parseCmd(t, h, "reconcile Checking 1,523.44 as of 2026-10-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Account != "checking" || args.Amount != 152344 || args.Range == nil || args.Range[0].Day() != 15 || len(args.Keywords) != 0 {
+		t.Errorf("unexpected reconcile args: %+v", args)
+	}
+	if args, err = parseCmd(t, h, "clear checking 12, #15,16"); err != nil || len(args.Words) != 1 || len(args.IDs) != 3 || args.IDs[1] != 15 {
+		t.Errorf("unexpected ids: %+v %v", args, err)
+	}
+	if _, err = parseCmd(t, h, "reconcile checking"); err == nil {
+		t.Error("expected a statement without a balance not to parse")
+	}
+
+	g := grammar{user(), amount()}
+	tokens, _ := lex("@Alice 3")
+	args, err = g.parse("@Alice 3", tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.User != "alice" || args.Amount != 300 {
+		t.Errorf("unexpected args: %+v", args)
 	}
-	if len(tags) != 3 {
-		t.Error("unexpected tag length:", len(tags), "expected: 3")
+}
+
+func TestParseErrors(t *testing.T) {
+	h := NewHandler(nil, nil, "")
+	for _, tc := range []struct {
+		cmd string
+		pos int
+		msg string
+	}{
+		{"spent 12,5 on food", 6, "expected an amount"},
+		{"spent 12.50 food", 12, "expected `on`"},
+		{"spent 12.50 on", 14, "missing a tag"},
+		{"spent 12.50 on food, ", 21, "expected a tag after"},
+		{"spent 12.50 on fo*od", 15, "invalid tag"},
+		{`spent 12.50 on food "unterminated`, 20, "unterminated"},
+		{"howmuch on food sometime", 16, "unexpected `sometime`"},
+		{"list tag", 5, "expected `tags`"},
+	} {
+		_, err := parseCmd(t, h, tc.cmd)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: expected a parse error got %v", tc.cmd, err)
+			continue
+		}
+		if perr.Pos != tc.pos || !strings.Contains(perr.Msg, tc.msg) {
+			t.Errorf("%q: expected %q at %d got %q at %d", tc.cmd, tc.msg, tc.pos, perr.Msg, perr.Pos)
+		}
+	}
+	perr := &ParseError{"spent 12,5 on food", 6, "expected an amount"}
+	if p := perr.Pointer(); !strings.Contains(p, "\n      ^\n") {
+		t.Errorf("caret is not under the error:\n%s", p)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	h := NewHandler(nil, nil, "")
+	help := h.helpText()
+	for _, name := range h.cmds.Names() {
+		c := h.cmds[name]
+		if c.Description == "" || len(c.Examples) == 0 {
+			t.Errorf("command %s is missing documentation", name)
+		}
+		if !strings.Contains(help, c.Usage()) {
+			t.Errorf("help is missing usage of %s", name)
+		}
+		//every example must be accepted by the command's grammar
+		for _, ex := range c.Examples {
+			if _, err := c.Parse(ex); err != nil {
+				t.Errorf("example %q does not parse: %s", ex, err)
+			}
+		}
+	}
+	spent := h.cmds["spent"]
+	if usage := spent.UsageString(); !strings.Contains(usage, spent.Examples[0]) {
+		t.Error("usage string is missing examples:", usage)
+	}
+	if u := spent.Usage(); u != "spent <amount> on <tag>[, <tag>...] [from <account>] [<note>]" {
+		t.Error("unexpected usage:", u)
+	}
+}
+
+func TestShorthandParsing(t *testing.T) {
+	for _, tc := range []struct {
+		input     string
+		spent     bool
+		ambiguous bool
+		amount    USD
+		tags      []string
+		note      string
+	}{
+		{"-12 food lunch with team", true, false, 1200, []string{"food"}, "lunch with team"},
+		{"+500 salary", false, false, 50000, []string{"salary"}, ""},
+		{"12.50 coffee", true, true, 1250, []string{"coffee"}, ""},
+		{"-$40 on car, gas", true, false, 4000, []string{"car", "gas"}, ""},
+	} {
+		s, err := parseShorthand(tc.input)
+		if err != nil || s == nil {
+			t.Errorf("%q: unexpected result %v %v", tc.input, s, err)
+			continue
+		}
+		if s.Spent != tc.spent || s.Ambiguous != tc.ambiguous || s.Args.Amount != tc.amount ||
+			strings.Join(s.Args.Tags, ",") != strings.Join(tc.tags, ",") || s.Args.Note != tc.note {
+			t.Errorf("%q: unexpected shorthand %+v %+v", tc.input, s, s.Args)
+		}
+	}
+	for _, input := range []string{"hello there", "12", "-", "+twelve food"} {
+		if s, _ := parseShorthand(input); s != nil {
+			t.Errorf("%q: expected no shorthand got %+v", input, s.Args)
+		}
+	}
+	s, _ := parseShorthand("12.5 coffee beans")
+	if c := s.Command(); c != `spent 12.50 on coffee "beans"` {
+		t.Error("unexpected command:", c)
+	}
+}
+
+func TestAdvertisement(t *testing.T) {
+	h := NewHandler(nil, nil, "")
+	ad := h.cmds.Advertisement()
+	if len(ad.Advertisements) != 1 || ad.Advertisements[0].Typ != "public" {
+		t.Fatalf("unexpected advertisement: %+v", ad)
 	}
-	for i, tag := range tags{
-		if tag != fmt.Sprintf("tag%v", i+1) {
-			t.Error("error parsing tags: unexpected value: ", tag)
-			break
+	cmds := ad.Advertisements[0].Commands
+	//subcommands are advertised under their first word
+	if len(cmds) != len(h.cmds)-len(h.cmds.group("goal"))+1 {
+		t.Errorf("advertised %d of %d commands", len(cmds), len(h.cmds))
+	}
+	for _, c := range cmds {
+		if c.Name == "goal" && c.Usage != "add <tag> <amount> | create <tag> <amount> by <month|date>" {
+			t.Error("unexpected goal usage:", c.Usage)
+		}
+		if c.Name == "spent" && c.Usage != "<amount> on <tag>[, <tag>...] [from <account>] [<note>]" {
+			t.Error("unexpected spent usage:", c.Usage)
+		}
+		if c.Name == "balance" && c.Usage != "[<month|date>]" {
+			t.Error("unexpected balance usage:", c.Usage)
 		}
 	}
 
-	tlist = []string{"tag1,", "tag2,", "tag3", "this", "is", "a", "note"}
-	tags, note := parseTagsAndNote(tlist)
-	if tags == nil {
-		t.Error("unexpected tags == nil")
+	//commands can be registered while others are handled
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			h.findCommand([]string{"spent"})
+			h.helpText()
+		}
+	}()
+	if err := h.Register(command{Description: "say hi", Examples: []string{"hi"}}, h.HandleHelp, "hi"); err != nil {
+		t.Fatal(err)
 	}
-	if len(tags) != 3 {
-		t.Error("ParseMultiTagAndNote: unexpected tag length:", len(tags), "expected: 3")
+	wg.Wait()
+	if n := len(h.cmds.Advertisement().Advertisements[0].Commands); n != len(cmds)+1 {
+		t.Error("registered command was not advertised, got", n)
 	}
-	for i, tag := range tags{
-		if tag != fmt.Sprintf("tag%v", i+1) {
-			t.Error("ParseMultiTagAndNote: error parsing tags: unexpected value: ", tag)
-			break
+}
+
+func TestSpanParsing(t *testing.T) {
+	h := NewHandler(nil, nil, "")
+	for _, tc := range []struct {
+		cmd  string
+		kind string
+		tag  string
+		span string
+	}{
+		{"chart food last 6 months", "", "food", "last 6 months"},
+		{"chart pie this month", "pie", "", "this month"},
+		{"chart line last week", "line", "", "last week"},
+		{"chart bar this", "bar", "this", ""},
+		{"chart", "", "", ""},
+	} {
+		args, err := parseCmd(t, h, tc.cmd)
+		if err != nil {
+			t.Errorf("%q: %s", tc.cmd, err)
+			continue
+		}
+		var kind, tag, span string
+		if len(args.Keywords) > 0 {
+			kind = args.Keywords[0]
+		}
+		if len(args.Tags) > 0 {
+			tag = args.Tags[0]
+		}
+		if args.Span != nil {
+			span = args.Span.String()
+		}
+		if kind != tc.kind || tag != tc.tag || span != tc.span {
+			t.Errorf("%q: unexpected kind %q tag %q span %q", tc.cmd, kind, tag, span)
 		}
 	}
-	if note != "this is a note" {
-		t.Error("error parsing note from taglist got", note, "expected: this is a note")
+	for _, cmd := range []string{"chart food last 0 months", "chart this 3 months", "chart food last 6 days"} {
+		if _, err := parseCmd(t, h, cmd); err == nil {
+			t.Errorf("%q: expected an error", cmd)
+		}
+	}
+
+	s := Span{Count: 3, Unit: Monthly}
+	starts := s.Starts(time.Date(2026, 1, 15, 0, 0, 0, 0, location))
+	if len(starts) != 3 || starts[0].Month() != 11 || starts[0].Year() != 2025 || starts[2].Month() != 1 {
+		t.Error("unexpected starts:", starts)
+	}
+	s = Span{Count: 1, Unit: Weekly, Last: true}
+	if starts = s.Starts(time.Date(2026, 10, 15, 0, 0, 0, 0, location)); starts[0].Day() != 5 {
+		t.Error("unexpected start of last week:", starts)
 	}
 }
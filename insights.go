@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+const (
+	//historyPeriods is how many periods before the current one are averaged
+	historyPeriods = 6
+	//minHistoryPeriods is how many of those a tag must have been spent on in
+	//before its spending is compared to them
+	minHistoryPeriods = 3
+	//minHistoryTxns is how many transactions a tag needs before a single
+	//transaction is compared to them
+	minHistoryTxns = 5
+	//periodZScore is how many standard deviations above average a period's
+	//spending on a tag must be to be flagged
+	periodZScore = 2.0
+	//txnZScore is the same for a single transaction
+	txnZScore = 3.0
+	//minRatio is the least multiple of the average that is flagged, so tags
+	//with very steady spending aren't flagged for small changes
+	minRatio = 1.5
+	//insightsInterval is how often insights are recomputed in the background
+	insightsInterval = time.Hour
+)
+
+//Insight is something unusual about recent spending
+type Insight struct {
+	Tag     string
+	Message string
+	Score   float64 //how unusual it is, in standard deviations or multiples of the average
+}
+
+//stats are the mean and standard deviation of a set of amounts
+type stats struct {
+	mean, stddev float64
+	n            int
+}
+
+func statsOf(xs []float64) stats {
+	s := stats{n: len(xs)}
+	if s.n == 0 {
+		return s
+	}
+	for _, x := range xs {
+		s.mean += x
+	}
+	s.mean /= float64(s.n)
+	for _, x := range xs {
+		s.stddev += (x - s.mean) * (x - s.mean)
+	}
+	s.stddev = math.Sqrt(s.stddev / float64(s.n))
+	return s
+}
+
+//score returns how many standard deviations x is above the mean. With no
+//deviation at all it falls back to the multiple of the mean.
+func (s stats) score(x float64) float64 {
+	if s.stddev == 0 {
+		return x / s.mean
+	}
+	return (x - s.mean) / s.stddev
+}
+
+//analyze finds the tags whose spending in the period containing t is unusual
+//compared to the periods before it, and the transactions that are unusually
+//large for their tag. txns must cover the history periods and the current one.
+func analyze(txns []Txn, t time.Time) []Insight {
+	current := period.Start(t)
+	starts := []time.Time{current}
+	for i := 0; i < historyPeriods; i++ {
+		starts = append([]time.Time{period.Previous(starts[0])}, starts...)
+	}
+	//spending per tag in each period, the current one last
+	spent := make(map[string][]float64)
+	history := make(map[string][]float64)
+	var recent []Txn
+	for _, txn := range txns {
+		if txn.Amount >= 0 {
+			continue
+		}
+		i := sort.Search(len(starts), func(i int) bool { return starts[i].After(txn.Date.Time()) }) - 1
+		if i < 0 {
+			continue
+		}
+		amt := txn.Amount.Abs().InDollars()
+		for _, tag := range txn.Tags {
+			if spent[tag] == nil {
+				spent[tag] = make([]float64, len(starts))
+			}
+			spent[tag][i] += amt
+			if i < historyPeriods {
+				history[tag] = append(history[tag], amt)
+			}
+		}
+		if i == historyPeriods {
+			recent = append(recent, txn)
+		}
+	}
+
+	var insights []Insight
+	for tag, periods := range spent {
+		cur, past := periods[historyPeriods], periods[:historyPeriods]
+		var active int
+		for _, x := range past {
+			if x > 0 {
+				active++
+			}
+		}
+		s := statsOf(past)
+		if cur == 0 || active < minHistoryPeriods || cur < s.mean*minRatio || s.score(cur) < periodZScore {
+			continue
+		}
+		insights = append(insights, Insight{tag, fmt.Sprintf("%s is %.1fx your %d-%s average this %s (%s vs %s)",
+			tag, cur/s.mean, historyPeriods, period.Unit(), period.Unit(), ToUSD(cur), ToUSD(s.mean)), s.score(cur)})
+	}
+	for _, txn := range recent {
+		amt := txn.Amount.Abs().InDollars()
+		for _, tag := range txn.Tags {
+			s := statsOf(history[tag])
+			if s.n < minHistoryTxns || amt < s.mean*minRatio || s.score(amt) < txnZScore {
+				continue
+			}
+			insights = append(insights, Insight{tag, fmt.Sprintf("@%s spent %s on %s %s, your usual %s transaction is %s",
+				txn.User, txn.Amount.Abs(), tag, txn.Date, tag, ToUSD(s.mean)), s.score(amt)})
+			break
+		}
+	}
+	sort.Slice(insights, func(i, j int) bool { return insights[i].Score > insights[j].Score })
+	return insights
+}
+
+//insightCache holds the latest insights computed in the background
+type insightCache struct {
+	sync.Mutex
+	at       time.Time
+	insights []Insight
+}
+
+//Analyze returns the insights for the period containing t
+func (h *Handler) Analyze(t time.Time) ([]Insight, error) {
+	start := period.Start(t)
+	for i := 0; i < historyPeriods; i++ {
+		start = period.Previous(start)
+	}
+	txns, err := h.db.GetTransactions(start, period.End(t))
+	if err != nil {
+		return nil, err
+	}
+	return analyze(txns, t), nil
+}
+
+//RefreshInsights recomputes the insights for the current period
+func (h *Handler) RefreshInsights() ([]Insight, error) {
+	insights, err := h.Analyze(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	h.insights.Lock()
+	h.insights.at, h.insights.insights = time.Now(), insights
+	h.insights.Unlock()
+	return insights, nil
+}
+
+//Insights returns the current period's insights, recomputing them if the
+//background analysis hasn't run recently
+func (h *Handler) Insights() ([]Insight, error) {
+	h.insights.Lock()
+	at, insights := h.insights.at, h.insights.insights
+	h.insights.Unlock()
+	if time.Since(at) < insightsInterval && period.Start(at).Equal(StartOfPeriod()) {
+		return insights, nil
+	}
+	return h.RefreshInsights()
+}
+
+//HandleInsights lists anything unusual about this period's spending
+func (h *Handler) HandleInsights(args *Args, msg chat1.MsgSummary) error {
+	insights, err := h.Insights()
+	if err != nil {
+		return err
+	}
+	if len(insights) == 0 {
+		h.ChatEcho(msg.ConvID, "Nothing looks unusual this %s so far.", period.Unit())
+		return nil
+	}
+	str := "*Insights*\n"
+	for _, in := range insights {
+		str += ">" + in.Message + "\n"
+	}
+	h.ChatEcho(msg.ConvID, "%s", str)
+	return nil
+}
+
+//analyzeInBackground keeps the handler's insights up to date until ctx is done
+func (s *Server) analyzeInBackground(ctx context.Context, handler Handler, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := handler.RefreshInsights(); err != nil {
+			s.Debug("analyzeInBackground: unable to analyze spending: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			s.Debug("analyzeInBackground: shutting down")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Journal accounts are named by their type and a name, ie: assets:checking,
+//expenses:food, income:salary
+const (
+	assetsPrefix   = "assets:"
+	expensesPrefix = "expenses:"
+	incomePrefix   = "income:"
+	//openingAccount balances the starting balance of an account
+	openingAccount = "equity:opening"
+	//untaggedAccount is spent on or received from by transactions without tags
+	untaggedAccount = "untagged"
+)
+
+//ErrUnbalanced is returned when the postings of an entry don't add up to zero
+var ErrUnbalanced = errors.New("journal entry does not balance")
+
+//Posting is an amount debited (positive) or credited (negative) to an account
+type Posting struct {
+	Account string
+	Amount  USD
+}
+
+//Entry is a journal entry, postings against accounts that add up to zero
+type Entry struct {
+	ID       int64
+	Date     Timestamp
+	User     string
+	Note     string
+	Postings []Posting
+}
+
+//Balanced returns whether the entry's postings add up to zero
+func (e *Entry) Balanced() bool {
+	var sum USD
+	for _, p := range e.Postings {
+		sum += p.Amount
+	}
+	return len(e.Postings) > 1 && sum == 0
+}
+
+//Json returns the Entry as a Json Encoded string
+func (e *Entry) Json() (string, error) {
+	return toJsonString(e)
+}
+
+//String lists the entry's postings ie: assets:main -$12.00, expenses:food $12.00
+func (e *Entry) String() string {
+	postings := make([]string, len(e.Postings))
+	for i, p := range e.Postings {
+		postings[i] = fmt.Sprintf("%s %s", p.Account, signed(p.Amount))
+	}
+	return strings.Join(postings, ", ")
+}
+
+//assetAccount returns the journal account of an account transactions are
+//recorded in
+func assetAccount(name string) string {
+	if name == "" {
+		name = defaultAccount
+	}
+	return assetsPrefix + name
+}
+
+//journalEntry translates transactions recorded together into a balanced
+//entry. Money spent is moved from the asset account to an expense account
+//named by the first tag, so a transaction with several tags is only counted
+//once, money received is moved from an income account, starting balances
+//from equity, and the two sides of a transfer balance each other. It
+//returns false for period summaries, which aren't part of the journal.
+func journalEntry(txns ...Txn) (Entry, bool) {
+	if len(txns) == 0 {
+		return Entry{}, false
+	}
+	e := Entry{Date: txns[0].Date, User: txns[0].User, Note: txns[0].Note}
+	for _, txn := range txns {
+		if txn.Summary && txn.User == summaryUser {
+			return Entry{}, false
+		}
+		e.Postings = append(e.Postings, Posting{assetAccount(txn.Account), txn.Amount})
+		counter := untaggedAccount
+		if len(txn.Tags) > 0 {
+			counter = txn.Tags[0]
+		}
+		switch {
+		case txn.Transfer:
+			continue
+		case txn.Summary:
+			counter = openingAccount
+		case txn.Amount < 0:
+			counter = expensesPrefix + counter
+		default:
+			counter = incomePrefix + counter
+		}
+		e.Postings = append(e.Postings, Posting{counter, -txn.Amount})
+	}
+	return e, true
+}
@@ -1,27 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/bvinc/go-sqlite-lite/sqlite3"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 	"golang.org/x/sync/errgroup"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestDb(t *testing.T) {
-	db := DB("test.db")
+	db := NewDB("test.db")
 
 	if err := db.Init(); err != nil {
 		t.Error(err)
 	}
 
 	txn := Txn{
-		TimestampNow(),
-		-10 * 100,
-		[]string{"nugget", "cat-food", "cat-toys"},
-		"Catfood and nip",
-		"Sarah",
-		false,
+		Date:   TimestampNow(),
+		Amount: -10 * 100,
+		Tags:   []string{"nugget", "cat-food", "cat-toys"},
+		Note:   "Catfood and nip",
+		User:   "Sarah",
 	}
 	AmntTotal := USD(0)
 	var FirstTs time.Time
@@ -41,7 +54,7 @@ func TestDb(t *testing.T) {
 		}
 	}
 
-	bal, err := db.GetBalance(FirstTs)
+	bal, err := db.GetNetWorth(time.Now())
 	if err != nil {
 		t.Error(err)
 	}
@@ -86,17 +99,18 @@ func TestDb(t *testing.T) {
 
 	//test Balancer
 	ts := time.Now()
-	shutdownCh := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	heartbeat := make(chan struct{})
-	handler := NewHandler(nil, &db, "1234")
+	handler := NewHandler(nil, db, "1234")
 	s := new(Server)
 	s.Output = NewDebugOutput("test", nil, "")
 	var eg errgroup.Group
-	eg.Go(func() error { return s.waitToBalance(shutdownCh, handler, ts.Add(2*time.Second), heartbeat) })
+	eg.Go(func() error { return s.waitToBalance(ctx, handler, ts.Add(2*time.Second), heartbeat) })
 
 	select {
 	case <-heartbeat:
-		close(shutdownCh)
+		cancel()
 	case <-time.After(3 * time.Second):
 		t.Error("Balancer timed out")
 	}
@@ -105,12 +119,122 @@ func TestDb(t *testing.T) {
 		t.Error(err)
 	}
 
-	nbal, err := db.GetBalance(ts)
-	if err != nil {
+	//nothing is recorded at the end of a period, the balance carries over
+	if ntxs, err := db.GetTransactionsSince(ts); err != nil || len(ntxs) != 0 {
+		t.Error(fmt.Sprintf("Got %d transactions, expected nothing since the end of the period %v", len(ntxs), err))
+	}
+	if worth, err := db.GetNetWorth(time.Now()); err != nil || worth != bal {
+		t.Error(fmt.Sprintf("Incorrect net worth. Got %s expected %s %v", worth, bal, err))
+	}
+
+	if err := db.Close(); err != nil {
 		t.Error(err)
 	}
-	if nbal != bal {
-		t.Error(fmt.Sprintf("Incorrect balance. Got %s expected %s", nbal, bal))
+	if _, err := db.GetNetWorth(ts); err != ErrDBClosed {
+		t.Error("expected ErrDBClosed querying a closed db, got", err)
+	}
+}
+
+//fakeSub is a subscription that delivers msgs and then blocks until shut down.
+//onRead is called each time a message is delivered.
+type fakeSub struct {
+	msgs     chan kbchat.SubscriptionMessage
+	convs    chan kbchat.SubscriptionConversation
+	shutdown chan struct{}
+	once     sync.Once
+	onRead   func()
+}
+
+func newFakeSub() *fakeSub {
+	return &fakeSub{
+		msgs:     make(chan kbchat.SubscriptionMessage, 1),
+		convs:    make(chan kbchat.SubscriptionConversation, 2),
+		shutdown: make(chan struct{}),
+	}
+}
+
+func (f *fakeSub) Read() (kbchat.SubscriptionMessage, error) {
+	select {
+	case m := <-f.msgs:
+		if f.onRead != nil {
+			f.onRead()
+		}
+		return m, nil
+	default:
+	}
+	select {
+	case m := <-f.msgs:
+		return m, nil
+	case <-f.shutdown:
+		return kbchat.SubscriptionMessage{}, errors.New("subscription shutdown")
+	}
+}
+
+func (f *fakeSub) ReadNewConvs() (kbchat.SubscriptionConversation, error) {
+	select {
+	case c := <-f.convs:
+		return c, nil
+	case <-f.shutdown:
+		return kbchat.SubscriptionConversation{}, errors.New("subscription shutdown")
+	}
+}
+
+func (f *fakeSub) Shutdown() {
+	f.once.Do(func() { close(f.shutdown) })
+}
+
+func textMsg(user, body string) chat1.MsgSummary {
+	return chat1.MsgSummary{
+		Id:      1,
+		ConvID:  "conv",
+		Sender:  chat1.MsgSender{Username: user},
+		Content: chat1.MsgContent{TypeName: "text", Text: &chat1.MessageText{Body: body}},
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "shutdown.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	s.Output = NewDebugOutput("test", nil, "")
+	s.SetUsers(AuthorizedUsers{"alice": {}})
+	handler := NewHandler(nil, db, "")
+
+	//the shutdown signal arrives while a command is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := newFakeSub()
+	sub.onRead = cancel
+	sub.msgs <- kbchat.SubscriptionMessage{Message: textMsg("alice", "start 25.00")}
+
+	done := make(chan error)
+	go func() { done <- s.serve(ctx, sub, handler) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("unexpected error shutting down:", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	select {
+	case <-sub.shutdown:
+	default:
+		t.Error("subscription was not shut down")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = NewDB(db.String())
+	bal, err := db.GetNetWorth(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bal != 2500 {
+		t.Error("in-flight command was not finished before shutdown, balance is", bal)
 	}
 }
 
@@ -135,6 +259,1772 @@ func TestAuthorizedUsers(t *testing.T) {
 
 }
 
+func TestAuthorizedUsersParsing(t *testing.T) {
+	auth, err := NewAuthorizedUsers(" Alice, bob ,carol_1")
+	if err != nil {
+		t.Fatal("unexpected error parsing users:", err)
+	}
+	for _, usr := range []string{"alice", "bob", "carol_1"} {
+		if _, ok := auth[usr]; !ok {
+			t.Error("expected user to be authorized:", usr)
+		}
+	}
+	if _, ok := auth[" bob"]; ok {
+		t.Error("untrimmed username was authorized")
+	}
+
+	for _, bad := range []string{"", "  ", "alice,,bob", "alice,", "averyveryverylongname", "has space", "_under", "team:"} {
+		if _, err := NewAuthorizedUsers(bad); err == nil {
+			t.Errorf("expected error for users string %q", bad)
+		}
+	}
+
+	if _, err := NewAuthorizedUsers("alice,team:ourfamily"); err == nil {
+		t.Error("expected error resolving a team without a keybase connection")
+	}
+}
+
+type teamListerFunc func(string) (keybase1.TeamMembersDetails, error)
+
+func (f teamListerFunc) ListMembersOfTeam(team string) (keybase1.TeamMembersDetails, error) {
+	return f(team)
+}
+
+func TestAuthorizedUsersTeams(t *testing.T) {
+	l, err := ParseUserList("alice, team:OurFamily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Teams) != 1 || l.Teams[0] != "ourfamily" {
+		t.Fatal("unexpected teams:", l.Teams)
+	}
+	auth, err := l.Resolve(teamListerFunc(func(team string) (keybase1.TeamMembersDetails, error) {
+		if team != "ourfamily" {
+			return keybase1.TeamMembersDetails{}, errors.New("no such team")
+		}
+		return keybase1.TeamMembersDetails{
+			Owners:  []keybase1.TeamMemberDetails{{Username: "bob"}},
+			Writers: []keybase1.TeamMemberDetails{{Username: "carol"}},
+			Bots:    []keybase1.TeamMemberDetails{{Username: "somebot"}},
+		}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, usr := range []string{"alice", "bob", "carol"} {
+		if _, ok := auth[usr]; !ok {
+			t.Error("expected user to be authorized:", usr)
+		}
+	}
+	if _, ok := auth["somebot"]; ok {
+		t.Error("team bots should not be authorized")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kst.toml")
+	err := ioutil.WriteFile(path, []byte(`
+dbloc = "file.db"
+users = ["alice", "team:ourfamily"]
+period = "weekly"
+currency = "EUR"
+
+[reactions]
+success = "👍"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.applyEnv(func(env string) string {
+		return map[string]string{"KST_DBLOC": "env.db", "KST_USERS": "bob"}[env]
+	})
+	if c.DBLoc != "env.db" {
+		t.Error("expected environment to override dbloc, got", c.DBLoc)
+	}
+	if c.UsersString() != "bob" {
+		t.Error("expected environment to override users, got", c.UsersString())
+	}
+	if c.Period != "weekly" || c.KBLoc != "keybase" || c.Reactions.Success != "👍" || c.Reactions.Error != "❗" {
+		t.Errorf("unexpected config values: %+v", c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error("unexpected validation error:", err)
+	}
+
+	c.Admins = []string{"alice"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "admins") {
+		t.Error("expected an admin who isn't an authorized user to be invalid:", err)
+	}
+	c.Admins = []string{"bob"}
+	c.API.Tokens = map[string]string{"carol": "carol-token-0123456789"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "api.tokens.carol") {
+		t.Error("expected a token for a user who isn't authorized to be invalid:", err)
+	}
+	c.API.Tokens = nil
+
+	c.Users = []string{"alice,,bob"}
+	c.Timezone = "Nowhere/Special"
+	c.Currency = "XYZ"
+	c.Period = "daily"
+	c.Confirm.TagMultiple = 0.5
+	c.OCRTimeout = "soon"
+	c.applyEnv(func(env string) string {
+		return map[string]string{"KST_API_LISTEN": ":8080", "KST_API_TOKENS": "alice=short"}[env]
+	})
+	if c.API.Listen != ":8080" || c.API.Tokens["alice"] != "short" {
+		t.Errorf("unexpected api config: %+v", c.API)
+	}
+	if strings.Contains(c.String(), "short") {
+		t.Error("the config summary should not reveal tokens")
+	}
+	err = c.Validate()
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, setting := range []string{"users", "ocr_timeout", "timezone", "currency", "period", "confirm.tag_multiple", "api.tokens.alice"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("expected validation error to mention %s: %s", setting, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`dbloction = "typo.db"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected error for unknown setting")
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	SetLocation(time.UTC)
+	defer SetLocation(time.Local)
+	wed := time.Date(2026, time.October, 14, 15, 0, 0, 0, time.UTC)
+	if s := Weekly.Start(wed); !s.Equal(time.Date(2026, time.October, 12, 0, 0, 0, 0, time.UTC)) {
+		t.Error("unexpected weekly start:", s)
+	}
+	if e := Weekly.End(wed); !e.Equal(time.Date(2026, time.October, 18, 23, 59, 59, 999999999, time.UTC)) {
+		t.Error("unexpected weekly end:", e)
+	}
+	if s := Monthly.Previous(wed); !s.Equal(time.Date(2026, time.September, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("unexpected previous monthly start:", s)
+	}
+	if e := Monthly.End(time.Date(2026, time.December, 31, 23, 0, 0, 0, time.UTC)); e.Year() != 2026 || e.Month() != time.December || e.Day() != 31 {
+		t.Error("unexpected monthly end:", e)
+	}
+}
+
+func newConv(id chat1.ConvIDStr, creator string) kbchat.SubscriptionConversation {
+	return kbchat.SubscriptionConversation{Conversation: chat1.ConvSummary{
+		Id:          id,
+		CreatorInfo: &chat1.ConversationCreatorInfoLocal{Username: creator},
+	}}
+}
+
+func TestNewConvs(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "convs.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := new(Server)
+	s.Output = NewDebugOutput("test", nil, "")
+	s.SetUsers(AuthorizedUsers{"alice": {}})
+	handler := NewHandler(nil, db, "")
+
+	//a conversation from an unauthorized user must not stop the listener
+	sub := newFakeSub()
+	sub.convs <- newConv("mallorys", "mallory")
+	sub.convs <- newConv("alices", "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.serve(ctx, sub, handler) }()
+
+	var ledgers []Ledger
+	for i := 0; i < 50 && len(ledgers) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		var err error
+		if ledgers, err = db.GetLedgers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if len(ledgers) != 1 || ledgers[0].ConvID != "alices" || ledgers[0].Creator != "alice" {
+		t.Errorf("expected only alice's conversation to be registered, got %+v", ledgers)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2}
+	for i, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if d := b.Next(); d != expected*time.Second {
+			t.Errorf("attempt %d: expected delay %s got %s", i, expected*time.Second, d)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Error("expected delay to reset to 1s, got", d)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "health.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	var out strings.Builder
+	h.SetConsole(&out)
+	if err := h.HandleCommand(textMsg("alice", "health")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "isn't being supervised") {
+		t.Error("unexpected health without a server:", out.String())
+	}
+
+	s := new(Server)
+	s.Output = NewDebugOutput("test", nil, "")
+	s.setHealth(HealthReconnecting, errors.New("connection reset"))
+	h.SetHealth(s.Health)
+	out.Reset()
+	if err := h.HandleCommand(textMsg("alice", "health")); err != nil {
+		t.Fatal(err)
+	}
+	if str := out.String(); !strings.Contains(str, "keybase connection: reconnecting since") || !strings.Contains(str, "last error: connection reset") {
+		t.Error("unexpected health:", str)
+	}
+}
+
+func TestCursors(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "cursors.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	channel := chat1.ChatChannel{Name: "alice,bob"}
+	for i, step := range []struct {
+		id       chat1.MessageID
+		advanced bool
+	}{{5, true}, {5, false}, {3, false}, {8, true}} {
+		advanced, err := db.AdvanceCursor(Cursor{"conv", channel, step.id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advanced != step.advanced {
+			t.Errorf("step %d: expected advanced %v for msg %d", i, step.advanced, step.id)
+		}
+	}
+	cursors, err := db.GetCursors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cursors) != 1 || cursors[0].MsgID != 8 || cursors[0].Channel.Name != "alice,bob" {
+		t.Errorf("unexpected cursors: %+v", cursors)
+	}
+
+	//pages of three messages, newest first, back to the cursor
+	var reads []string
+	read := func(next string) (*chat1.Thread, error) {
+		reads = append(reads, next)
+		top := 14
+		if next != "" {
+			top = atoi(next)
+		}
+		page := &chat1.Thread{Pagination: &chat1.Pagination{Next: fmt.Sprint(top - 3), Last: top <= 3}}
+		for id := top; id > top-3 && id > 0; id-- {
+			msg := chat1.MsgSummary{Id: chat1.MessageID(id), Content: chat1.MsgContent{TypeName: "text"}}
+			if id == 12 {
+				msg.Content.TypeName = "reaction"
+			}
+			page.Messages = append(page.Messages, chat1.Message{Msg: &msg})
+		}
+		return page, nil
+	}
+	missed, err := missedMessages(read, cursors[0].MsgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 6 || missed[0].Id != 9 || missed[5].Id != 14 || missed[3].Content.TypeName != "reaction" || len(reads) != 3 {
+		t.Errorf("unexpected missed messages: %+v %v", missed, reads)
+	}
+	if _, err := missedMessages(func(string) (*chat1.Thread, error) { return nil, errors.New("offline") }, 8); err == nil {
+		t.Error("expected an error when a page can't be read")
+	}
+}
+
+func TestShorthand(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "shorthand.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+
+	send := func(user, body string) {
+		t.Helper()
+		if err := h.HandleCommand(textMsg(user, body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		t.Helper()
+		txns, err := db.GetTransactions(time.Time{}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(txns)
+	}
+
+	//shorthand is off by default
+	send("alice", "-12 food")
+	if n := count(); n != 0 {
+		t.Fatal("shorthand recorded while disabled:", n)
+	}
+	send("alice", "shorthand on")
+	send("alice", "-12 food lunch")
+	send("alice", "+500 salary")
+	if n := count(); n != 2 {
+		t.Fatal("expected 2 transactions got", n)
+	}
+	//unsigned amounts wait for a confirmation reaction, and are only asked
+	//about once even when they're large
+	SetThresholds(Thresholds{Above: 10})
+	defer SetThresholds(DefaultThresholds())
+	var out strings.Builder
+	h.SetConsole(&out)
+	send("alice", "12.50 coffee")
+	send("alice", "yes")
+	if n := count(); n != 2 {
+		t.Fatal("unsigned shorthand recorded before it was confirmed")
+	}
+	if n := strings.Count(out.String(), "Record"); n != 1 || !strings.Contains(out.String(), "`spent 12.50 on coffee`") {
+		t.Errorf("expected a single prompt, got %d: %s", n, out.String())
+	}
+	if err := h.HandleReaction(reactionMsg("alice", 0, ":+1:")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Fatal("expected 3 transactions got", n)
+	}
+	if err := h.HandleReaction(reactionMsg("alice", 0, ":+1:")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Fatal("a confirmed shorthand was recorded twice")
+	}
+	bal, err := db.GetNetWorth(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bal != 50000-1200-1250 {
+		t.Error("unexpected balance:", bal)
+	}
+	//bob hasn't turned it on
+	send("bob", "-5 food")
+	if n := count(); n != 3 {
+		t.Error("shorthand recorded for a user who didn't enable it")
+	}
+	//commands autocompleted by the chat client start with !
+	send("bob", "!spent 5 on food")
+	if n := count(); n != 4 {
+		t.Error("autocompleted command was not recorded")
+	}
+}
+
+func reactionMsg(user string, target chat1.MessageID, body string) chat1.MsgSummary {
+	return chat1.MsgSummary{
+		Id:      2,
+		ConvID:  "conv",
+		Sender:  chat1.MsgSender{Username: user},
+		Content: chat1.MsgContent{TypeName: "reaction", Reaction: &chat1.MessageReaction{MessageID: target, Body: body}},
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "confirm.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	defer SetThresholds(DefaultThresholds())
+	SetThresholds(Thresholds{Above: 1000, TagMultiple: 10})
+
+	count := func() int {
+		t.Helper()
+		txns, err := db.GetTransactions(time.Time{}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(txns)
+	}
+	for _, body := range []string{"spent 4 on coffee", "spent 5 on coffee", "spent 6 on coffee"} {
+		if err := h.HandleCommand(textMsg("alice", body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	avg, n, err := db.GetTagAverage("coffee")
+	if err != nil || avg != 500 || n != 3 {
+		t.Fatalf("unexpected tag average %v of %d: %v", avg, n, err)
+	}
+	for _, tc := range []struct {
+		txn    Txn
+		reason string
+	}{
+		{Txn{Date: TimestampNow(), Amount: -4999, Tags: []string{"coffee"}, User: "alice"}, ""},
+		{Txn{Date: TimestampNow(), Amount: -5001, Tags: []string{"coffee"}, User: "alice"}, "the usual $5.00 for coffee"},
+		{Txn{Date: TimestampNow(), Amount: -90000, Tags: []string{"rent"}, User: "alice"}, ""},
+		{Txn{Date: TimestampNow(), Amount: 150000, Tags: []string{"salary"}, User: "alice"}, "over $1000.00"},
+	} {
+		reason, err := h.confirmReason(tc.txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (tc.reason == "") != (reason == "") || !strings.Contains(reason, tc.reason) {
+			t.Errorf("%v: expected reason %q got %q", tc.txn.Amount, tc.reason, reason)
+		}
+	}
+
+	//offline prompts have id 0
+	if err := h.HandleCommand(textMsg("alice", "spent 1200.00 on coffee")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Fatal("unusual transaction was recorded without confirmation")
+	}
+	for _, r := range []chat1.MsgSummary{
+		reactionMsg("bob", 0, ":joy:"),
+		reactionMsg("bob", 7, ":+1:"),
+	} {
+		if err := h.HandleReaction(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(); n != 3 {
+		t.Fatal("transaction recorded without a confirmation reaction on its prompt")
+	}
+	//only alice or an admin may confirm it
+	if err := h.HandleReaction(reactionMsg("bob", 0, "👍")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Fatal("transaction confirmed by someone else was recorded")
+	}
+	if err := h.HandleReaction(reactionMsg("alice", 0, "👍")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 4 {
+		t.Fatal("confirmed transaction was not recorded")
+	}
+	//a second confirmation doesn't record it twice
+	if err := h.HandleReaction(reactionMsg("alice", 0, ":+1:")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 4 {
+		t.Error("transaction recorded twice")
+	}
+
+	SetAdmins([]string{"bob"})
+	defer SetAdmins(nil)
+	if err := h.HandleCommand(textMsg("alice", "spent 1200.00 on coffee")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.HandleReaction(reactionMsg("bob", 0, "👍")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 5 {
+		t.Fatal("transaction confirmed by an admin was not recorded")
+	}
+
+	//confirmations expire
+	var out strings.Builder
+	h.SetConsole(&out)
+	old := newPending(Txn{Date: TimestampNow(), Amount: -120000, Tags: []string{"coffee"}, User: "alice"}, textMsg("alice", ""), 3)
+	old.Created = Timestamp(now().Add(-pendingExpiry - time.Minute))
+	if err := db.PutPending(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.HandleReaction(reactionMsg("alice", 3, ":+1:")); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 5 || !strings.Contains(out.String(), "expired") {
+		t.Error("expired confirmation was recorded:", out.String())
+	}
+	if p, err := db.GetPending("conv", 3); err != nil || p != nil {
+		t.Error("expired transaction is still pending:", p, err)
+	}
+
+	//refunds and transfers aren't spending
+	for _, amt := range []USD{-300, 400} {
+		if err := db.PutTransaction(Txn{Date: TimestampNow(), Amount: amt, Tags: []string{"tea"}, User: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutTransactions([]Txn{
+		{Date: TimestampNow(), Amount: -9000, Tags: []string{"tea"}, User: "alice", Account: accountOf("checking"), Transfer: true},
+		{Date: TimestampNow(), Amount: 9000, Tags: []string{"tea"}, User: "alice", Account: accountOf("savings"), Transfer: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if avg, n, err := db.GetTagAverage("tea"); err != nil || avg != 300 || n != 1 {
+		t.Errorf("unexpected tea average %v of %d: %v", avg, n, err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "report.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	defer SetBudgets(nil)
+	SetBudgets(map[string]float64{"food": 100, "car": 50, "gas": 20})
+
+	day := func(y int, m time.Month, d int) Timestamp {
+		return Timestamp(time.Date(y, m, d, 12, 0, 0, 0, location))
+	}
+	for _, txn := range []Txn{
+		{Date: day(2025, 10, 1), Amount: 200000, Tags: []string{"salary"}, User: "alice"},
+		{Date: day(2025, 10, 2), Amount: -8000, Tags: []string{"food"}, User: "alice"},
+		{Date: day(2025, 10, 3), Amount: -4000, Tags: []string{"food"}, User: "bob"},
+		{Date: day(2025, 10, 4), Amount: -3000, Tags: []string{"car", "gas"}, User: "bob"},
+		{Date: day(2025, 10, 31), Amount: 99900, Tags: []string{}, Note: "summary txn", User: "Server", Summary: true},
+		{Date: day(2025, 9, 10), Amount: -10000, Tags: []string{"food"}, User: "alice"},
+		{Date: day(2024, 10, 10), Amount: -30000, Tags: []string{"rent"}, User: "alice"},
+	} {
+		if err := db.PutTransaction(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := h.BuildReport(time.Date(2025, 10, 15, 0, 0, 0, 0, location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Total.In != 200000 || r.Total.Out != 15000 || r.Total.Net() != 185000 {
+		t.Errorf("unexpected totals: %+v", r.Total)
+	}
+	//transactions count towards their first tag only
+	if len(r.Tags) != 2 || r.Tags[0] != (Amount{"food", 12000}) || r.Tags[1] != (Amount{"car", 3000}) {
+		t.Errorf("unexpected tags: %+v", r.Tags)
+	}
+	if len(r.Users) != 2 || r.Users[0] != (Amount{"alice", 8000}) || r.Users[1] != (Amount{"bob", 7000}) {
+		t.Errorf("unexpected users: %+v", r.Users)
+	}
+	//budgets only count spending on a transaction's first tag
+	if len(r.Budgets) != 3 || r.Budgets[0] != (BudgetStatus{"car", 5000, 3000}) || r.Budgets[1] != (BudgetStatus{"food", 10000, 12000}) ||
+		r.Budgets[2] != (BudgetStatus{"gas", 2000, 0}) {
+		t.Errorf("unexpected budgets: %+v", r.Budgets)
+	}
+	if r.Previous.Out != 10000 || r.LastYear.Out != 30000 {
+		t.Errorf("unexpected comparisons: %+v %+v", r.Previous, r.LastYear)
+	}
+	str := r.String()
+	for _, want := range []string{
+		"*Spending report for October 2025*",
+		">net: *$1850.00*",
+		">balance: -$400.00 to $1450.00",
+		">food: $120.00 (80.0%)",
+		">car: $30.00 (20.0%)",
+		">@bob: $70.00",
+		">food: $120.00 of $100.00, *over by $20.00*",
+		">car: $30.00 of $50.00, $20.00 left",
+		">gas: $0.00 of $20.00, $20.00 left",
+		">previous period: spent $100.00, +50.0% this period",
+		">same period last year: spent $300.00, -50.0% this period",
+	} {
+		if !strings.Contains(str, want) {
+			t.Errorf("report is missing %q:\n%s", want, str)
+		}
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "breakdown.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	day := func(d int) Timestamp {
+		return Timestamp(time.Date(2026, 9, d, 12, 0, 0, 0, location))
+	}
+	for _, txn := range []Txn{
+		{Date: day(1), Amount: 200000, Tags: []string{"salary"}, User: "alice"},
+		{Date: day(2), Amount: -8000, Tags: []string{"food"}, User: "alice"},
+		{Date: day(3), Amount: -4000, Tags: []string{"food", "party"}, User: "bob"},
+		{Date: day(4), Amount: -3000, Tags: []string{"car", "gas", "food"}, User: "bob"},
+		{Date: day(5), Amount: -1000, Tags: []string{"food"}, User: "bob"},
+		{Date: day(30), Amount: 99900, Tags: []string{}, Note: "summary txn", User: "Server", Summary: true},
+		{Date: Timestamp(time.Date(2026, 10, 1, 12, 0, 0, 0, location)), Amount: -50000, Tags: []string{"rent"}, User: "alice"},
+	} {
+		if err := db.PutTransaction(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := parseDateRange(t, "2026-09")
+	breakdown, total, err := db.GetTagBreakdown(r[0], r[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 16000 {
+		t.Error("unexpected total spent:", total)
+	}
+	var tags []string
+	for _, tb := range breakdown {
+		tags = append(tags, fmt.Sprintf("%s %d", tb.tag, tb.Total()))
+	}
+	//transactions with several tags count towards their first tag only
+	if strings.Join(tags, ",") != "food -13000,car -3000" {
+		t.Error("unexpected breakdown:", tags)
+	}
+	if shares := breakdown[0].Shares(); len(shares) != 2 || shares[0] != (Amount{"alice", 8000}) || shares[1] != (Amount{"bob", 5000}) {
+		t.Errorf("unexpected food shares: %+v", shares)
+	}
+	if title := rangeTitle(r[0], r[1]); title != "September 2026" {
+		t.Error("unexpected title:", title)
+	}
+	if title := rangeTitle(Weekly.Start(r[0]), Weekly.End(r[0])); title != "Aug 31 - Sep 6 2026" {
+		t.Error("unexpected title:", title)
+	}
+}
+
+func parseDateRange(t *testing.T, s string) *[2]time.Time {
+	t.Helper()
+	r, ok := parseDate(s)
+	if !ok {
+		t.Fatal("unable to parse date", s)
+	}
+	return r
+}
+
+func TestInsights(t *testing.T) {
+	day := func(m time.Month, d int) Timestamp {
+		return Timestamp(time.Date(2026, m, d, 12, 0, 0, 0, location))
+	}
+	var txns []Txn
+	for i, total := range []USD{9000, 11000, 10000, 9500, 10500, 10000} {
+		m := time.April + time.Month(i)
+		txns = append(txns,
+			Txn{Date: day(m, 3), Amount: -total / 2, Tags: []string{"food"}, User: "alice"},
+			Txn{Date: day(m, 17), Amount: -total / 2, Tags: []string{"food"}, User: "bob"},
+			Txn{Date: day(m, 5), Amount: -10000, Tags: []string{"car"}, User: "bob"},
+		)
+	}
+	txns = append(txns,
+		Txn{Date: day(9, 9), Amount: -3000, Tags: []string{"gift"}, User: "alice"},
+		Txn{Date: day(10, 2), Amount: -5000, Tags: []string{"food"}, User: "alice"},
+		Txn{Date: day(10, 3), Amount: -20000, Tags: []string{"food"}, User: "bob"},
+		Txn{Date: day(10, 5), Amount: -10000, Tags: []string{"car"}, User: "bob"},
+		Txn{Date: day(10, 6), Amount: -90000, Tags: []string{"gift"}, User: "alice"},
+		Txn{Date: day(10, 7), Amount: 500000, Tags: []string{"salary"}, User: "alice"},
+	)
+	insights := analyze(txns, time.Date(2026, 10, 15, 0, 0, 0, 0, location))
+	if len(insights) != 2 {
+		t.Fatalf("expected 2 insights got %+v", insights)
+	}
+	var msgs []string
+	for _, in := range insights {
+		if in.Tag != "food" {
+			t.Error("unexpected insight:", in.Message)
+		}
+		msgs = append(msgs, in.Message)
+	}
+	all := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"food is 2.5x your 6-month average this month ($250.00 vs $100.00)",
+		"@bob spent $200.00 on food",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("insights are missing %q:\n%s", want, all)
+		}
+	}
+}
+
+func TestForecast(t *testing.T) {
+	day := func(m time.Month, d int) Timestamp {
+		return Timestamp(time.Date(2026, m, d, 12, 0, 0, 0, location))
+	}
+	var txns []Txn
+	for m := time.April; m <= time.September; m++ {
+		txns = append(txns,
+			Txn{Date: day(m, 1), Amount: -120000, Tags: []string{"rent"}, User: "alice"},
+			Txn{Date: day(m, 25), Amount: 250000, Tags: []string{"salary"}, User: "alice"},
+			Txn{Date: day(m, 10), Amount: -50000, Tags: []string{"food"}, User: "bob"},
+			Txn{Date: day(m, 20), Amount: -10000 - USD(m)*1000, Tags: []string{"food"}, User: "bob"},
+		)
+	}
+	//one off transactions aren't recurring
+	txns = append(txns, Txn{Date: day(5, 15), Amount: -30000, Tags: []string{"gift"}, User: "alice"})
+	txns = append(txns,
+		Txn{Date: day(10, 1), Amount: -121000, Tags: []string{"rent"}, User: "alice"},
+		Txn{Date: day(10, 8), Amount: -50500, Tags: []string{"food"}, User: "bob"},
+	)
+
+	starts := []time.Time{}
+	for m := time.April; m <= time.September; m++ {
+		starts = append(starts, time.Date(2026, m, 1, 0, 0, 0, 0, location))
+	}
+	rules := detectRecurring(txns[:len(txns)-2], starts)
+	var names []string
+	for _, r := range rules {
+		names = append(names, r.String())
+	}
+	if strings.Join(names, ", ") != "-$1200.00 rent, -$500.00 food, +$2500.00 salary" {
+		t.Error("unexpected recurring rules:", names)
+	}
+
+	f := forecast(50000, txns, time.Date(2026, 10, 16, 0, 0, 0, 0, location))
+	if len(f.Upcoming) != 1 || f.Upcoming[0].Tag != "salary" {
+		t.Errorf("unexpected upcoming transactions: %+v", f.Upcoming)
+	}
+	//the second food transaction of the month is the only spending that isn't recurring
+	if f.Spent != 0 || f.Remaining <= 0 {
+		t.Errorf("unexpected spending: %s so far, %s more", f.Spent, f.Remaining)
+	}
+	if !(f.Low <= f.Expected && f.Expected <= f.High) || f.Expected > 50000+250000 {
+		t.Errorf("unexpected projection: %s between %s and %s", f.Expected, f.Low, f.High)
+	}
+	if str := f.String(); !strings.Contains(str, "recurring still to come: +$2500.00 salary") || strings.Contains(str, "Warning") {
+		t.Error("unexpected forecast:", str)
+	}
+
+	f = forecast(-10000, txns[len(txns)-2:], time.Date(2026, 10, 16, 0, 0, 0, 0, location))
+	if !strings.Contains(f.String(), "projected to go negative") {
+		t.Error("expected a warning:", f)
+	}
+}
+
+func TestGoals(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "goals.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	for _, cmd := range []string{
+		"goal create vacation 3000 by 2099-06",
+		"goal create vacation 10 by 2099-06",
+		"goal create past 10 by 2001-06",
+		"goal add vacation 200",
+		"goal add nothing 5",
+		"goal nonsense",
+	} {
+		if err := h.HandleCommand(textMsg("alice", cmd)); err != nil {
+			t.Fatalf("%q: %s", cmd, err)
+		}
+	}
+	goals, err := db.GetGoals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(goals) != 1 || goals[0].Name != "vacation" || goals[0].Target != 300000 || goals[0].Deadline.Time().Month() != 6 {
+		t.Fatalf("unexpected goals: %+v", goals)
+	}
+	p, err := h.goalProgress(goals[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Saved != 20000 {
+		t.Error("unexpected amount saved:", p.Saved)
+	}
+	//contributions are moved to the goal's account, they aren't spending
+	if bal, err := db.GetAccountBalance(assetAccount("goal-vacation"), time.Now()); err != nil || bal != 20000 {
+		t.Error("contribution was not moved to the goal's account:", bal, err)
+	}
+	if worth, err := db.GetNetWorth(time.Now()); err != nil || worth != 0 {
+		t.Error("contribution changed the net worth:", worth, err)
+	}
+	if txns, err := db.GetTransactions(time.Time{}, time.Now()); err != nil || len(txns) != 0 {
+		t.Errorf("contribution was recorded as spending: %+v %v", txns, err)
+	}
+	//older versions recorded contributions as spending on the goal's tag
+	if err := db.PutTransaction(Txn{Date: TimestampNow(), Amount: -5000, Tags: []string{"goal-vacation"}, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = h.goalProgress(goals[0]); err != nil || p.Saved != 25000 {
+		t.Error("unexpected amount saved with an older contribution:", p.Saved, err)
+	}
+
+	day := func(y int, m time.Month) Timestamp {
+		return Timestamp(time.Date(y, m, 1, 0, 0, 0, 0, location))
+	}
+	g := Goal{"car", 300000, day(2027, 7), day(2026, 1), "alice"}
+	var contributions []Txn
+	for m := time.February; m <= time.June; m++ {
+		contributions = append(contributions, Txn{Date: day(2026, m), Amount: 20000})
+	}
+	p = progress(g, contributions, time.Date(2026, 7, 1, 0, 0, 0, 0, location))
+	if p.Saved != 100000 || p.Monthly < 16000 || p.Monthly > 17000 || p.Average < 20000 || p.Average > 20500 {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+	if p.ETA == nil || p.ETA.Year() != 2027 || p.ETA.Month() != 4 {
+		t.Error("unexpected eta:", p.ETA)
+	}
+	if str := p.String(); !strings.Contains(str, "on pace to finish Apr 2027, on track") {
+		t.Error("unexpected progress:", str)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "accounts.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	for _, cmd := range []string{
+		"start 1000",
+		"account add checking",
+		"account add visa",
+		"account add checking",
+		"account add main",
+		"spent 60 on food from visa",
+		"received 2500 from salary into checking",
+		"transfer 500 from checking to visa",
+		"transfer 5 from checking to nowhere",
+		"transfer 5 from visa to visa",
+		"spent 5 on food from the market",
+	} {
+		if err := h.HandleCommand(textMsg("alice", cmd)); err != nil {
+			t.Fatalf("%q: %s", cmd, err)
+		}
+	}
+	accounts, err := db.GetAccounts()
+	if err != nil || len(accounts) != 2 || accounts[0].Name != "checking" || accounts[1].Name != "visa" {
+		t.Fatalf("unexpected accounts: %+v %v", accounts, err)
+	}
+	balances, err := db.GetAccountBalances(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 3 || balances["main"] != 99500 || balances["checking"] != 200000 || balances["visa"] != 44000 {
+		t.Errorf("unexpected balances: %v", balances)
+	}
+	if str := balancesString(accounts, balances); !strings.Contains(str, ">visa: $440.00") || !strings.Contains(str, "net worth is **$3435.00**") {
+		t.Error("unexpected balances:", str)
+	}
+	//transfers aren't spending or income, and from words that aren't an
+	//account are part of the note
+	txns, err := db.GetTransactions(time.Time{}, time.Now())
+	if err != nil || len(txns) != 3 || txns[2].Note != "from the market" || txns[2].Account != "" {
+		t.Errorf("unexpected transactions: %+v %v", txns, err)
+	}
+	if str := balancesString(nil, map[string]USD{"main": -500}); str != "current balance is **-$5.00**" {
+		t.Error("unexpected balance:", str)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	day := func(d int) Timestamp {
+		return Timestamp(time.Date(2026, 9, d, 12, 0, 0, 0, location))
+	}
+	e, ok := journalEntry(Txn{Date: day(1), Amount: -1200, Tags: []string{"food", "lunch"}, User: "alice", Account: "visa"})
+	if !ok || !e.Balanced() || e.String() != "assets:visa -$12.00, expenses:food $12.00" {
+		t.Error("unexpected entry for spending:", e.String())
+	}
+	e, _ = journalEntry(Txn{Date: day(1), Amount: 50000, User: "alice"})
+	if !e.Balanced() || e.String() != "assets:main $500.00, income:untagged -$500.00" {
+		t.Error("unexpected entry for income:", e.String())
+	}
+	e, _ = journalEntry(Txn{Date: day(1), Amount: 100000, Tags: []string{}, User: "alice", Summary: true})
+	if e.String() != "assets:main $1000.00, equity:opening -$1000.00" {
+		t.Error("unexpected entry for a starting balance:", e.String())
+	}
+	e, _ = journalEntry(Txn{Date: day(1), Amount: -500, Tags: []string{}, User: "alice", Transfer: true}, Txn{Date: day(1), Amount: 500, Tags: []string{}, User: "alice", Account: "visa", Transfer: true})
+	if !e.Balanced() || e.String() != "assets:main -$5.00, assets:visa $5.00" {
+		t.Error("unexpected entry for a transfer:", e.String())
+	}
+	if _, ok := journalEntry(Txn{Date: day(1), Amount: 100000, Tags: []string{}, Note: "summary txn", User: summaryUser, Summary: true}); ok {
+		t.Error("period summaries aren't part of the journal")
+	}
+
+	//transactions recorded before the journal existed are translated when it's created
+	path := filepath.Join(t.TempDir(), "journal.db")
+	conn, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Exec(`CREATE TABLE txs(tx JSON)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, txn := range []Txn{
+		{Date: day(1), Amount: 100000, Tags: []string{}, Note: "Starting transaction", User: "alice", Summary: true},
+		{Date: day(2), Amount: -2000, Tags: []string{"food"}, User: "alice"},
+		{Date: day(3), Amount: -30000, Tags: []string{}, User: "alice", Transfer: true},
+		{Date: day(3), Amount: 30000, Tags: []string{}, User: "alice", Account: "savings", Transfer: true},
+		{Date: day(30), Amount: 68000, Tags: []string{}, Note: "summary txn", User: summaryUser, Summary: true},
+	} {
+		tjson, _ := txn.Json()
+		if err := conn.Exec(`INSERT INTO txs VALUES (?)`, tjson); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+	db := NewDB(path)
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutEntry(&Entry{Date: day(1), Postings: []Posting{{"assets:main", 100}}}); err != ErrUnbalanced {
+		t.Error("expected an unbalanced entry to be refused got", err)
+	}
+	entries, err := db.GetEntries(time.Time{}, time.Now())
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("unexpected entries: %+v %v", entries, err)
+	}
+	for _, e := range entries {
+		if !e.Balanced() {
+			t.Error("unbalanced entry:", e.String())
+		}
+	}
+	if err := db.PutTransaction(Txn{Date: day(10), Amount: -1000, Tags: []string{"food"}, User: "bob", Account: "savings"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		account string
+		at      time.Time
+		bal     USD
+	}{
+		{"assets:main", time.Date(2026, 9, 2, 23, 0, 0, 0, location), 98000},
+		{"assets:main", time.Now(), 68000},
+		{"assets:savings", time.Now(), 29000},
+		{"expenses:food", time.Now(), 3000},
+		{"equity:opening", time.Now(), -100000},
+	} {
+		if bal, err := db.GetAccountBalance(tc.account, tc.at); err != nil || bal != tc.bal {
+			t.Errorf("%s at %s: expected %s got %s %v", tc.account, tc.at, tc.bal, bal, err)
+		}
+	}
+	//initializing again doesn't translate anything twice
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ = db.GetEntries(time.Time{}, time.Now()); len(entries) != 4 {
+		t.Error("unexpected entries after initializing again:", len(entries))
+	}
+	//every transaction but the summary is linked to its entry
+	linked, err := db.GetEntryTransactions()
+	if err != nil || len(linked) != 4 || len(linked[entries[2].ID]) != 2 || linked[entries[3].ID][0].User != "bob" {
+		t.Errorf("unexpected linked transactions: %+v %v", linked, err)
+	}
+
+	//databases journaled before transactions were linked to their entries
+	//are linked when they're opened
+	path = filepath.Join(t.TempDir(), "unlinked.db")
+	if conn, err = sqlite3.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{
+		`CREATE TABLE txs(tx JSON)`,
+		`CREATE TABLE entries(id INTEGER PRIMARY KEY, date INTEGER, user TEXT, note TEXT)`,
+		`CREATE TABLE postings(entry INTEGER, account TEXT, amount INTEGER, date INTEGER)`,
+	} {
+		if err := conn.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the second transaction was never journaled, and bob's entry isn't for a transaction
+	for i, txn := range []Txn{
+		{Date: day(1), Amount: 100000, Tags: []string{}, Note: "Starting transaction", User: "alice", Summary: true},
+		{Date: day(2), Amount: -500, Tags: []string{"food"}, User: "alice"},
+		{Date: day(3), Amount: -2000, Tags: []string{"food"}, User: "alice"},
+	} {
+		tjson, _ := txn.Json()
+		if err := conn.Exec(`INSERT INTO txs VALUES (?)`, tjson); err != nil {
+			t.Fatal(err)
+		}
+		e, _ := journalEntry(txn)
+		entries := []Entry{e}
+		switch i {
+		case 0:
+			entries = append(entries, Entry{Date: day(1), User: "bob"})
+		case 1:
+			entries = nil
+		}
+		for _, e := range entries {
+			if err := conn.Exec(`INSERT INTO entries(date, user, note) VALUES (?, ?, ?)`, e.Date.Time().UnixNano(), e.User, e.Note); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	conn.Close()
+	unlinked := NewDB(path)
+	if err := unlinked.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer unlinked.Close()
+	//the gap doesn't stop the rest being linked
+	if linked, err = unlinked.GetEntryTransactions(); err != nil || len(linked) != 2 || len(linked[1]) != 1 || len(linked[3]) != 1 || linked[3][0].Amount != -2000 {
+		t.Errorf("unexpected linked transactions: %+v %v", linked, err)
+	}
+	if txns, err := unlinked.GetUnjournaledTransactions(); err != nil || len(txns) != 1 || txns[0].Amount != -500 {
+		t.Errorf("unexpected unjournaled transactions: %+v %v", txns, err)
+	}
+}
+
+func TestOpeningBalances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opening.db")
+	db := NewDB(path)
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+
+	now := time.Now()
+	last := period.Previous(now)
+	at := func(start time.Time, d int) Timestamp {
+		return Timestamp(start.AddDate(0, 0, d))
+	}
+	for _, txn := range []Txn{
+		{Date: at(period.Previous(last), 0), Amount: 100000, Tags: []string{}, Note: "Starting transaction", User: "alice", Summary: true},
+		{Date: at(last, 1), Amount: -2000, Tags: []string{"food"}, User: "alice"},
+		//recorded by an older version at the end of last period
+		{Date: at(period.Start(now), 0), Amount: 98000, Tags: []string{}, Note: "summary txn", User: summaryUser, Summary: true},
+		//backdated after the summary was recorded
+		{Date: at(last, 2), Amount: -5000, Tags: []string{"food"}, User: "bob"},
+		{Date: Timestamp(period.Start(now).Add(time.Second)), Amount: 40000, Tags: []string{"salary"}, User: "alice"},
+	} {
+		if err := db.PutTransaction(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the backdated transaction is part of this period's opening balance
+	if opening, err := h.openingBalance(period.Start(now)); err != nil || opening != 93000 {
+		t.Error("unexpected opening balance:", opening, err)
+	}
+	if opening, err := h.openingBalance(last); err != nil || opening != 100000 {
+		t.Error("unexpected opening balance of last period:", opening, err)
+	}
+	if worth, err := db.GetNetWorth(now); err != nil || worth != 133000 {
+		t.Error("unexpected net worth:", worth, err)
+	}
+
+	c, err := h.CheckBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.OK() || c.Summaries != 1 || len(c.Stale) != 1 {
+		t.Errorf("unexpected check: %+v", c)
+	}
+	if str := c.String(); !strings.Contains(str, "recorded $980.00, the ledger says $930.00") {
+		t.Error("unexpected check:", str)
+	}
+
+	//a transaction that bypassed the journal
+	conn, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tjson, _ := (&Txn{Date: at(last, 3), Amount: -100, Tags: []string{"food"}, User: "bob"}).Json()
+	if err := conn.Exec(`INSERT INTO txs(tx) VALUES (?)`, tjson); err != nil {
+		t.Fatal(err)
+	}
+	//a transaction changed without its journal entry
+	if err := conn.Exec(`UPDATE txs SET tx = json_set(tx, '$.Amount', -2500) WHERE rowid = 2`); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if c, err = h.CheckBooks(); err != nil {
+		t.Fatal(err)
+	}
+	if c.OK() || len(c.Unbalanced) != 0 || len(c.Mismatches) != 1 || len(c.Unjournaled) != 1 || c.Unjournaled[0].Amount != -100 {
+		t.Errorf("expected the changed and the unjournaled transactions: %+v", c)
+	}
+	if str := c.String(); !strings.Contains(str, "don't match their transactions*: 2") || !strings.Contains(str, "@bob spent $1.00 on food") {
+		t.Error("unexpected check:", str)
+	}
+}
+
+func TestBankReconciliation(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "reconcile.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+
+	day := func(d int) Timestamp {
+		return Timestamp(time.Date(2026, 9, d, 12, 0, 0, 0, location))
+	}
+	for _, txn := range []Txn{
+		{Date: day(1), Amount: 200000, Tags: []string{}, Note: "Starting transaction", User: "alice", Summary: true, Account: "checking"},
+		{Date: day(2), Amount: -4000, Tags: []string{"food"}, User: "alice", Account: "checking"},
+		{Date: day(3), Amount: -7656, Tags: []string{"car"}, User: "bob", Account: "checking"},
+		{Date: day(4), Amount: -1000, Tags: []string{"food"}, User: "bob"},
+		{Date: day(20), Amount: -3000, Tags: []string{"food"}, User: "bob", Account: "checking"},
+	} {
+		if err := db.PutTransaction(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutAccount(Account{"checking", day(1), "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2026, 9, 15, 0, 0, 0, 0, location).AddDate(0, 0, 1).Add(-1)
+	uncleared, err := db.GetUnclearedTransactions("checking", at)
+	if err != nil || len(uncleared) != 2 || uncleared[0].Amount != -4000 || uncleared[0].ID == 0 {
+		t.Fatalf("unexpected uncleared transactions: %+v %v", uncleared, err)
+	}
+	s := &Statement{"checking", at, 196000, 188344, uncleared}
+	if str := s.String(); !strings.Contains(str, fmt.Sprintf("#%d Thu Sep 3 @bob spent $76.56 on car *matches the difference*", uncleared[1].ID)) ||
+		strings.Contains(str, "food *matches") || !strings.Contains(str, ">difference: *$76.56*") {
+		t.Error("unexpected statement:", str)
+	}
+
+	//only admins reconcile
+	var out strings.Builder
+	h.SetConsole(&out)
+	defer SetAdmins(nil)
+	SetAdmins([]string{"alice"})
+	if err := h.HandleCommand(textMsg("bob", "reconcile checking 1878.44 as of 2026-09-15 adjust")); err != nil {
+		t.Fatal(err)
+	}
+	if bal, err := db.GetAccountBalance(assetAccount("checking"), at); err != nil || bal != 188344 || !strings.Contains(out.String(), "Only admins") {
+		t.Error("a user who isn't an admin reconciled:", bal, err)
+	}
+
+	//the car payment hasn't reached the bank
+	if err := h.HandleCommand(textMsg("alice", "reconcile checking 1960.00 as of 2026-09-15")); err != nil {
+		t.Fatal(err)
+	}
+	if uncleared, _ = db.GetUnclearedTransactions("checking", at); len(uncleared) != 2 {
+		t.Fatal("nothing should be cleared while there's a difference")
+	}
+	//only admins clear, and only in the account named
+	for _, cmd := range []struct{ user, text string }{
+		{"bob", fmt.Sprintf("clear checking %d", uncleared[0].ID)},
+		{"alice", fmt.Sprintf("clear visa %d", uncleared[0].ID)},
+		{"alice", fmt.Sprintf("clear main %d", uncleared[0].ID)},
+	} {
+		if err := h.HandleCommand(textMsg(cmd.user, cmd.text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if uncleared, _ = db.GetUnclearedTransactions("checking", at); len(uncleared) != 2 {
+		t.Fatal("transaction cleared by someone who isn't an admin or in another account")
+	}
+	if str := out.String(); !strings.Contains(str, "Only admins can clear") || !strings.Contains(str, "aren't in main") {
+		t.Error("unexpected reply:", str)
+	}
+	if err := h.HandleCommand(textMsg("alice", fmt.Sprintf("clear checking %d", uncleared[0].ID))); err != nil {
+		t.Fatal(err)
+	}
+	//a bank fee while the car payment is still outstanding, only the fee is adjusted
+	if err := h.HandleCommand(textMsg("alice", "reconcile checking 1955.00 as of 2026-09-15 adjust")); err != nil {
+		t.Fatal(err)
+	}
+	if bal, err := db.GetAccountBalance(assetAccount("checking"), at); err != nil || bal != 187844 {
+		t.Error("unexpected balance after the adjustment:", bal, err)
+	}
+	if uncleared, _ = db.GetUnclearedTransactions("checking", at); len(uncleared) != 1 || uncleared[0].Amount != -7656 {
+		t.Fatalf("the outstanding car payment should be left for clear: %+v", uncleared)
+	}
+	if str := out.String(); !strings.Contains(str, "Recorded an adjustment of -$5.00.") || !strings.Contains(str, "mark the ones on the statement with `clear checking <id>`") {
+		t.Error("unexpected reply:", str)
+	}
+	//now it has reached the bank
+	if err := h.HandleCommand(textMsg("alice", "reconcile checking 1878.44 as of 2026-09-15 adjust")); err != nil {
+		t.Fatal(err)
+	}
+	if uncleared, _ = db.GetUnclearedTransactions("checking", at); len(uncleared) != 0 {
+		t.Fatalf("a matching statement should clear the car payment: %+v", uncleared)
+	}
+	if bal, err := db.GetAccountBalance(assetAccount("checking"), at); err != nil || bal != 187844 {
+		t.Error("nothing more should be adjusted:", bal, err)
+	}
+	if uncleared, _ = db.GetUnclearedTransactions("checking", time.Now()); len(uncleared) != 1 || uncleared[0].Amount != -3000 {
+		t.Errorf("only the transaction after the statement should be left: %+v", uncleared)
+	}
+	if n, err := db.ClearTransactions("checking", []int64{uncleared[0].ID, uncleared[0].ID, 999}); err != nil || n != 1 {
+		t.Error("unexpected number of transactions cleared:", n, err)
+	}
+	txns, err := db.GetTransactions(time.Date(2026, 9, 1, 0, 0, 0, 0, location), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, txn := range txns {
+		if txn.Account == "checking" && !txn.Cleared {
+			t.Errorf("expected transaction to be cleared: %+v", txn)
+		}
+		if txn.Account == "" && txn.Cleared {
+			t.Errorf("transaction in another account was cleared: %+v", txn)
+		}
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "receipts.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	defer SetReceiptsDir(receiptsDir)
+	SetReceiptsDir(t.TempDir())
+
+	photo := func(caption string) chat1.MsgSummary {
+		msg := textMsg("alice", "")
+		msg.Id = 7
+		msg.Content = chat1.MsgContent{TypeName: "attachment", Attachment: &chat1.MessageAttachment{
+			Object: chat1.Asset{Filename: "IMG_0042.JPG", MimeType: "image/jpeg", Title: caption},
+		}}
+		return msg
+	}
+	if err := h.HandleCommand(photo("")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := db.HasTransactions(); has {
+		t.Fatal("a photo without a caption should not be recorded")
+	}
+	if err := h.HandleCommand(photo("spent 45.20 on hardware")); err != nil {
+		t.Fatal(err)
+	}
+	txns, err := db.GetTransactions(time.Now().Add(-time.Hour), time.Now())
+	if err != nil || len(txns) != 1 || txns[0].Amount != -4520 || txns[0].Receipt == nil {
+		t.Fatalf("expected the captioned photo to be recorded with its receipt: %+v %v", txns, err)
+	}
+	//offline the photo can't be downloaded, only the message is kept
+	if r := txns[0].Receipt; r.ConvID != "conv" || r.MsgID != 7 || r.Filename != "IMG_0042.JPG" || r.Path != "" {
+		t.Errorf("unexpected receipt: %+v", r)
+	}
+	if name := txns[0].Receipt.fileName(); name != "conv-7.jpg" {
+		t.Error("unexpected receipt file name:", name)
+	}
+
+	txn, err := db.GetTransaction(txns[0].ID)
+	if err != nil || txn == nil || txn.ID != txns[0].ID || txn.Receipt == nil {
+		t.Fatalf("unexpected transaction: %+v %v", txn, err)
+	}
+	if err := h.postReceipt("conv", txn); err == nil {
+		t.Error("expected an error posting a receipt that wasn't saved while offline")
+	}
+	txn.Receipt.Path = filepath.Join(receiptsDir, txn.Receipt.fileName())
+	if err := ioutil.WriteFile(txn.Receipt.Path, []byte("jpeg"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.postReceipt("conv", txn); err != nil {
+		t.Error("unexpected error posting a saved receipt:", err)
+	}
+	if txn, err := db.GetTransaction(999); err != nil || txn != nil {
+		t.Error("expected no transaction:", txn, err)
+	}
+	if err := h.HandleCommand(textMsg("alice", "receipt 999")); err != nil {
+		t.Error(err)
+	}
+	//another conversation can't see the receipt
+	var out strings.Builder
+	h.SetConsole(&out)
+	other := textMsg("bob", fmt.Sprintf("receipt %d", txn.ID))
+	other.ConvID = "other"
+	if err := h.HandleCommand(other); err != nil {
+		t.Error(err)
+	}
+	if str := out.String(); h.Flagged() != 1 || !strings.Contains(str, "doesn't have a receipt") {
+		t.Error("a receipt was shown in another conversation:", str)
+	}
+}
+
+//fixtureOCR stands in for an OCR program, the images it reads are text files
+//of what's printed on them
+type fixtureOCR struct{}
+
+func (fixtureOCR) Read(image string) (string, error) {
+	text, err := ioutil.ReadFile(image)
+	return string(text), err
+}
+
+func TestCommandOCR(t *testing.T) {
+	image := filepath.Join("testdata", "receipts", "hardware.txt")
+	text, err := CommandOCR{[]string{"cat"}, time.Minute}.Read(image)
+	if err != nil || !strings.Contains(text, "HOME DEPOT") {
+		t.Errorf("unexpected text: %q %v", text, err)
+	}
+	//a program that hangs is stopped
+	start := time.Now()
+	if _, err := (CommandOCR{[]string{"sh", "-c", "exec sleep 10", "{}"}, 100 * time.Millisecond}).Read(image); err == nil || !strings.Contains(err.Error(), "after 100ms") {
+		t.Error("expected the program to time out:", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("the program wasn't stopped when it timed out")
+	}
+}
+
+func TestScanReceipt(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, location)
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(2026, m, d, 0, 0, 0, 0, location)
+	}
+	for _, tc := range []struct {
+		fixture  string
+		merchant string
+		total    USD
+		date     time.Time
+	}{
+		{"hardware.txt", "The Home Depot", 4520, day(10, 12)},
+		{"grocery.txt", "Fresh Market", 3582, day(10, 3)},
+		{"cafe.txt", "Café Lumière", 1070, day(9, 28)},
+		{"faded.txt", "Gas & Go", 3920, time.Time{}},
+		{"future.txt", "Parking Garage", 125000, day(9, 14)},
+	} {
+		text, err := fixtureOCR{}.Read(filepath.Join("testdata", "receipts", tc.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := ScanReceipt(text, now)
+		if s.Merchant != tc.merchant || s.Total != tc.total || !s.Date.Equal(tc.date) {
+			t.Errorf("%s: expected %s %s %v, got %s %s %v", tc.fixture, tc.merchant, tc.total, tc.date, s.Merchant, s.Total, s.Date)
+		}
+	}
+	if s := ScanReceipt("THANK YOU\nno prices here", now); s.Total != 0 || s.Merchant != "no prices here" || !s.Date.IsZero() {
+		t.Errorf("expected only a merchant to be found, got %+v", s)
+	}
+}
+
+func TestReceiptConfirmation(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "ocr.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	defer SetOCR(nil)
+	SetOCR(fixtureOCR{})
+
+	if err := db.PutTransaction(Txn{Date: TimestampNow(), Amount: -1299, Tags: []string{"hardware"}, Note: "the home depot", User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := db.GetTagForNote("The Home Depot"); err != nil || tag != "hardware" {
+		t.Fatal("unexpected tag for the note:", tag, err)
+	}
+
+	msg := textMsg("alice", "")
+	msg.Id = 9
+	msg.Content = chat1.MsgContent{TypeName: "attachment", Attachment: &chat1.MessageAttachment{Object: chat1.Asset{Filename: "receipt.jpg"}}}
+	r := &Receipt{msg.ConvID, msg.Channel, msg.Id, "receipt.jpg", filepath.Join("testdata", "receipts", "hardware.txt")}
+	if err := h.proposeReceipt(r.Path, r, msg); err != nil {
+		t.Fatal(err)
+	}
+	if txns, _ := db.GetTransactions(time.Time{}, time.Now().Add(time.Hour)); len(txns) != 1 {
+		t.Fatal("the receipt should not be recorded before it's confirmed")
+	}
+	//offline prompts have id 0
+	if err := h.HandleReaction(reactionMsg("alice", 0, ":+1:")); err != nil {
+		t.Fatal(err)
+	}
+	txns, err := db.GetTransactions(time.Time{}, time.Now().Add(time.Hour))
+	if err != nil || len(txns) != 2 {
+		t.Fatalf("expected the receipt to be recorded: %+v %v", txns, err)
+	}
+	txn := txns[0]
+	if txns[1].Receipt != nil {
+		txn = txns[1]
+	}
+	if txn.Amount != -4520 || txn.Tags[0] != "hardware" || txn.Note != "The Home Depot" || txn.User != "alice" ||
+		txn.Receipt == nil || txn.Receipt.MsgID != 9 {
+		t.Errorf("unexpected transaction from the receipt: %+v", txn)
+	}
+	if d := txn.Date.Time(); d.Day() != 12 || d.Month() != time.October || d.Hour() != 12 {
+		t.Error("expected the transaction on the day of the receipt, got", d)
+	}
+
+	//only photos are read
+	var out strings.Builder
+	h.SetConsole(&out)
+	msg.Content.Attachment.Object = chat1.Asset{Filename: "statement.pdf", MimeType: "application/pdf"}
+	if err := h.HandleCommand(msg); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Error("an attachment that isn't a photo was read:", out.String())
+	}
+}
+
+func TestAPI(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "api.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	api := NewAPI(&h, map[string]string{"alice": "alice-token-0123456789"})
+	if err := db.PutAccount(Account{"visa", TimestampNow(), "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, url, token, body string, v interface{}) int {
+		t.Helper()
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %s: %s", method, url, err, w.Body)
+			}
+		}
+		return w.Code
+	}
+	if code := do("GET", "/api/tags", "", "", nil); code != http.StatusUnauthorized {
+		t.Error("expected a request without a token to be unauthorized, got", code)
+	}
+	if code := do("GET", "/api/tags", "alice-token-0123456788", "", nil); code != http.StatusUnauthorized {
+		t.Error("expected a request with the wrong token to be unauthorized, got", code)
+	}
+	bare := httptest.NewRequest("GET", "/api/tags", nil)
+	bare.Header.Set("Authorization", "alice-token-0123456789")
+	if user, ok := api.authenticate(bare); !ok || user != "alice" {
+		t.Error("expected a token without the Bearer scheme to be accepted, got", user, ok)
+	}
+
+	var created apiTxn
+	code := do("POST", "/api/transactions", "alice-token-0123456789",
+		`{"type": "spent", "amount": "45.20", "tags": ["hardware"], "note": "deck screws", "account": "Visa"}`, &created)
+	if code != http.StatusCreated || created.ID == 0 || created.Amount != "-45.20" || created.User != "alice" || created.Account != "visa" {
+		t.Errorf("unexpected transaction created: %d %+v", code, created)
+	}
+	for _, body := range []string{
+		`{"type": "spent", "amount": "-5", "tags": ["food"]}`,
+		`{"type": "spent", "amount": "5", "tags": ["bad tag"]}`,
+		`{"type": "spent", "amount": "5", "tags": ["food"], "account": "savings"}`,
+		`{"type": "lent", "amount": "5", "tags": ["food"]}`,
+		`{"type": "received", "amount": "5"}`,
+		`{"type": "received", "amount": "5", "tags": ["gifts"], "user": "bob"}`,
+	} {
+		var res map[string]string
+		if code := do("POST", "/api/transactions", "alice-token-0123456789", body, &res); code != http.StatusBadRequest || res["error"] == "" {
+			t.Errorf("expected %s to be rejected, got %d %v", body, code, res)
+		}
+	}
+	if code := do("POST", "/api/transactions", "alice-token-0123456789", `{"type": "received", "amount": "1,200", "tags": ["salary"]}`, nil); code != http.StatusCreated {
+		t.Error("unexpected status receiving:", code)
+	}
+
+	var txns []apiTxn
+	if code := do("GET", "/api/transactions", "alice-token-0123456789", "", &txns); code != http.StatusOK || len(txns) != 2 || txns[0].Tags[0] != "hardware" {
+		t.Errorf("unexpected transactions: %d %+v", code, txns)
+	}
+	if code := do("GET", "/api/transactions?from=2020-01", "alice-token-0123456789", "", &txns); code != http.StatusOK || len(txns) != 2 {
+		t.Errorf("unexpected transactions since 2020: %d %+v", code, txns)
+	}
+	if code := do("GET", "/api/transactions?from=yesterday", "alice-token-0123456789", "", nil); code != http.StatusBadRequest {
+		t.Error("expected an invalid date to be rejected, got", code)
+	}
+	if code := do("DELETE", "/api/transactions", "alice-token-0123456789", "", nil); code != http.StatusMethodNotAllowed {
+		t.Error("unexpected status deleting:", code)
+	}
+
+	var bal struct {
+		Accounts map[string]string `json:"accounts"`
+		NetWorth string            `json:"net_worth"`
+	}
+	if code := do("GET", "/api/balance", "alice-token-0123456789", "", &bal); code != http.StatusOK ||
+		bal.Accounts["main"] != "1200.00" || bal.Accounts["visa"] != "-45.20" || bal.NetWorth != "1154.80" {
+		t.Errorf("unexpected balance: %d %+v", code, bal)
+	}
+	var tags []string
+	if code := do("GET", "/api/tags", "alice-token-0123456789", "", &tags); code != http.StatusOK || len(tags) != 2 {
+		t.Errorf("unexpected tags: %d %v", code, tags)
+	}
+	var tbs []apiTagBalance
+	if code := do("GET", "/api/tags/balances?tag=hardware", "alice-token-0123456789", "", &tbs); code != http.StatusOK ||
+		len(tbs) != 1 || tbs[0].Total != "-45.20" || tbs[0].Users["alice"] != "-45.20" {
+		t.Errorf("unexpected tag balances: %d %+v", code, tbs)
+	}
+	if code := do("GET", "/api/tags/balances", "alice-token-0123456789", "", &tbs); code != http.StatusOK ||
+		len(tbs) != 2 || tbs[0].Tag != "hardware" || tbs[1].Tag != "salary" || tbs[1].Total != "1200.00" {
+		t.Errorf("unexpected balances of every tag: %d %+v", code, tbs)
+	}
+
+	//notes are kept as written, even when they look like part of the command
+	code = do("POST", "/api/transactions", "alice-token-0123456789",
+		`{"type": "spent", "amount": "3", "tags": ["food"], "note": "lunch \\ \"from visa\""}`, &created)
+	if code != http.StatusCreated || created.Note != `lunch \ "from visa"` || created.Account != defaultAccount {
+		t.Errorf("unexpected transaction created: %d %+v", code, created)
+	}
+	//nobody can react to confirm a transaction recorded with the API
+	defer SetThresholds(thresholds)
+	SetThresholds(Thresholds{Above: 100})
+	var res map[string]string
+	if code := do("POST", "/api/transactions", "alice-token-0123456789", `{"type": "spent", "amount": "500", "tags": ["food"]}`, &res); code != http.StatusBadRequest ||
+		!strings.Contains(res["error"], "record it in chat") {
+		t.Errorf("expected a transaction that needs confirming to be rejected, got %d %v", code, res)
+	}
+	//a rejected transaction doesn't affect the next one
+	if code := do("POST", "/api/transactions", "alice-token-0123456789", `{"type": "spent", "amount": "5", "tags": ["food"]}`, &created); code != http.StatusCreated {
+		t.Error("unexpected status after a rejected transaction:", code)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	db := NewDB(filepath.Join(t.TempDir(), "dashboard.db"))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := NewHandler(nil, db, "")
+	api := NewAPI(&h, map[string]string{"alice": "alice-token-0123456789"})
+	api.ServeDashboard()
+
+	now := time.Now()
+	for _, txn := range []Txn{
+		{Date: Timestamp(Monthly.Previous(Monthly.Previous(Monthly.Start(now))).Add(time.Hour)), Amount: 250000, Tags: []string{"salary"}, User: "alice"},
+		{Date: TimestampNow(), Amount: -4520, Tags: []string{"hardware"}, Note: "<script>alert(1)</script>", User: "bob"},
+	} {
+		if err := db.PutTransaction(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := h.BuildDashboard(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Months) != trendMonths || d.Months[trendMonths-1].Total.Out != 4520 || d.Months[trendMonths-3].InPct != 100 ||
+		d.Months[trendMonths-1].OutPct != 1 {
+		t.Errorf("unexpected monthly trends: %+v", d.Months)
+	}
+	if len(d.Recent) != 2 || d.Recent[0].Amount != -4520 || d.NetWorth != 245480 {
+		t.Errorf("unexpected dashboard: %+v", d)
+	}
+
+	get := func(user, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.SetBasicAuth(user, token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+	if w := get("", ""); w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Error("expected the browser to be asked to sign in, got", w.Code)
+	}
+	if w := get("bob", "alice-token-0123456789"); w.Code != http.StatusUnauthorized {
+		t.Error("expected a token to only sign in its own user, got", w.Code)
+	}
+	w := get("alice", "alice-token-0123456789")
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body)
+	}
+	page := w.Body.String()
+	for _, want := range []string{"$2454.80", "hardware", "-$45.20", "&lt;script&gt;", now.Format("Jan 2006")} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected the dashboard to contain %q", want)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Error("notes should be escaped")
+	}
+	req := httptest.NewRequest("GET", "/api/tags", nil)
+	req.SetBasicAuth("alice", "alice-token-0123456789")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Error("expected the API to work next to the dashboard, got", w.Code)
+	}
+
+	//backdated transactions are listed by when they happened, not when they were recorded
+	if err := db.PutTransaction(Txn{Date: Timestamp(Monthly.Previous(Monthly.Start(now))), Amount: -1000, Tags: []string{"food"}, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = h.BuildDashboard(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Recent) != 3 || d.Recent[0].Amount != -4520 || d.Recent[1].Amount != -1000 || d.Recent[2].Amount != 250000 {
+		t.Errorf("expected the recent transactions newest first: %+v", d.Recent)
+	}
+}
+
+func TestCharts(t *testing.T) {
+	day := func(m time.Month, d int) Timestamp {
+		return Timestamp(time.Date(2026, m, d, 12, 0, 0, 0, location))
+	}
+	txns := []Txn{
+		{Date: day(8, 3), Amount: -2000, Tags: []string{"food"}, User: "alice"},
+		{Date: day(9, 3), Amount: -3000, Tags: []string{"food", "party"}, User: "bob"},
+		{Date: day(9, 4), Amount: -1000, Tags: []string{"car"}, User: "alice"},
+		{Date: day(9, 5), Amount: 90000, Tags: []string{"salary"}, User: "alice"},
+		{Date: day(10, 1), Amount: -500, Tags: []string{"food"}, User: "bob"},
+	}
+	s := Span{Count: 3, Unit: Monthly}
+	starts := s.Starts(time.Date(2026, 10, 15, 0, 0, 0, 0, location))
+	labels, values := spendingPerPeriod(txns, starts, Monthly, "food")
+	if strings.Join(labels, ",") != "Aug 26,Sep 26,Oct 26" || values[0] != 2000 || values[1] != 3000 || values[2] != 500 {
+		t.Errorf("unexpected food spending per period: %v %v", labels, values)
+	}
+	labels, values = spendingShares(txns, "")
+	if strings.Join(labels, ",") != "food,car" || values[0] != 5500 || values[1] != 1000 {
+		t.Errorf("unexpected shares by tag: %v %v", labels, values)
+	}
+	labels, _ = spendingShares(txns, "food")
+	if strings.Join(labels, ",") != "@bob,@alice" {
+		t.Errorf("unexpected shares by user: %v", labels)
+	}
+
+	dir := t.TempDir()
+	for _, kind := range []ChartKind{BarChart, LineChart, PieChart} {
+		c := &Chart{kind, "Spending, last 3 months", []string{"Aug 26", "Sep 26", "Oct 26"}, []USD{2000, 3000, 500}}
+		path, err := c.WritePNG(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s chart is not a png: %s", kind, err)
+		}
+		if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartHeight {
+			t.Errorf("%s chart has unexpected size %v", kind, b)
+		}
+		//the first value is drawn in the first palette color
+		var found bool
+		for y := 0; y < chartHeight && !found; y++ {
+			for x := 0; x < chartWidth && !found; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				found = r>>8 == uint32(chartPalette[0].R) && g>>8 == uint32(chartPalette[0].G) && b>>8 == uint32(chartPalette[0].B)
+			}
+		}
+		if !found {
+			t.Errorf("%s chart has no data drawn", kind)
+		}
+	}
+}
+
+func TestCLI(t *testing.T) {
+	defer SetThresholds(DefaultThresholds())
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.DBLoc = filepath.Join(dir, "cli.db")
+	cfg.KBLoc = filepath.Join(dir, "no-keybase")
+	if err := cfg.ValidateLocal(); err != nil {
+		t.Fatal("keybase shouldn't be needed from the command line:", err)
+	}
+	run := func(args ...string) (string, int) {
+		var out, errs strings.Builder
+		code := RunCLI(cfg, args, &out, &errs)
+		return out.String() + errs.String(), code
+	}
+
+	for _, args := range [][]string{
+		{"add", "-user", "alice", "start", "1000"},
+		{"add", "-user", "alice", "spent", "12.50", "on", "food", "lunch"},
+		{"add", "-user", "bob", "received", "2000", "from", "salary"},
+	} {
+		if out, code := run(args...); code != 0 {
+			t.Fatalf("%v exited with %d: %s", args, code, out)
+		}
+	}
+	if out, code := run("add", "-user", "alice", "spent", "12.50"); code == 0 || !strings.Contains(out, "usage: spent") {
+		t.Errorf("expected a usage error, got %d: %s", code, out)
+	}
+	if out, code := run("add", "spent", "12.50", "on", "food"); code != 2 || !strings.Contains(out, "usage: add -user <name>") {
+		t.Errorf("expected -user to be required, got %d: %s", code, out)
+	}
+	if out, code := run("add", "-user", "Alice Smith", "spent", "12.50", "on", "food"); code == 0 || !strings.Contains(out, "invalid user") {
+		t.Errorf("expected an invalid user, got %d: %s", code, out)
+	}
+	if out, code := run("add", "-user", "alice", "goal", "list"); code == 0 {
+		t.Errorf("only transactions should be added, got %d: %s", code, out)
+	}
+	if out, code := run("add", "-user", "alice", "transfer", "5", "from", "main", "to", "visa"); code == 0 || !strings.Contains(out, "account add visa") {
+		t.Errorf("expected an unknown account, got %d: %s", code, out)
+	}
+	if out, code := run("frobnicate"); code != 2 || !strings.Contains(out, "backup <file>") {
+		t.Errorf("expected the subcommands for an unknown one, got %d: %s", code, out)
+	}
+
+	out, code := run("list")
+	if code != 0 || !strings.Contains(out, "\talice\t-12.50\tmain\tfood\tlunch\n") || !strings.Contains(out, "\tbob\t2000.00\tmain\tsalary\t\n") {
+		t.Errorf("unexpected list %d: %q", code, out)
+	}
+	if out, code := run("balance"); code != 0 || !strings.Contains(out, "main\t2987.50\n") || !strings.Contains(out, "net worth\t2987.50\n") {
+		t.Errorf("unexpected balance %d: %q", code, out)
+	}
+	if out, code := run("tags"); code != 0 || out != "food\nsalary\n" {
+		t.Errorf("unexpected tags %d: %q", code, out)
+	}
+	if out, code := run("migrate"); code != 0 || !strings.Contains(out, "up to date") {
+		t.Errorf("unexpected migrate %d: %q", code, out)
+	}
+
+	export := filepath.Join(dir, "export.csv")
+	if out, code := run("export", export); code != 0 {
+		t.Fatalf("export exited with %d: %s", code, out)
+	}
+	if out, code := run("export", export); code == 0 {
+		t.Errorf("export shouldn't overwrite a file: %s", out)
+	}
+	backup := filepath.Join(dir, "backup.db")
+	if out, code := run("backup", backup); code != 0 {
+		t.Fatalf("backup exited with %d: %s", code, out)
+	}
+
+	//a transfer to an account the new database doesn't have yet
+	csv, err := ioutil.ReadFile(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Now().Format(time.RFC3339Nano)
+	csv = append(csv, fmt.Sprintf("9,%s,-100.00,,,alice,,false,true,false\n9,%s,100.00,,,alice,Savings,false,true,false\n", date, date)...)
+	if err := ioutil.WriteFile(export, csv, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.DBLoc = filepath.Join(dir, "imported.db")
+	bad := filepath.Join(dir, "bad.csv")
+	if err := ioutil.WriteFile(bad, append(csv, "10,yesterday,5,food,,alice,,false,false,false\n"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := run("import", bad); code == 0 || !strings.Contains(out, "line 7: invalid date") {
+		t.Errorf("expected an invalid date, got %d: %s", code, out)
+	}
+	//nothing is imported from a file that doesn't balance, not even its accounts
+	unbalanced := filepath.Join(dir, "unbalanced.csv")
+	if err := ioutil.WriteFile(unbalanced, []byte(strings.Replace(string(csv), ",100.00,,,alice,Savings,", ",90.00,,,alice,Savings,", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, code := run("import", unbalanced); code == 0 || !strings.Contains(out, "does not balance") || strings.Contains(out, "added the account") {
+		t.Errorf("expected an unbalanced import to fail, got %d: %s", code, out)
+	}
+	if out, code := run("import", export); code != 0 || !strings.Contains(out, "added the account savings") || !strings.Contains(out, "imported 5 transactions") {
+		t.Fatalf("unexpected import %d: %s", code, out)
+	}
+	if out, code := run("balance"); code != 0 || !strings.Contains(out, "main\t2887.50\n") || !strings.Contains(out, "savings\t100.00\n") || !strings.Contains(out, "net worth\t2987.50\n") {
+		t.Errorf("unexpected imported balance %d: %q", code, out)
+	}
+	if out, code := run("migrate"); code != 0 || !strings.Contains(out, "matches its transactions") {
+		t.Errorf("the imported books should balance, got %d: %q", code, out)
+	}
+	if out, code := run("import", export); code == 0 || !strings.Contains(out, "already has transactions") {
+		t.Errorf("expected importing twice to be refused, got %d: %s", code, out)
+	}
+	if out, code := run("balance"); code != 0 || !strings.Contains(out, "net worth\t2987.50\n") {
+		t.Errorf("nothing should be imported twice %d: %q", code, out)
+	}
+
+	cfg.DBLoc = backup
+	if out, code := run("balance"); code != 0 || !strings.Contains(out, "net worth\t2987.50\n") {
+		t.Errorf("unexpected backup balance %d: %q", code, out)
+	}
+}
+
 func TestMain(m *testing.M) {
 	x := m.Run()
 	_ = os.Remove("test.db")
@@ -1,37 +1,110 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sync/errgroup"
 )
 
 func main() {
-	homedir := os.Getenv("KST_KBHOME")
-	keybase := os.Getenv("KST_KBLOC")
-	dbloc := os.Getenv("KST_DBLOC")
-	errConvID := os.Getenv("KST_DBGCONV")
-	users, err := NewAuthorizedUsers(os.Getenv("KST_USERS"))
+	configPath := flag.String("config", os.Getenv("KST_CONFIG"), "path to a TOML config file (KST_CONFIG)")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, print it and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [subcommand]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), CLIUsage())
+	}
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	//subcommands manage the database from the command line instead of running the bot
+	if flag.NArg() > 0 {
+		os.Exit(RunCLI(cfg, flag.Args(), os.Stdout, os.Stderr))
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		fmt.Println(cfg)
+		fmt.Println("configuration ok")
+		return
+	}
+	if err := cfg.Apply(); err != nil {
+		fmt.Println("error applying configuration:", err)
+		os.Exit(1)
 	}
 
 	s := new(Server)
-	s.SetUsers(users)
-
-	kbc, err := s.Start(keybase, homedir, errConvID)
+	kbc, err := s.Start(cfg.KBLoc, cfg.KBHome, cfg.DebugConv)
 	if err != nil {
 		fmt.Println("error starting server:", err)
 		os.Exit(1)
 	}
+	//the keybase process has started, it's shut down on every error from here on
+	exit := func(msg string, err error) {
+		fmt.Println(msg, err)
+		if serr := s.Shutdown(); serr != nil {
+			fmt.Println("error shutting down keybase:", serr)
+		}
+		os.Exit(1)
+	}
+	if err := s.LoadUsers(cfg.UsersString()); err != nil {
+		exit("error loading authorized users:", err)
+	}
+	//re-read the config on SIGHUP so edits to the users take effect
+	s.ReloadUsersOnHangup(func() string {
+		c, err := LoadConfig(*configPath)
+		if err != nil {
+			s.Debug("SIGHUP: %s", err)
+			return cfg.UsersString()
+		}
+		return c.UsersString()
+	})
 
-	db := DB(dbloc)
-	err = db.Init()
-	if err != nil {
-		panic(err)
+	db := NewDB(cfg.DBLoc)
+	if err := db.Init(); err != nil {
+		exit("error opening database:", err)
 	}
 
-	h := NewHandler(kbc, &db, errConvID)
-	err = s.Listen(h)
+	//SIGINT and SIGTERM (docker stop) cancel ctx, after which in-flight
+	//commands are finished before Run returns
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//the API stops with the bot and is done with the database before it's closed
+	eg, ctx := errgroup.WithContext(ctx)
+	h := NewHandler(kbc, db, cfg.DebugConv)
+	if cfg.API.Listen != "" {
+		api := NewAPI(&h, cfg.API.Tokens)
+		if cfg.API.Dashboard {
+			api.ServeDashboard()
+		}
+		eg.Go(func() error {
+			if err := api.ListenAndServe(ctx, cfg.API.Listen); err != nil {
+				return fmt.Errorf("serving the API: %w", err)
+			}
+			return nil
+		})
+	}
+	eg.Go(func() error { return s.Run(ctx, h) })
+	err = eg.Wait()
+	stop()
+	if cerr := db.Close(); cerr != nil {
+		fmt.Println("error closing database:", cerr)
+	}
+	if serr := s.Shutdown(); serr != nil {
+		fmt.Println("error shutting down keybase:", serr)
+	}
 	if err != nil {
 		fmt.Println("error starting listeners", err)
 		os.Exit(2)
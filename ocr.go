@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//OCR reads the text in an image. Receipts are read on the bot's machine,
+//photos are never sent to an online service.
+type OCR interface {
+	Read(image string) (string, error)
+}
+
+//CommandOCR reads images with a local OCR program like tesseract. {} in its
+//arguments is replaced by the image, which is appended if there's no {}.
+//The program prints the text it read.
+type CommandOCR struct {
+	Args    []string
+	Timeout time.Duration //how long the program may run, 0 waits for it to finish
+}
+
+//Read runs the program on image and returns what it printed. The program is
+//killed and an error returned if it runs longer than the timeout.
+func (c CommandOCR) Read(image string) (string, error) {
+	if len(c.Args) == 0 {
+		return "", errors.New("CommandOCR: no program to run")
+	}
+	args := make([]string, 0, len(c.Args))
+	replaced := false
+	for _, arg := range c.Args[1:] {
+		if strings.Contains(arg, "{}") {
+			arg = strings.Replace(arg, "{}", image, -1)
+			replaced = true
+		}
+		args = append(args, arg)
+	}
+	if !replaced {
+		args = append(args, image)
+	}
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Args[0], args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s: still reading %s after %s", c.Args[0], image, c.Timeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", c.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+//ocr reads the receipts of photos sent without a caption, nil if they aren't read
+var ocr OCR
+
+//SetOCR sets how receipts are read, nil stops reading them
+func SetOCR(o OCR) {
+	ocr = o
+}
+
+//receiptTag is the tag transactions read from a receipt are proposed with
+//when the merchant hasn't been tagged before
+const receiptTag = "receipt"
+
+//ReceiptScan is what was found on a receipt
+type ReceiptScan struct {
+	Merchant string
+	Total    USD
+	Date     time.Time //the start of the day on the receipt, zero if there's none
+}
+
+var (
+	//receiptAmountExp matches amounts with cents ie: 45.20, $1,045.20 or 45,20
+	receiptAmountExp = regexp.MustCompile(`(\d{1,3}(?:[,.]\d{3})+|\d+)[.,](\d{2})(?:[^\d]|$)`)
+	totalExp         = regexp.MustCompile(`(?i)\b(total|amount due|balance due|to pay)\b`)
+	notTotalExp      = regexp.MustCompile(`(?i)sub\s*-?\s*total|total\s+(savings|saved|discount|items|qty|tax)|\btax\b|you saved`)
+	//paymentExp matches lines about how the receipt was paid, not what it cost
+	paymentExp = regexp.MustCompile(`(?i)\b(cash|change|tender(ed)?|paid|visa|mastercard|debit|credit|card)\b`)
+	//notMerchantExp matches lines at the top of a receipt that aren't the merchant
+	notMerchantExp = regexp.MustCompile(`(?i)^(welcome|thank|receipt|invoice|store|tel|phone|fax|www\.|https?:)|@|\.com\b`)
+
+	receiptISODateExp   = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	receiptSlashDateExp = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})/(\d{4}|\d{2})\b`)
+	receiptMonthDateExp = regexp.MustCompile(`(?i)\b([a-z]{3})[a-z]*\.?\s+(\d{1,2}),?\s+(\d{4})\b`)
+	receiptDayMonthExp  = regexp.MustCompile(`(?i)\b(\d{1,2})\s+([a-z]{3})[a-z]*\.?,?\s+(\d{4})\b`)
+)
+
+//ScanReceipt finds the merchant, total and date in the text of a receipt.
+//The total is the largest amount on a line labelled total, or the largest
+//amount that isn't a payment if there's no such line. The merchant is the
+//first line near the top that reads like a name, and the date is the first
+//one that isn't after now.
+func ScanReceipt(text string, now time.Time) ReceiptScan {
+	var (
+		s       ReceiptScan
+		largest USD
+	)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if s.Merchant == "" && i < 5 {
+			s.Merchant = merchantName(line)
+		}
+		if s.Date.IsZero() {
+			if d, ok := receiptDate(line); ok && !d.After(now) {
+				s.Date = d
+			}
+		}
+		amounts := receiptAmounts(line)
+		if totalExp.MatchString(line) && !notTotalExp.MatchString(line) {
+			//the amount may be printed on the line below its label
+			if len(amounts) == 0 && i+1 < len(lines) {
+				amounts = receiptAmounts(lines[i+1])
+			}
+			if n := len(amounts); n > 0 && amounts[n-1] > s.Total {
+				s.Total = amounts[n-1]
+			}
+			continue
+		}
+		if paymentExp.MatchString(line) {
+			continue
+		}
+		for _, amt := range amounts {
+			if amt > largest {
+				largest = amt
+			}
+		}
+	}
+	if s.Total == 0 {
+		s.Total = largest
+	}
+	return s
+}
+
+//receiptAmounts returns the amounts with cents on a line of a receipt
+func receiptAmounts(line string) []USD {
+	var amounts []USD
+	for _, m := range receiptAmountExp.FindAllStringSubmatch(line, -1) {
+		dollars, err := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(m[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		cents, _ := strconv.ParseInt(m[2], 10, 64)
+		amounts = append(amounts, USD(dollars*100+cents))
+	}
+	return amounts
+}
+
+//merchantName returns line cleaned up as the name of a merchant ie: Home Depot
+//for HOME DEPOT #4521, or an empty string if it doesn't read like a name
+func merchantName(line string) string {
+	if notMerchantExp.MatchString(line) || len(receiptAmounts(line)) > 0 {
+		return ""
+	}
+	if _, ok := receiptDate(line); ok {
+		return ""
+	}
+	var words []string
+	letters := 0
+	for _, w := range strings.Fields(line) {
+		w = strings.TrimFunc(w, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '&' })
+		if w != "&" && strings.IndexFunc(w, unicode.IsLetter) < 0 {
+			//store numbers, street numbers and punctuation
+			continue
+		}
+		for _, r := range w {
+			if unicode.IsLetter(r) {
+				letters++
+			}
+		}
+		words = append(words, w)
+	}
+	if letters < 3 {
+		return ""
+	}
+	name := strings.Join(words, " ")
+	if strings.ToUpper(name) == name {
+		name = titleCase(name)
+	}
+	return name
+}
+
+//titleCase capitalizes the first letter of every word and lower cases the rest
+func titleCase(s string) string {
+	words := strings.Fields(strings.ToLower(s))
+	for i, w := range words {
+		r := []rune(w)
+		r[0] = unicode.ToUpper(r[0])
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
+
+//receiptDate returns the start of the day written on a line of a receipt.
+//Dates with slashes are read month first.
+func receiptDate(line string) (time.Time, bool) {
+	var y, m, d int
+	var month time.Month
+	if p := receiptISODateExp.FindStringSubmatch(line); p != nil {
+		y, m, d = atoi(p[1]), atoi(p[2]), atoi(p[3])
+		month = time.Month(m)
+	} else if p := receiptSlashDateExp.FindStringSubmatch(line); p != nil {
+		m, d, y = atoi(p[1]), atoi(p[2]), atoi(p[3])
+		if y < 100 {
+			y += 2000
+		}
+		month = time.Month(m)
+	} else if p := receiptMonthDateExp.FindStringSubmatch(line); p != nil {
+		month, d, y = monthAbbr[strings.ToLower(p[1])], atoi(p[2]), atoi(p[3])
+	} else if p := receiptDayMonthExp.FindStringSubmatch(line); p != nil {
+		d, month, y = atoi(p[1]), monthAbbr[strings.ToLower(p[2])], atoi(p[3])
+	} else {
+		return time.Time{}, false
+	}
+	date := time.Date(y, month, d, 0, 0, 0, 0, location)
+	//reject dates like 2026-02-31 that time.Date would normalize
+	if month == 0 || date.Month() != month || date.Day() != d {
+		return time.Time{}, false
+	}
+	return date, true
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+//HandleReceiptPhoto reads the receipt in a photo sent without a caption and
+//asks whether to record what was spent. Attachments that aren't images are
+//ignored.
+func (h *Handler) HandleReceiptPhoto(msg chat1.MsgSummary) error {
+	if mime := msg.Content.Attachment.Object.MimeType; !strings.HasPrefix(mime, "image/") {
+		h.Debug("skipping %q attachment, only photos are read as receipts", mime)
+		return nil
+	}
+	if ocr == nil {
+		h.Debug("skipping photo without a caption, reading receipts is off")
+		return nil
+	}
+	r := h.saveReceipt(msg)
+	return h.withReceiptFile(r, func(path string) error {
+		return h.proposeReceipt(path, r, msg)
+	})
+}
+
+//proposeReceipt reads the receipt at path and asks whether to record what was
+//spent, keeping r as the transaction's receipt
+func (h *Handler) proposeReceipt(path string, r *Receipt, msg chat1.MsgSummary) error {
+	text, err := ocr.Read(path)
+	if err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	t := now()
+	s := ScanReceipt(text, t)
+	if s.Total == 0 {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "%s", "I couldn't find the total on that receipt, send it again with a caption like `spent 45.20 on hardware`.")
+		return nil
+	}
+	tag := receiptTag
+	if s.Merchant != "" {
+		known, err := h.db.GetTagForNote(s.Merchant)
+		if err != nil {
+			return err
+		}
+		if known != "" {
+			tag = known
+		}
+	}
+	//receipts from earlier days are recorded at noon on the day they're from
+	date := Timestamp(t)
+	if y, m, d := t.Date(); s.Date.Before(time.Date(y, m, d, 0, 0, 0, 0, location)) && !s.Date.IsZero() {
+		date = Timestamp(s.Date.Add(12 * time.Hour))
+	}
+	txn := Txn{Date: date, Amount: -s.Total, Tags: []string{tag}, Note: s.Merchant, User: msg.Sender.Username, Receipt: r}
+
+	at := ""
+	if s.Merchant != "" {
+		at = " at " + s.Merchant
+	}
+	promptID, err := h.Ask(msg.ConvID, "Record %s spent on %s%s on %s? react %s to confirm, or send the photo again with a caption to record it differently",
+		s.Total, tag, at, date, reactions.Confirm)
+	if err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	if err := h.db.PutPending(newPending(txn, msg, promptID)); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactQuestion(msg)
+	return nil
+}
@@ -1,15 +1,41 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"sync"
+
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
+//reactions are the emoji used by the React* methods
+var reactions = DefaultReactions()
+
+//DefaultReactions returns the reactions used when none are configured
+func DefaultReactions() Reactions {
+	return Reactions{
+		Success:  "✔",
+		Error:    "❗",
+		Dollar:   "💲",
+		Question: "❓",
+		Confirm:  ":+1:",
+	}
+}
+
+//SetReactions sets the emoji used by the React* methods
+func SetReactions(r Reactions) {
+	reactions = r
+}
+
 type Output struct {
 	name          string
+	mu            sync.Mutex //guards KBC, which is replaced when keybase restarts
 	KBC           *kbchat.API
 	ErrReportConv string
+	console       io.Writer //where replies are written when run from the command line
+	flagged       int       //how many messages were reacted to with an error or question on the console
 }
 
 func NewDebugOutput(name string, kbc *kbchat.API, errConv string) *Output {
@@ -24,46 +50,141 @@ func (d *Output) Debug(msg string, args ...interface{}) {
 	fmt.Printf(d.name+": "+msg+"\n", args...)
 }
 
+//SetConsole writes replies to w instead of logging them while offline, as
+//when commands are run from the command line
+func (d *Output) SetConsole(w io.Writer) {
+	d.console = w
+}
+
+//Flagged returns how many messages were reacted to with an error or a
+//question on the console
+func (d *Output) Flagged() int {
+	return d.flagged
+}
+
+//SetAPI points the output at a new keybase connection
+func (d *Output) SetAPI(kbc *kbchat.API) {
+	d.mu.Lock()
+	d.KBC = kbc
+	d.mu.Unlock()
+}
+
+//api returns the current keybase connection
+func (d *Output) api() *kbchat.API {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.KBC
+}
+
+//offline reports whether there is no keybase connection to send chat messages with,
+//as when handlers are run from tests
+func (d *Output) offline() bool {
+	return d.api() == nil
+}
+
 func (d *Output) ChatDebug(convID chat1.ConvIDStr, msg string, args ...interface{}) {
 	d.Debug(msg, args...)
-	if _, err := d.KBC.SendMessageByConvID(convID, "Something went wrong!"); err != nil {
+	if d.offline() {
+		return
+	}
+	if _, err := d.api().SendMessageByConvID(convID, "Something went wrong!"); err != nil {
 		d.Debug("ChatDebug: failed to send error message: %s", err)
 	}
 }
 
 func (d *Output) ReactSuccess(msg chat1.MsgSummary) {
-	d.react(msg.ConvID, msg.Id, "✔")
+	d.react(msg.ConvID, msg.Id, reactions.Success)
 }
 
 func (d *Output) ReactError(msg chat1.MsgSummary) {
-	d.react(msg.ConvID, msg.Id, "❗")
+	d.react(msg.ConvID, msg.Id, reactions.Error)
 }
 
 func (d *Output) ReactDollar(msg chat1.MsgSummary) {
-	d.react(msg.ConvID, msg.Id, "💲")
+	d.react(msg.ConvID, msg.Id, reactions.Dollar)
 
 }
 
 func (d *Output) ReactQuestion(msg chat1.MsgSummary) {
-	d.react(msg.ConvID, msg.Id, "❓")
+	d.react(msg.ConvID, msg.Id, reactions.Question)
 
 }
 
 func (d *Output) react(convID chat1.ConvIDStr, msgID chat1.MessageID, reaction string) {
-	if _, err := d.KBC.ReactByConvID(convID, msgID, reaction); err != nil {
+	if d.offline() && d.console != nil {
+		if reaction == reactions.Error || reaction == reactions.Question {
+			d.flagged++
+		}
+		return
+	}
+	if d.offline() {
+		d.Debug("react %s to %v", reaction, msgID)
+		return
+	}
+	if _, err := d.api().ReactByConvID(convID, msgID, reaction); err != nil {
 		d.Debug("ChatConfirm: failed to react to message", err)
 	}
 }
 
 func (d *Output) ChatEcho(convID chat1.ConvIDStr, msg string, args ...interface{}) {
-	if _, err := d.KBC.SendMessageByConvID(convID, msg, args...); err != nil {
+	if d.offline() && d.console != nil {
+		fmt.Fprintf(d.console, msg+"\n", args...)
+		return
+	}
+	if d.offline() {
+		d.Debug("echo: "+msg, args...)
+		return
+	}
+	if _, err := d.api().SendMessageByConvID(convID, msg, args...); err != nil {
 		d.Debug("ChatEcho: failed to send echo message", err)
 	}
 }
 
+//Ask sends a message that expects a reply and returns its id
+func (d *Output) Ask(convID chat1.ConvIDStr, msg string, args ...interface{}) (chat1.MessageID, error) {
+	if d.offline() && d.console != nil {
+		fmt.Fprintf(d.console, msg+"\n", args...)
+		return 0, nil
+	}
+	if d.offline() {
+		d.Debug("ask: "+msg, args...)
+		return 0, nil
+	}
+	res, err := d.api().SendMessageByConvID(convID, msg, args...)
+	if err != nil {
+		return 0, err
+	}
+	if res.Result.MessageID == nil {
+		return 0, fmt.Errorf("Ask: keybase did not return the id of the message sent")
+	}
+	return *res.Result.MessageID, nil
+}
+
+//Attach uploads the file at filename to the conversation
+func (d *Output) Attach(convID chat1.ConvIDStr, filename, title string) error {
+	if d.offline() {
+		d.Debug("attach: %s %s", filename, title)
+		return nil
+	}
+	_, err := d.api().SendAttachmentByConvID(convID, filename, title)
+	return err
+}
+
+//Download saves the file attached to a message to filename
+func (d *Output) Download(channel chat1.ChatChannel, msgID chat1.MessageID, filename string) error {
+	if d.offline() {
+		return errors.New("Download: no keybase connection to download attachments with")
+	}
+	return d.api().DownloadToFile(channel, msgID, filename)
+}
+
 //Notify broadcasts the given message
 func (d *Output) Notify(args ...interface{}) {
-	if _, err := d.KBC.Broadcast(fmt.Sprint(args...)); err != nil {
+	if d.offline() {
+		d.Debug("notify: %s", fmt.Sprint(args...))
+		return
+	}
+	if _, err := d.api().Broadcast(fmt.Sprint(args...)); err != nil {
 		d.Debug("Notify: failed to broadcast message", err)
 	}
 }
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	//tokWord is a run of characters without whitespace, commas or quotes
+	tokWord tokenKind = iota
+	//tokString is a quoted string
+	tokString
+	//tokComma is a comma separating list items
+	tokComma
+)
+
+//token is a lexed piece of a command. pos is the byte offset of the
+//token in the input.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+//isQuote returns whether r opens or closes a quoted string. Phone keyboards
+//often insert curly quotes, so they're accepted too.
+func isQuote(r rune) bool {
+	return r == '"' || r == '“' || r == '”'
+}
+
+//isDigitComma returns whether the comma at i is between two digits, as in
+//1,200.00, making it part of a word instead of a list separator
+func isDigitComma(input string, i int) bool {
+	return i > 0 && i+1 < len(input) &&
+		input[i-1] >= '0' && input[i-1] <= '9' &&
+		input[i+1] >= '0' && input[i+1] <= '9'
+}
+
+//lex splits a command into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == ',' && !isDigitComma(input, i):
+			tokens = append(tokens, token{tokComma, ",", i})
+			i += size
+		case isQuote(r):
+			start := i
+			i += size
+			var b strings.Builder
+			closed := false
+			for i < len(input) {
+				r, size = utf8.DecodeRuneInString(input[i:])
+				i += size
+				if r == '\\' && i < len(input) {
+					r, size = utf8.DecodeRuneInString(input[i:])
+					i += size
+				} else if isQuote(r) {
+					closed = true
+					break
+				}
+				b.WriteRune(r)
+			}
+			if !closed {
+				return nil, &ParseError{input, start, "unterminated quoted string"}
+			}
+			tokens = append(tokens, token{tokString, b.String(), start})
+		default:
+			start := i
+			for i < len(input) {
+				r, size = utf8.DecodeRuneInString(input[i:])
+				if unicode.IsSpace(r) || (r == ',' && !isDigitComma(input, i)) || isQuote(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, token{tokWord, input[start:i], start})
+		}
+	}
+	return tokens, nil
+}
+
+//ParseError describes where and why a command couldn't be parsed
+type ParseError struct {
+	Input string
+	Pos   int
+	Msg   string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+//Pointer returns the input with a caret under the position of the error,
+//formatted as a chat code block
+func (e *ParseError) Pointer() string {
+	col := utf8.RuneCountInString(e.Input[:e.Pos])
+	return fmt.Sprintf("```\n%s\n%s^\n```", e.Input, strings.Repeat(" ", col))
+}
+
+type argKind int
+
+const (
+	argKeyword argKind = iota
+	argAmount
+	argTags
+	argTag
+	argWord
+	argDate
+	argUser
+	argNote
+	argSpan
+	argAccount
+	argStatement
+	argAsOf
+	argIDs
+)
+
+//param is one element of a command's grammar
+type param struct {
+	kind     argKind
+	name     string //placeholder shown in usage, or the keyword alternatives
+	optional bool
+}
+
+//keyword matches one of the given words separated by |, ie: on|from
+func keyword(words string) param { return param{kind: argKeyword, name: words} }
+
+//amount matches a currency amount ie: 12, 12.5, $12.50, 1,200.00
+func amount() param { return param{kind: argAmount, name: "amount"} }
+
+//tags matches one tag or a comma separated list of tags
+func tags() param { return param{kind: argTags, name: "tag"} }
+
+//tag matches a single tag
+func tag() param { return param{kind: argTag, name: "tag"} }
+
+//word matches any single word
+func word(name string) param { return param{kind: argWord, name: name} }
+
+//dateRange matches a month name, a month (2026-10) or a day (2026-10-15)
+func dateRange() param { return param{kind: argDate, name: "month|date"} }
+
+//user matches a user mention ie: @alice
+func user() param { return param{kind: argUser, name: "user"} }
+
+//note matches the rest of the input, or a single quoted string
+func note() param { return param{kind: argNote, name: "note"} }
+
+//span matches a stretch of periods ie: this month, last week, last 6 months
+func span() param { return param{kind: argSpan, name: "span"} }
+
+//account matches one of the given words separated by | followed by an
+//account name, ie: from checking
+func account(words string) param { return param{kind: argAccount, name: words} }
+
+//statement matches an account and the balance on its statement ie: checking 1523.44
+func statement() param { return param{kind: argStatement, name: "account"} }
+
+//asOf matches as of followed by a month or date ie: as of 2026-10-15
+func asOf() param { return param{kind: argAsOf, name: "month|date"} }
+
+//ids matches one transaction id or a comma separated list of them
+func ids() param { return param{kind: argIDs, name: "id"} }
+
+//optional marks p as not required
+func optional(p param) param {
+	p.optional = true
+	return p
+}
+
+//usage returns the param as it's shown in a command's usage
+func (p param) usage() string {
+	var u string
+	switch p.kind {
+	case argKeyword:
+		u = p.name
+	case argTags:
+		u = "<tag>[, <tag>...]"
+	case argUser:
+		u = "@<user>"
+	case argSpan:
+		u = "this|last [<n>] months|weeks"
+	case argAccount:
+		u = p.name + " <account>"
+	case argStatement:
+		u = "<account> <amount>"
+	case argAsOf:
+		u = "as of <" + p.name + ">"
+	case argIDs:
+		u = "<id>[, <id>...]"
+	default:
+		u = "<" + p.name + ">"
+	}
+	if p.optional {
+		return "[" + u + "]"
+	}
+	return u
+}
+
+//expected describes what the param matches, for parse errors
+func (p param) expected() string {
+	switch p.kind {
+	case argKeyword:
+		return "`" + strings.Replace(p.name, "|", "` or `", -1) + "`"
+	case argAmount:
+		return "an amount like 12.50"
+	case argTags:
+		return "a tag or comma separated list of tags"
+	case argTag:
+		return "a tag"
+	case argDate:
+		return "a month like jan, or a date like 2026-10 or 2026-10-15"
+	case argUser:
+		return "a user like @alice"
+	case argSpan:
+		return "a span like this month or last 6 weeks"
+	case argAccount:
+		return "`" + strings.Replace(p.name, "|", "` or `", -1) + "` and an account"
+	case argStatement:
+		return "an account and its balance like checking 1523.44"
+	case argAsOf:
+		return "`as of` and a month or date like 2026-10-15"
+	case argIDs:
+		return "a transaction id or comma separated list of ids"
+	default:
+		return "a " + p.name
+	}
+}
+
+//grammar is the sequence of params following a command's name
+type grammar []param
+
+//usage returns the command's syntax
+func (g grammar) usage(name string) string {
+	parts := []string{name}
+	for _, p := range g {
+		parts = append(parts, p.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+//Args are the typed arguments parsed from a command
+type Args struct {
+	Keywords     []string      //the keyword matched by each keyword param, lower cased
+	Amount       USD           //the amount given
+	Tags         []string      //the tags given
+	Words        []string      //the words matched by each word param
+	Range        *[2]time.Time //the first and last nanosecond of the date given
+	User         string        //the username mentioned
+	Note         string        //the note given
+	Span         *Span         //the stretch of periods given
+	Account      string        //the account given, lower cased
+	AccountWords string        //the words the account was given with ie: from visa
+	IDs          []int64       //the transaction ids given
+}
+
+//clone returns a copy of args that can be changed without affecting args
+func (args *Args) clone() *Args {
+	c := *args
+	c.Keywords = append([]string(nil), args.Keywords...)
+	c.Tags = append([]string(nil), args.Tags...)
+	c.Words = append([]string(nil), args.Words...)
+	c.IDs = append([]int64(nil), args.IDs...)
+	return &c
+}
+
+//Span is a stretch of consecutive months or weeks
+type Span struct {
+	Count int    //how many periods the span covers
+	Unit  Period //the length of each period
+	Last  bool   //whether the span ends with the previous period instead of the current one
+}
+
+//String returns the span as it's written in commands
+func (s *Span) String() string {
+	unit := "month"
+	if s.Unit == Weekly {
+		unit = "week"
+	}
+	switch {
+	case s.Count > 1:
+		return fmt.Sprintf("last %d %ss", s.Count, unit)
+	case s.Last:
+		return "last " + unit
+	}
+	return "this " + unit
+}
+
+//Starts returns the start of each period in the span containing or
+//preceding t, oldest first
+func (s *Span) Starts(t time.Time) []time.Time {
+	start := s.Unit.Start(t)
+	if s.Last {
+		start = s.Unit.Previous(t)
+	}
+	starts := make([]time.Time, s.Count)
+	for i := s.Count - 1; i >= 0; i-- {
+		starts[i] = start
+		start = s.Unit.Previous(start)
+	}
+	return starts
+}
+
+var (
+	amountExp = regexp.MustCompile(`^\$?((\d+|\d{1,3}(,\d{3})+)(\.\d{0,2})?|\.\d{1,2})$`)
+	tagExp    = regexp.MustCompile(`^[\p{L}\p{N}_][\p{L}\p{N}_-]*$`)
+	dayExp    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	monthExp  = regexp.MustCompile(`^\d{4}-\d{2}$`)
+)
+
+//parser walks the tokens of a command
+type parser struct {
+	input  string
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() *token {
+	if p.next < len(p.tokens) {
+		return &p.tokens[p.next]
+	}
+	return nil
+}
+
+//errorAt returns a parse error at the next token, or the end of input
+func (p *parser) errorAt(msg string, args ...interface{}) *ParseError {
+	pos := len(p.input)
+	if t := p.peek(); t != nil {
+		pos = t.pos
+	}
+	return &ParseError{p.input, pos, fmt.Sprintf(msg, args...)}
+}
+
+//parse parses the tokens following the command's name
+func (g grammar) parse(input string, tokens []token) (*Args, error) {
+	p := &parser{input: input, tokens: tokens}
+	return g.match(p, new(Args))
+}
+
+//match parses the remaining tokens with the params of g. An optional param
+//that matched is skipped and the rest retried if the rest doesn't match, so
+//chart pie this month doesn't take "this" as a tag. Errors are reported
+//from the first attempt.
+func (g grammar) match(p *parser, args *Args) (*Args, error) {
+	if len(g) == 0 {
+		if t := p.peek(); t != nil {
+			return nil, p.errorAt("unexpected `%s`", t.text)
+		}
+		return args, nil
+	}
+	prm, start, saved := g[0], p.next, args.clone()
+	ok, err := p.parseParam(prm, args)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		p.next = start
+		if prm.optional {
+			return g[1:].match(p, saved)
+		}
+		if p.peek() == nil {
+			return nil, p.errorAt("missing %s", prm.expected())
+		}
+		return nil, p.errorAt("expected %s", prm.expected())
+	}
+	matched, err := g[1:].match(p, args)
+	if err == nil || !prm.optional {
+		return matched, err
+	}
+	p.next = start
+	if matched, retryErr := g[1:].match(p, saved); retryErr == nil {
+		return matched, nil
+	}
+	return nil, err
+}
+
+//parseParam parses a single param into args. It returns false if the next
+//tokens don't match the param.
+func (p *parser) parseParam(prm param, args *Args) (bool, error) {
+	t := p.peek()
+	if t == nil {
+		return false, nil
+	}
+	if prm.kind != argNote && t.kind != tokWord {
+		return false, nil
+	}
+	switch prm.kind {
+	case argKeyword:
+		for _, kw := range strings.Split(prm.name, "|") {
+			if strings.EqualFold(t.text, kw) {
+				args.Keywords = append(args.Keywords, kw)
+				p.next++
+				return true, nil
+			}
+		}
+		return false, nil
+	case argAmount:
+		amt, ok := parseAmount(t.text)
+		if !ok {
+			return false, nil
+		}
+		args.Amount = amt
+		p.next++
+		return true, nil
+	case argTags:
+		for {
+			t = p.peek()
+			if t == nil || t.kind != tokWord {
+				return false, nil
+			}
+			if !tagExp.MatchString(t.text) {
+				return false, p.errorAt("invalid tag `%s`, tags may only contain letters, numbers, - and _", t.text)
+			}
+			args.Tags = append(args.Tags, t.text)
+			p.next++
+			if t = p.peek(); t == nil || t.kind != tokComma {
+				return true, nil
+			}
+			p.next++
+			if t = p.peek(); t == nil || t.kind != tokWord {
+				return false, p.errorAt("expected a tag after `,`")
+			}
+		}
+	case argTag:
+		if !tagExp.MatchString(t.text) {
+			return false, nil
+		}
+		args.Tags = append(args.Tags, t.text)
+		p.next++
+		return true, nil
+	case argWord:
+		args.Words = append(args.Words, t.text)
+		p.next++
+		return true, nil
+	case argDate:
+		r, ok := parseDate(t.text)
+		if !ok {
+			return false, nil
+		}
+		args.Range = r
+		p.next++
+		return true, nil
+	case argUser:
+		name := strings.ToLower(strings.TrimPrefix(t.text, "@"))
+		if !strings.HasPrefix(t.text, "@") || !usernameExp.MatchString(name) {
+			return false, nil
+		}
+		args.User = name
+		p.next++
+		return true, nil
+	case argNote:
+		if t.kind == tokString && p.next == len(p.tokens)-1 {
+			args.Note = t.text
+		} else {
+			args.Note = strings.Join(strings.Fields(p.input[t.pos:]), " ")
+		}
+		p.next = len(p.tokens)
+		return true, nil
+	case argSpan:
+		s, n := parseSpan(p.tokens[p.next:])
+		if s == nil {
+			return false, nil
+		}
+		args.Span = s
+		p.next += n
+		return true, nil
+	case argAccount:
+		if p.next+1 >= len(p.tokens) {
+			return false, nil
+		}
+		name := p.tokens[p.next+1]
+		if name.kind != tokWord || !tagExp.MatchString(name.text) {
+			return false, nil
+		}
+		for _, kw := range strings.Split(prm.name, "|") {
+			if strings.EqualFold(t.text, kw) {
+				args.Account = strings.ToLower(name.text)
+				args.AccountWords = t.text + " " + name.text
+				p.next += 2
+				return true, nil
+			}
+		}
+		return false, nil
+	case argStatement:
+		if p.next+1 >= len(p.tokens) || !tagExp.MatchString(t.text) || p.tokens[p.next+1].kind != tokWord {
+			return false, nil
+		}
+		amt, ok := parseAmount(p.tokens[p.next+1].text)
+		if !ok {
+			return false, nil
+		}
+		args.Account, args.Amount = strings.ToLower(t.text), amt
+		p.next += 2
+		return true, nil
+	case argAsOf:
+		if p.next+2 >= len(p.tokens) || !strings.EqualFold(t.text, "as") || !strings.EqualFold(p.tokens[p.next+1].text, "of") {
+			return false, nil
+		}
+		r, ok := parseDate(p.tokens[p.next+2].text)
+		if !ok {
+			return false, nil
+		}
+		args.Range = r
+		p.next += 3
+		return true, nil
+	case argIDs:
+		for {
+			t = p.peek()
+			if t == nil || t.kind != tokWord {
+				return false, nil
+			}
+			//12,15 lexes as one word like a thousands separator
+			for _, field := range strings.Split(t.text, ",") {
+				id, err := strconv.ParseInt(strings.TrimPrefix(field, "#"), 10, 64)
+				if err != nil || id < 1 {
+					return false, p.errorAt("invalid transaction id `%s`", field)
+				}
+				args.IDs = append(args.IDs, id)
+			}
+			p.next++
+			if t = p.peek(); t == nil || t.kind != tokComma {
+				return true, nil
+			}
+			p.next++
+		}
+	}
+	return false, nil
+}
+
+//parseAmount parses a currency amount ie: 12, 12.5, $12.50, 1,200.00
+func parseAmount(s string) (USD, bool) {
+	if !amountExp.MatchString(s) {
+		return 0, false
+	}
+	amt, err := StringToUSD(strings.Replace(strings.TrimPrefix(s, "$"), ",", "", -1))
+	return amt, err == nil
+}
+
+//parseDate parses a month name, a month ie: 2026-10, or a day ie: 2026-10-15
+//into the range of time it covers
+func parseDate(s string) (*[2]time.Time, bool) {
+	s = strings.ToLower(s)
+	switch {
+	case dayExp.MatchString(s):
+		d, err := time.ParseInLocation("2006-01-02", s, location)
+		if err != nil {
+			return nil, false
+		}
+		return &[2]time.Time{d, d.AddDate(0, 0, 1).Add(-1)}, true
+	case monthExp.MatchString(s):
+		m, err := time.ParseInLocation("2006-01", s, location)
+		if err != nil {
+			return nil, false
+		}
+		return &[2]time.Time{m, m.AddDate(0, 1, 0).Add(-1)}, true
+	case len(s) >= 3:
+		if m, ok := monthAbbr[s[:3]]; ok && strings.HasPrefix(strings.ToLower(m.String()), s) {
+			return monthTimestampRange(m), true
+		}
+	}
+	return nil, false
+}
+
+//spanUnits maps the units a span can be given in to their period
+var spanUnits = map[string]Period{
+	"month":  Monthly,
+	"months": Monthly,
+	"week":   Weekly,
+	"weeks":  Weekly,
+}
+
+//maxSpan is the most periods a span can cover
+const maxSpan = 60
+
+//parseSpan parses a span from the start of tokens, returning it and the
+//number of tokens it took, or nil if tokens don't start with a span
+func parseSpan(tokens []token) (*Span, int) {
+	if len(tokens) < 2 || tokens[0].kind != tokWord {
+		return nil, 0
+	}
+	s := &Span{Count: 1}
+	switch strings.ToLower(tokens[0].text) {
+	case "this":
+	case "last":
+		s.Last = true
+	default:
+		return nil, 0
+	}
+	n := 1
+	if s.Last {
+		if count, err := strconv.Atoi(tokens[1].text); err == nil {
+			if count < 1 || count > maxSpan || len(tokens) < 3 {
+				return nil, 0
+			}
+			//last 6 months includes the current one
+			s.Count, s.Last = count, false
+			n++
+		}
+	}
+	unit, ok := spanUnits[strings.ToLower(tokens[n].text)]
+	if !ok || tokens[n].kind != tokWord {
+		return nil, 0
+	}
+	s.Unit = unit
+	return s, n + 1
+}
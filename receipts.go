@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//receiptsDir is where receipt photos are saved, when empty only the message
+//they were attached to is remembered
+var receiptsDir = "receipts"
+
+//SetReceiptsDir sets where receipt photos are saved
+func SetReceiptsDir(dir string) {
+	receiptsDir = dir
+}
+
+//commandText returns the text of a message, or the caption of an attachment,
+//and false if the message has neither
+func commandText(msg chat1.MsgSummary) (string, bool) {
+	switch {
+	case msg.Content.Text != nil:
+		return strings.TrimSpace(msg.Content.Text.Body), true
+	case msg.Content.Attachment != nil:
+		caption := strings.TrimSpace(msg.Content.Attachment.Object.Title)
+		return caption, caption != ""
+	}
+	return "", false
+}
+
+//fileName returns the name the receipt is saved as in receiptsDir ie: 0000f0b5-42.jpg
+func (r *Receipt) fileName() string {
+	return fmt.Sprintf("%s-%d%s", r.ConvID, r.MsgID, strings.ToLower(filepath.Ext(r.Filename)))
+}
+
+//saveReceipt downloads the photo attached to msg to receiptsDir. It returns
+//nil if nothing is attached, and a receipt without a Path if the photo
+//couldn't be saved, so it can still be found in the conversation.
+func (h *Handler) saveReceipt(msg chat1.MsgSummary) *Receipt {
+	a := msg.Content.Attachment
+	if a == nil {
+		return nil
+	}
+	r := &Receipt{msg.ConvID, msg.Channel, msg.Id, a.Object.Filename, ""}
+	if receiptsDir == "" {
+		return r
+	}
+	if err := os.MkdirAll(receiptsDir, 0700); err != nil {
+		h.Debug("saveReceipt: unable to create %s: %s", receiptsDir, err)
+		return r
+	}
+	path := filepath.Join(receiptsDir, r.fileName())
+	if err := h.Download(msg.Channel, msg.Id, path); err != nil {
+		h.Debug("saveReceipt: unable to download %v: %s", msg.Id, err)
+		return r
+	}
+	r.Path = path
+	return r
+}
+
+//receiptRecorded tells the conversation how to see the receipt of a newly
+//recorded transaction again
+func (h *Handler) receiptRecorded(convID chat1.ConvIDStr, txn Txn, id int64) {
+	if txn.Receipt != nil {
+		h.ChatEcho(convID, "Kept the receipt, see it again with `receipt %d`.", id)
+	}
+}
+
+//withReceiptFile calls fn with the path of the photo of r. Receipts that
+//weren't saved are downloaded again from the message they were sent with.
+func (h *Handler) withReceiptFile(r *Receipt, fn func(path string) error) error {
+	if r.Path != "" {
+		if _, err := os.Stat(r.Path); err == nil {
+			return fn(r.Path)
+		}
+	}
+	dir, err := ioutil.TempDir("", "kst-receipt")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, r.fileName())
+	if err := h.Download(r.Channel, r.MsgID, path); err != nil {
+		return err
+	}
+	return fn(path)
+}
+
+//postReceipt uploads the receipt of txn to the conversation
+func (h *Handler) postReceipt(convID chat1.ConvIDStr, txn *Txn) error {
+	return h.withReceiptFile(txn.Receipt, func(path string) error {
+		return h.Attach(convID, path, describeTxn(*txn))
+	})
+}
+
+//HandleReceipt posts the receipts of transactions again, in the conversation
+//they were sent in
+func (h *Handler) HandleReceipt(args *Args, msg chat1.MsgSummary) error {
+	for _, id := range args.IDs {
+		txn, err := h.db.GetTransaction(id)
+		if err != nil {
+			h.ReactError(msg)
+			return err
+		}
+		//receipts are only shown in the conversation they were sent in
+		if txn == nil || txn.Receipt == nil || txn.Receipt.ConvID != msg.ConvID {
+			h.ReactQuestion(msg)
+			h.ChatEcho(msg.ConvID, "#%d doesn't have a receipt.", id)
+			continue
+		}
+		if err := h.postReceipt(msg.ConvID, txn); err != nil {
+			h.Debug("HandleReceipt: unable to post the receipt of #%d: %s", id, err)
+			h.ReactQuestion(msg)
+			h.ChatEcho(msg.ConvID, "The receipt of #%d wasn't saved and its message can't be downloaded anymore.", id)
+		}
+	}
+	return nil
+}
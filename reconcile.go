@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//BooksCheck is the result of verifying the journal against the transactions
+type BooksCheck struct {
+	Unbalanced  []int64  //journal entries whose postings don't add up to zero
+	Mismatches  []int64  //journal entries whose postings differ from the transactions recorded with them
+	Unjournaled []Txn    //transactions recorded without a journal entry
+	Summaries   int      //period summaries recorded by older versions
+	Stale       []string //summaries that no longer match the ledger
+}
+
+//OK returns whether nothing is wrong with the books. Stale summaries are
+//ignored, so they aren't a problem.
+func (c *BooksCheck) OK() bool {
+	return len(c.Unbalanced) == 0 && len(c.Mismatches) == 0 && len(c.Unjournaled) == 0
+}
+
+//entryIDs joins the ids of journal entries ie: 3, 12
+func entryIDs(ids []int64) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = fmt.Sprint(id)
+	}
+	return strings.Join(strs, ", ")
+}
+
+//String formats the check in keybase markdown
+func (c *BooksCheck) String() string {
+	var b strings.Builder
+	b.WriteString("*Books check*\n")
+	if len(c.Unbalanced) == 0 {
+		b.WriteString(">every journal entry balances\n")
+	} else {
+		fmt.Fprintf(&b, ">*journal entries that don't balance*: %s\n", entryIDs(c.Unbalanced))
+	}
+	if len(c.Mismatches) == 0 {
+		b.WriteString(">every journal entry matches its transactions")
+	} else {
+		fmt.Fprintf(&b, ">*journal entries that don't match their transactions*: %s", entryIDs(c.Mismatches))
+	}
+	if len(c.Unjournaled) > 0 {
+		b.WriteString("\n>*transactions missing from the journal*:")
+		for _, txn := range c.Unjournaled {
+			b.WriteString("\n>" + describeTxn(txn))
+		}
+	}
+	if c.Summaries > 0 {
+		fmt.Fprintf(&b, "\n>%d period summaries from older versions are ignored", c.Summaries)
+		if len(c.Stale) > 0 {
+			b.WriteString(", these no longer match the ledger:")
+			for _, s := range c.Stale {
+				b.WriteString("\n>" + s)
+			}
+		}
+	}
+	return b.String()
+}
+
+//samePostings returns whether two entries post the same amounts to the same
+//accounts in the same order
+func samePostings(a, b Entry) bool {
+	if len(a.Postings) != len(b.Postings) {
+		return false
+	}
+	for i := range a.Postings {
+		if a.Postings[i] != b.Postings[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//CheckBooks verifies that every journal entry balances and still matches the
+//transactions it was recorded with, and that no transaction is missing from
+//the journal
+func (h *Handler) CheckBooks() (*BooksCheck, error) {
+	c := new(BooksCheck)
+	var err error
+	if c.Unbalanced, err = h.db.GetUnbalancedEntries(); err != nil {
+		return nil, err
+	}
+	entries, err := h.db.GetEntries(time.Unix(0, 0), time.Unix(0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	linked, err := h.db.GetEntryTransactions()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		txns, ok := linked[e.ID]
+		if !ok {
+			//entries recorded without transactions have nothing to match
+			continue
+		}
+		if want, _ := journalEntry(txns...); !samePostings(e, want) {
+			c.Mismatches = append(c.Mismatches, e.ID)
+		}
+	}
+	if c.Unjournaled, err = h.db.GetUnjournaledTransactions(); err != nil {
+		return nil, err
+	}
+
+	summaries, err := h.db.GetPeriodSummaries()
+	if err != nil {
+		return nil, err
+	}
+	c.Summaries = len(summaries)
+	for _, s := range summaries {
+		bal, err := h.db.GetNetWorth(s.Date.Time())
+		if err != nil {
+			return nil, err
+		}
+		if bal != s.Amount {
+			c.Stale = append(c.Stale, fmt.Sprintf("%s recorded %s, the ledger says %s", s.Date, signed(s.Amount), signed(bal)))
+		}
+	}
+	return c, nil
+}
+
+//admins are the usernames allowed to reconcile the books
+var admins = map[string]bool{}
+
+//SetAdmins sets the usernames allowed to reconcile the books
+func SetAdmins(usrs []string) {
+	admins = make(map[string]bool, len(usrs))
+	for _, usr := range usrs {
+		admins[strings.ToLower(strings.TrimSpace(usr))] = true
+	}
+}
+
+//adjustmentTag is the tag reconciliation adjustments are recorded with
+const adjustmentTag = "adjustment"
+
+//Statement compares the balance of an account on a bank statement with the
+//tracked balance
+type Statement struct {
+	Account   string
+	At        time.Time
+	Balance   USD   //the balance on the statement
+	Tracked   USD   //the balance of the account in the journal
+	Uncleared []Txn //transactions in the account that haven't shown up on a statement
+}
+
+//Difference returns how far the statement is from the tracked balance
+func (s *Statement) Difference() USD {
+	return s.Balance - s.Tracked
+}
+
+//Unexplained returns the part of the difference that the transactions that
+//haven't cleared don't account for
+func (s *Statement) Unexplained() USD {
+	d := s.Difference()
+	for _, txn := range s.Uncleared {
+		d += txn.Amount
+	}
+	return d
+}
+
+//explains returns whether txn not being on the statement yet accounts for
+//the whole difference
+func (s *Statement) explains(txn Txn) bool {
+	return s.Difference() != 0 && txn.Amount == -s.Difference()
+}
+
+//describeTxn describes a transaction with its id ie: #12 Mon Oct 12 @alice spent $5.00 on food
+func describeTxn(txn Txn) string {
+	what := ActionString(txn.Amount) + " " + strings.Join(txn.Tags, ", ")
+	if txn.Transfer {
+		what = "transferred " + txn.Amount.Abs().String() + " out"
+		if txn.Amount > 0 {
+			what = "transferred " + txn.Amount.String() + " in"
+		}
+	}
+	return fmt.Sprintf("#%d %s @%s %s", txn.ID, txn.Date, txn.User, what)
+}
+
+//String formats the comparison in keybase markdown
+func (s *Statement) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Reconciling %s as of %s*\n", s.Account, s.At.Format("Mon Jan 2 2006"))
+	fmt.Fprintf(&b, ">statement: %s\n>tracked: %s\n>difference: *%s*", signed(s.Balance), signed(s.Tracked), signed(s.Difference()))
+	if len(s.Uncleared) == 0 {
+		b.WriteString("\nEvery transaction has cleared, the difference may be a transaction that wasn't recorded.")
+		return b.String()
+	}
+	b.WriteString("\n*Not cleared yet*")
+	for _, txn := range s.Uncleared {
+		b.WriteString("\n>" + describeTxn(txn))
+		if s.explains(txn) {
+			b.WriteString(" *matches the difference*")
+		}
+	}
+	if s.Unexplained() == 0 {
+		b.WriteString("\nThe transactions that haven't cleared add up to the difference.")
+	}
+	return b.String()
+}
+
+//statementUsage is the reply when reconcile is given only part of a statement
+const statementUsage = "To reconcile with a bank statement give the account and its balance, ie: `reconcile checking 1523.44 as of 2026-10-15`"
+
+//checkAdmin replies to msg and returns false if its sender isn't an admin,
+//saying they can't do what
+func (h *Handler) checkAdmin(msg chat1.MsgSummary, what string) bool {
+	if admins[msg.Sender.Username] {
+		return true
+	}
+	h.ReactQuestion(msg)
+	h.ChatEcho(msg.ConvID, "Only admins can %s, they're listed under admins (KST_ADMINS) in the bot's config.", what)
+	return false
+}
+
+//HandleReconcile checks the books, or compares the balance of an account with
+//a bank statement. Only admins may reconcile. With adjust the part of the
+//difference the transactions that haven't cleared don't explain is recorded,
+//and once the statement matches the account's transactions are marked cleared.
+func (h *Handler) HandleReconcile(args *Args, msg chat1.MsgSummary) error {
+	if !h.checkAdmin(msg, "reconcile the books") {
+		return nil
+	}
+	adjust := len(args.Keywords) > 0
+	if args.Account == "" {
+		if args.Range != nil || adjust {
+			h.ReactQuestion(msg)
+			h.ChatEcho(msg.ConvID, "%s", statementUsage)
+			return nil
+		}
+		return h.handleCheckBooks(msg)
+	}
+	if ok, err := h.checkAccounts(msg, args.Account); err != nil || !ok {
+		return err
+	}
+	s := &Statement{Account: args.Account, At: time.Now(), Balance: args.Amount}
+	date := TimestampNow()
+	if args.Range != nil {
+		s.At = args.Range[1]
+		date = Timestamp(s.At)
+	}
+	var err error
+	if s.Tracked, err = h.db.GetAccountBalance(assetAccount(accountOf(s.Account)), s.At); err != nil {
+		return err
+	}
+	if s.Uncleared, err = h.db.GetUnclearedTransactions(s.Account, s.At); err != nil {
+		return err
+	}
+	var adjustment USD
+	if adjust && s.Difference() != 0 {
+		adjustment = s.Unexplained()
+	}
+	if adjustment != 0 {
+		txn := Txn{
+			Date:    date,
+			Amount:  adjustment,
+			Tags:    []string{adjustmentTag},
+			Note:    "reconciliation adjustment",
+			User:    msg.Sender.Username,
+			Account: accountOf(s.Account),
+			Cleared: true,
+		}
+		if err := h.db.PutTransaction(txn); err != nil {
+			h.ReactError(msg)
+			return err
+		}
+		s.Tracked += adjustment
+	}
+	if s.Difference() != 0 {
+		cmd, _ := commandText(msg)
+		hint := fmt.Sprintf("Mark the transactions on the statement with `clear %s <id>`, or record what they don't explain with `%s adjust`.",
+			s.Account, strings.TrimSuffix(cmd, " adjust"))
+		if adjust {
+			hint = fmt.Sprintf("The rest is the transactions that haven't cleared, mark the ones on the statement with `clear %s <id>` and reconcile again.", s.Account)
+		}
+		str := s.String() + "\n" + hint
+		if adjustment != 0 {
+			str = fmt.Sprintf("Recorded an adjustment of %s.\n", signed(adjustment)) + str
+		}
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "%s", str)
+		return nil
+	}
+	ids := make([]int64, len(s.Uncleared))
+	for i, txn := range s.Uncleared {
+		ids[i] = txn.ID
+	}
+	cleared, err := h.db.ClearTransactions(s.Account, ids)
+	if err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactSuccess(msg)
+	str := fmt.Sprintf("%s matches the statement, marked %d cleared.", s.Account, cleared)
+	if adjustment != 0 {
+		str = fmt.Sprintf("Recorded an adjustment of %s, ", signed(adjustment)) + str
+	}
+	h.ChatEcho(msg.ConvID, "%s", str)
+	return nil
+}
+
+//HandleClear marks transactions in an account as having shown up on a bank
+//statement. Only admins may clear transactions.
+func (h *Handler) HandleClear(args *Args, msg chat1.MsgSummary) error {
+	if !h.checkAdmin(msg, "clear transactions") {
+		return nil
+	}
+	account := strings.ToLower(args.Words[0])
+	if ok, err := h.checkAccounts(msg, account); err != nil || !ok {
+		return err
+	}
+	cleared, err := h.db.ClearTransactions(account, args.IDs)
+	if err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	if cleared < len(args.IDs) {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "Cleared %d of %d, the others are already cleared, aren't in %s or aren't transactions.", cleared, len(args.IDs), account)
+		return nil
+	}
+	h.ReactSuccess(msg)
+	return nil
+}
+
+//handleCheckBooks checks the books
+func (h *Handler) handleCheckBooks(msg chat1.MsgSummary) error {
+	c, err := h.CheckBooks()
+	if err != nil {
+		return err
+	}
+	if c.OK() {
+		h.ReactSuccess(msg)
+	} else {
+		h.ReactQuestion(msg)
+	}
+	h.ChatEcho(msg.ConvID, "%s", c.String())
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//topTagCount is how many tags are listed in a report
+const topTagCount = 5
+
+//budgets are the most that should be spent on a tag each period
+var budgets = map[string]USD{}
+
+//SetBudgets sets the most that should be spent on each tag per period
+func SetBudgets(b map[string]float64) {
+	budgets = make(map[string]USD, len(b))
+	for tag, amt := range b {
+		budgets[tag] = ToUSD(amt)
+	}
+}
+
+//Total is money in and out of the ledger over a period
+type Total struct {
+	In  USD
+	Out USD //money spent, as a positive amount
+}
+
+//Net returns the money left over after spending
+func (t Total) Net() USD {
+	return t.In - t.Out
+}
+
+//Amount is money spent on a tag or by a user
+type Amount struct {
+	Name   string
+	Amount USD
+}
+
+//BudgetStatus is how much of a tag's budget has been spent
+type BudgetStatus struct {
+	Tag    string
+	Budget USD
+	Spent  USD
+}
+
+//Report summarizes the spending of a period
+type Report struct {
+	Start    time.Time
+	End      time.Time
+	Opening  USD //the balance of every account at the start of the period
+	Closing  USD //the balance at the end of the period, or now for the current one
+	Total    Total
+	Tags     []Amount //spending per first tag, most first
+	Users    []Amount //spending per user, most first
+	Budgets  []BudgetStatus
+	Previous Total //the totals of the period before
+	LastYear Total //the totals of the same period last year
+	Insights []Insight
+}
+
+//totalOf adds up txns, returning the totals and the spending per tag and user
+func totalOf(txns []Txn) (Total, map[string]USD, map[string]USD) {
+	var t Total
+	tags, users := make(map[string]USD), make(map[string]USD)
+	for _, txn := range txns {
+		if txn.Amount >= 0 {
+			t.In += txn.Amount
+			continue
+		}
+		t.Out -= txn.Amount
+		users[txn.User] -= txn.Amount
+		//only the first tag so the shares add up to what was spent
+		if len(txn.Tags) > 0 {
+			tags[txn.Tags[0]] -= txn.Amount
+		}
+	}
+	return t, tags, users
+}
+
+//sortedAmounts returns the amounts largest first
+func sortedAmounts(m map[string]USD) []Amount {
+	amts := make([]Amount, 0, len(m))
+	for name, amt := range m {
+		amts = append(amts, Amount{name, amt})
+	}
+	sort.Slice(amts, func(i, j int) bool {
+		if amts[i].Amount == amts[j].Amount {
+			return amts[i].Name < amts[j].Name
+		}
+		return amts[i].Amount > amts[j].Amount
+	})
+	return amts
+}
+
+//openingBalance returns the balance of every account at the start of the
+//period starting at start, computed from the journal
+func (h *Handler) openingBalance(start time.Time) (USD, error) {
+	return h.db.GetNetWorth(start.Add(-time.Nanosecond))
+}
+
+//periodTotal returns the totals of the period starting at start
+func (h *Handler) periodTotal(start time.Time) (Total, error) {
+	txns, err := h.db.GetTransactions(start, period.End(start))
+	if err != nil {
+		return Total{}, err
+	}
+	t, _, _ := totalOf(txns)
+	return t, nil
+}
+
+//BuildReport summarizes the period containing t
+func (h *Handler) BuildReport(t time.Time) (*Report, error) {
+	r := &Report{Start: period.Start(t), End: period.End(t)}
+	txns, err := h.db.GetTransactions(r.Start, r.End)
+	if err != nil {
+		return nil, err
+	}
+	var tags, users map[string]USD
+	r.Total, tags, users = totalOf(txns)
+	r.Tags = sortedAmounts(tags)
+	if len(r.Tags) > topTagCount {
+		r.Tags = r.Tags[:topTagCount]
+	}
+	r.Users = sortedAmounts(users)
+	if r.Opening, err = h.openingBalance(r.Start); err != nil {
+		return nil, err
+	}
+	if r.Closing, err = h.db.GetNetWorth(r.End); err != nil {
+		return nil, err
+	}
+
+	budgetTags := make([]string, 0, len(budgets))
+	for tag := range budgets {
+		budgetTags = append(budgetTags, tag)
+	}
+	sort.Strings(budgetTags)
+	//budgets are spent from the same first tag totals as the top tags
+	for _, tag := range budgetTags {
+		r.Budgets = append(r.Budgets, BudgetStatus{tag, budgets[tag], tags[tag]})
+	}
+
+	if r.Previous, err = h.periodTotal(period.Previous(r.Start)); err != nil {
+		return nil, err
+	}
+	if r.LastYear, err = h.periodTotal(period.Start(r.Start.AddDate(-1, 0, 0))); err != nil {
+		return nil, err
+	}
+	if r.Insights, err = h.Analyze(t); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//signed formats an amount with its sign in front of the currency symbol
+func signed(m USD) string {
+	if m < 0 {
+		return "-" + m.Abs().String()
+	}
+	return m.String()
+}
+
+//change describes how spending compares to an earlier total
+func change(out USD, earlier Total) string {
+	if earlier.In == 0 && earlier.Out == 0 {
+		return "no transactions"
+	}
+	str := fmt.Sprintf("spent %s", earlier.Out)
+	if earlier.Out > 0 {
+		str += fmt.Sprintf(", %+.1f%% this period", (out.InDollars()/earlier.Out.InDollars()-1)*100)
+	}
+	return str
+}
+
+//String formats the report in keybase markdown
+func (r *Report) String() string {
+	var b strings.Builder
+	title := r.Start.Format("January 2006")
+	if period == Weekly {
+		title = "week of " + r.Start.Format("Mon Jan 2")
+	}
+	fmt.Fprintf(&b, "*Spending report for %s*\n", title)
+	fmt.Fprintf(&b, ">in: %s\n>out: %s\n>net: *%s*\n", r.Total.In, r.Total.Out, signed(r.Total.Net()))
+	fmt.Fprintf(&b, ">balance: %s to %s\n", signed(r.Opening), signed(r.Closing))
+
+	if len(r.Tags) > 0 {
+		b.WriteString("*Top tags*\n")
+		for _, t := range r.Tags {
+			fmt.Fprintf(&b, ">%s: %s (%.1f%%)\n", t.Name, t.Amount, t.Amount.InDollars()/r.Total.Out.InDollars()*100)
+		}
+	}
+	if len(r.Users) > 0 {
+		b.WriteString("*By user*\n")
+		for _, u := range r.Users {
+			fmt.Fprintf(&b, ">@%s: %s\n", u.Name, u.Amount)
+		}
+	}
+	if len(r.Budgets) > 0 {
+		b.WriteString("*Budgets*\n")
+		for _, s := range r.Budgets {
+			status := fmt.Sprintf("%s left", s.Budget-s.Spent)
+			if s.Spent > s.Budget {
+				status = fmt.Sprintf("*over by %s*", s.Spent-s.Budget)
+			}
+			fmt.Fprintf(&b, ">%s: %s of %s, %s\n", s.Tag, s.Spent, s.Budget, status)
+		}
+	}
+	b.WriteString("*Compared to*\n")
+	fmt.Fprintf(&b, ">previous period: %s\n", change(r.Total.Out, r.Previous))
+	fmt.Fprintf(&b, ">same period last year: %s", change(r.Total.Out, r.LastYear))
+	if len(r.Insights) > 0 {
+		b.WriteString("\n*Insights*")
+		for _, in := range r.Insights {
+			b.WriteString("\n>" + in.Message)
+		}
+	}
+	return b.String()
+}
+
+//HandleReport shows the report for the current or previous period
+func (h *Handler) HandleReport(args *Args, msg chat1.MsgSummary) error {
+	t := time.Now()
+	if len(args.Keywords) > 0 {
+		t = period.Previous(t)
+	}
+	r, err := h.BuildReport(t)
+	if err != nil {
+		return err
+	}
+	h.ChatEcho(msg.ConvID, "%s", r.String())
+	return nil
+}
+
+//PostReport posts the report of the period containing t to every ledger
+func (h *Handler) PostReport(t time.Time) error {
+	r, err := h.BuildReport(t)
+	if err != nil {
+		return err
+	}
+	ledgers, err := h.db.GetLedgers()
+	if err != nil {
+		return err
+	}
+	report := r.String()
+	for _, l := range ledgers {
+		h.ChatEcho(l.ConvID, "%s", report)
+	}
+	return nil
+}
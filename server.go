@@ -1,57 +1,135 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"golang.org/x/sync/errgroup"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type Server struct {
 	*Output
 	sync.Mutex
-	shutdownCh chan struct{}
-	kbc        *kbchat.API
-	Users      AuthorizedUsers
+	kbc     *kbchat.API
+	runOpts kbchat.RunOptions
+	health  Health
+	Users   AuthorizedUsers
 }
 
+//SetUsers replaces the authorized users. It is safe to call while listening.
 func (s *Server) SetUsers(users AuthorizedUsers) {
+	s.Lock()
 	s.Users = users
+	s.Unlock()
+}
+
+//keybase returns the current keybase connection, which is replaced when keybase restarts
+func (s *Server) keybase() *kbchat.API {
+	s.Lock()
+	defer s.Unlock()
+	return s.kbc
 }
 
 func (s *Server) IsUser(username string) bool {
+	s.Lock()
+	defer s.Unlock()
 	_, ok := s.Users[username]
 	return ok
 }
 
+//LoadUsers parses the authorized users string and sets the authorized users,
+//resolving any teams through the keybase connection.
+func (s *Server) LoadUsers(usrstr string) error {
+	l, err := ParseUserList(usrstr)
+	if err != nil {
+		return err
+	}
+	var tl TeamLister
+	if kbc := s.keybase(); kbc != nil {
+		tl = kbc
+	}
+	users, err := l.Resolve(tl)
+	if err != nil {
+		return err
+	}
+	s.SetUsers(users)
+	s.Debug("authorized %d users", len(users))
+	return nil
+}
+
+//ReloadUsersOnHangup reloads the authorized users each time the process
+//receives a SIGHUP. usrstr is called on every reload so the users string
+//can be re-read from its source. The previous users are kept if reloading fails.
+func (s *Server) ReloadUsersOnHangup(usrstr func() string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.Debug("SIGHUP: reloading authorized users")
+			if err := s.LoadUsers(usrstr()); err != nil {
+				s.Debug("SIGHUP: failed to reload authorized users, keeping current users: %s", err)
+			}
+		}
+	}()
+}
+
 func (s *Server) Start(keybaseLoc, home string, ErrorConvId string) (kbc *kbchat.API, err error) {
-	if s.kbc, err = kbchat.Start(kbchat.RunOptions{
+	s.runOpts = kbchat.RunOptions{
 		KeybaseLocation: keybaseLoc,
 		HomeDir:         home,
-	}); err != nil {
+	}
+	if s.kbc, err = kbchat.Start(s.runOpts); err != nil {
 		return s.kbc, err
 	}
 	s.Output = NewDebugOutput("server", s.kbc, ErrorConvId)
+	s.setHealth(HealthStarting, nil)
 	return s.kbc, nil
 }
 
-func (s *Server) Listen(handler Handler) error {
-	sub, err := s.kbc.Listen(kbchat.ListenOptions{Convs: true})
+//subscription is the part of a kbchat subscription the listeners read from
+type subscription interface {
+	Read() (kbchat.SubscriptionMessage, error)
+	ReadNewConvs() (kbchat.SubscriptionConversation, error)
+	Shutdown()
+}
+
+//Listen handles messages and new conversations until ctx is cancelled or the
+//subscription fails. Commands already read when ctx is cancelled are handled
+//before Listen returns. Messages sent since the bot last listened are replayed first.
+func (s *Server) Listen(ctx context.Context, handler Handler) error {
+	sub, err := s.keybase().Listen(kbchat.ListenOptions{Convs: true})
 	if err != nil {
 		s.Debug("Listen: failed to listen: %s", err)
 		return err
 	}
+	s.setHealth(HealthConnected, nil)
+	if err := handler.Advertise(); err != nil {
+		s.Debug("Listen: failed to advertise commands: %s", err)
+	}
 	s.Debug("startup success, listening for messages and convs...")
-	s.Lock()
-	shutdownCh := s.shutdownCh
-	s.Unlock()
-	var eg errgroup.Group
-	eg.Go(func() error { return s.listenForMsgs(shutdownCh, sub, handler) })
-	eg.Go(func() error { return s.listenForConvs(shutdownCh, sub, handler) })
-	eg.Go(func() error { return s.waitToBalance(shutdownCh, handler, EndOfMonth(), nil) })
+	s.replay(handler)
+	return s.serve(ctx, sub, handler)
+}
+
+func (s *Server) serve(ctx context.Context, sub subscription, handler Handler) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	//reads block until the subscription is shut down
+	eg.Go(func() error {
+		<-ctx.Done()
+		sub.Shutdown()
+		return nil
+	})
+	eg.Go(func() error { return s.listenForMsgs(ctx, sub, handler) })
+	eg.Go(func() error { return s.listenForConvs(ctx, sub, handler) })
+	eg.Go(func() error { return s.waitToBalance(ctx, handler, EndOfPeriod(), nil) })
+	eg.Go(func() error { return s.analyzeInBackground(ctx, handler, insightsInterval) })
 	if err := eg.Wait(); err != nil {
 		s.Debug("wait error: %s", err)
 		return err
@@ -60,54 +138,73 @@ func (s *Server) Listen(handler Handler) error {
 	return nil
 }
 
-func (s *Server) listenForMsgs(shutdownCh chan struct{}, sub *kbchat.NewSubscription, handler Handler) error {
-	for {
-		select {
-		case <-shutdownCh:
-			s.Debug("listenForMsgs: shutting down")
-			return nil
-		default:
-		}
+//Shutdown stops the keybase service started by Start
+func (s *Server) Shutdown() error {
+	return s.keybase().Shutdown()
+}
 
+func (s *Server) listenForMsgs(ctx context.Context, sub subscription, handler Handler) error {
+	for {
 		m, err := sub.Read()
 		if err != nil {
-			s.Debug("listenForMsgs: Read() error: %s", err)
-			continue
-		}
-		usr := m.Message.Sender.Username
-		if !s.IsUser(usr) {
-			if usr != os.Getenv("KEYBASE_USERNAME") {
-				s.Debug("Ignoring message from %s", usr)
+			if ctx.Err() != nil {
+				s.Debug("listenForMsgs: shutting down")
+				return nil
 			}
-			continue
+			return fmt.Errorf("listenForMsgs: Read() error: %v", err)
 		}
+		s.handleMsg(handler, m.Message)
+	}
+}
 
-		msg := m.Message
-		s.Debug("convid = %v", m.Conversation.Id)
-		if err := handler.HandleCommand(msg); err != nil {
-			s.ChatDebug(msg.ConvID, "listenForMsgs: unable to HandleCommand: %v", err)
+//handleMsg handles a message from an authorized user. Each message is only
+//handled once, it's marked as seen before handling so a crash mid-command
+//can't cause it to be replayed and recorded twice.
+func (s *Server) handleMsg(handler Handler, msg chat1.MsgSummary) {
+	isNew, err := handler.Seen(msg)
+	if err != nil {
+		s.Debug("handleMsg: unable to record message as seen: %s", err)
+	} else if !isNew {
+		return
+	}
+	usr := msg.Sender.Username
+	if !s.IsUser(usr) {
+		if usr != os.Getenv("KEYBASE_USERNAME") {
+			s.Debug("Ignoring message from %s", usr)
 		}
+		return
 	}
-}
 
-func (s *Server) listenForConvs(shutdownCh chan struct{}, sub *kbchat.NewSubscription, handler Handler) error {
-	for {
-		select {
-		case <-shutdownCh:
-			s.Debug("listenForConvs: shutting down")
-			return nil
-		default:
+	s.Debug("convid = %v", msg.ConvID)
+	if msg.Content.TypeName == "reaction" {
+		if err := handler.HandleReaction(msg); err != nil {
+			s.ChatDebug(msg.ConvID, "listenForMsgs: unable to HandleReaction: %v", err)
 		}
+		return
+	}
+	if err := handler.HandleCommand(msg); err != nil {
+		s.ChatDebug(msg.ConvID, "listenForMsgs: unable to HandleCommand: %v", err)
+	}
+}
 
+func (s *Server) listenForConvs(ctx context.Context, sub subscription, handler Handler) error {
+	for {
 		c, err := sub.ReadNewConvs()
 		if err != nil {
-			s.Debug("listenForConvs: ReadNewConvs() error: %s", err)
-			continue
+			if ctx.Err() != nil {
+				s.Debug("listenForConvs: shutting down")
+				return nil
+			}
+			return fmt.Errorf("listenForConvs: ReadNewConvs() error: %v", err)
 		}
 
-		if !s.IsUser(c.Conversation.CreatorInfo.Username) {
-			s.Debug("Ignored new conversation created by %s", c.Conversation.CreatorInfo.Username)
-			return nil
+		var creator string
+		if c.Conversation.CreatorInfo != nil {
+			creator = c.Conversation.CreatorInfo.Username
+		}
+		if !s.IsUser(creator) {
+			s.Debug("Ignored new conversation created by %s", creator)
+			continue
 		}
 
 		if err := handler.HandleNewConv(c.Conversation); err != nil {
@@ -116,24 +213,22 @@ func (s *Server) listenForConvs(shutdownCh chan struct{}, sub *kbchat.NewSubscri
 	}
 }
 
-func (s *Server) waitToBalance(shutdownCh chan struct{}, handler Handler, startTrigger time.Time, heartbeat chan struct{}) error {
+func (s *Server) waitToBalance(ctx context.Context, handler Handler, startTrigger time.Time, heartbeat chan struct{}) error {
 	triggerTime := startTrigger
 	for {
 		select {
-		case <-shutdownCh:
-			s.Debug("listenForConvs: shutting down")
+		case <-ctx.Done():
+			s.Debug("waitToBalance: shutting down")
 			return nil
-		default:
+		case <-time.After(time.Until(triggerTime)):
 		}
-		if time.Now().After(triggerTime) {
-			err := handler.HandleMonthSummary(triggerTime.Month())
-			if err != nil {
-				return errors.New(fmt.Sprint("error handling month summary:", err))
-			}
-			triggerTime = EndOfMonth()
-			if heartbeat != nil {
-				heartbeat <- struct{}{}
-			}
+		err := handler.HandlePeriodSummary(triggerTime)
+		if err != nil {
+			return errors.New(fmt.Sprint("error handling period summary:", err))
+		}
+		triggerTime = EndOfPeriod()
+		if heartbeat != nil {
+			heartbeat <- struct{}{}
 		}
 	}
 }
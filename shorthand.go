@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//shorthandSetting is the per user setting that enables shorthand entry
+const shorthandSetting = "shorthand"
+
+//shorthandGrammar is what follows the amount of a shorthand transaction
+var shorthandGrammar = grammar{optional(keyword("on|for|from")), tags(), optional(note())}
+
+//shorthand is a transaction entered without a trigger word
+type shorthand struct {
+	Args      *Args
+	Spent     bool //whether the amount was spent or received
+	Ambiguous bool //whether the amount was unsigned, so spent was assumed
+}
+
+//Command returns the full command the shorthand stands for
+func (s *shorthand) Command() string {
+	cmd := fmt.Sprintf("received %.2f from %s", s.Args.Amount.InDollars(), strings.Join(s.Args.Tags, ", "))
+	if s.Spent {
+		cmd = fmt.Sprintf("spent %.2f on %s", s.Args.Amount.InDollars(), strings.Join(s.Args.Tags, ", "))
+	}
+	if s.Args.Note != "" {
+		cmd += fmt.Sprintf(" %q", s.Args.Note)
+	}
+	return cmd
+}
+
+//parseShorthand parses transactions like -12 food lunch, +500 salary and
+//12.50 coffee. It returns nil if input doesn't start with an amount.
+func parseShorthand(input string) (*shorthand, error) {
+	tokens, err := lex(input)
+	if err != nil || len(tokens) == 0 || tokens[0].kind != tokWord {
+		return nil, err
+	}
+	sign, amtstr := "", tokens[0].text
+	if strings.HasPrefix(amtstr, "+") || strings.HasPrefix(amtstr, "-") {
+		sign, amtstr = amtstr[:1], amtstr[1:]
+	}
+	if !amountExp.MatchString(amtstr) {
+		return nil, nil
+	}
+	amt, err := StringToUSD(strings.Replace(strings.TrimPrefix(amtstr, "$"), ",", "", -1))
+	if err != nil {
+		return nil, nil
+	}
+	args, err := shorthandGrammar.parse(input, tokens[1:])
+	if err != nil {
+		return nil, err
+	}
+	args.Amount = amt
+	return &shorthand{
+		Args:      args,
+		Spent:     sign != "+",
+		Ambiguous: sign == "",
+	}, nil
+}
+
+//HandleShorthandSetting turns shorthand entry on or off for the sender
+func (h *Handler) HandleShorthandSetting(args *Args, msg chat1.MsgSummary) error {
+	if err := h.db.PutSetting(msg.Sender.Username, shorthandSetting, args.Keywords[0]); err != nil {
+		h.ReactError(msg)
+		return err
+	}
+	h.ReactSuccess(msg)
+	return nil
+}
+
+//shorthandEnabled returns whether usr has turned shorthand entry on
+func (h *Handler) shorthandEnabled(usr string) (bool, error) {
+	val, err := h.db.GetSetting(usr, shorthandSetting)
+	return val == "on", err
+}
+
+//handleShorthand records a shorthand transaction if the message is one.
+//Unsigned amounts are assumed to be spent and have to be confirmed first.
+func (h *Handler) handleShorthand(cmdstring string, msg chat1.MsgSummary) error {
+	enabled, err := h.shorthandEnabled(msg.Sender.Username)
+	if err != nil || !enabled {
+		return err
+	}
+	s, err := parseShorthand(cmdstring)
+	if err != nil {
+		//it started with an amount, but wasn't a transaction
+		h.Debug("handleShorthand: not a transaction: %s", err)
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+	if s.Ambiguous {
+		return h.confirm(spentTxn(s.Args, msg), msg, fmt.Sprintf("the amount had no sign, so I took it as `%s`", s.Command()))
+	}
+	if s.Spent {
+		return h.HandleSpent(s.Args, msg)
+	}
+	return h.HandleReceived(s.Args, msg)
+}
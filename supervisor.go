@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+//healthyAfter is how long a connection must last before the backoff is reset
+const healthyAfter = time.Minute
+
+//Backoff computes exponentially increasing delays between reconnection attempts
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+
+	attempt int
+}
+
+//Next returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := float64(b.Min)
+	for i := 0; i < b.attempt; i++ {
+		d *= b.Factor
+		if d >= float64(b.Max) {
+			return b.Max
+		}
+	}
+	b.attempt++
+	return time.Duration(d)
+}
+
+//Reset starts the delays over from Min
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+//HealthState describes the state of the keybase connection
+type HealthState string
+
+const (
+	HealthStarting     HealthState = "starting"
+	HealthConnected    HealthState = "connected"
+	HealthReconnecting HealthState = "reconnecting"
+	HealthStopped      HealthState = "stopped"
+)
+
+//Health is a snapshot of the keybase connection's state for operators
+type Health struct {
+	State      HealthState
+	Since      time.Time //when State was entered
+	LastError  string    //the error that caused the last reconnect
+	Reconnects int       //successful reconnects since startup
+}
+
+//String returns a one line description of the health
+func (h Health) String() string {
+	str := fmt.Sprintf("%s since %s, %d reconnects", h.State, h.Since.Format(time.RFC3339), h.Reconnects)
+	if h.LastError != "" {
+		str += ", last error: " + h.LastError
+	}
+	return str
+}
+
+//Health returns the current state of the keybase connection
+func (s *Server) Health() Health {
+	s.Lock()
+	defer s.Unlock()
+	return s.health
+}
+
+func (s *Server) setHealth(state HealthState, err error) {
+	s.Lock()
+	s.health.State = state
+	s.health.Since = time.Now()
+	if err != nil {
+		s.health.LastError = err.Error()
+	}
+	if state == HealthConnected && s.health.LastError != "" {
+		s.health.Reconnects++
+	}
+	h := s.health
+	s.Unlock()
+	s.Debug("health: %s", h)
+	//let operators know about outages once there's a connection to tell them with
+	if state == HealthConnected && h.Reconnects > 0 && s.ErrReportConv != "" {
+		s.ChatEcho(chat1.ConvIDStr(s.ErrReportConv), "reconnected to keybase after an outage: %s", h.LastError)
+	}
+}
+
+//healthSource is where the handler reads the health of the connection it
+//replies through, set by the server running it
+type healthSource struct {
+	sync.Mutex
+	health func() Health
+}
+
+//SetHealth sets where the health command reads the connection's health from
+func (h *Handler) SetHealth(health func() Health) {
+	h.health.Lock()
+	h.health.health = health
+	h.health.Unlock()
+}
+
+//HandleHealth replies with the state of the keybase connection
+func (h *Handler) HandleHealth(args *Args, msg chat1.MsgSummary) error {
+	h.health.Lock()
+	health := h.health.health
+	h.health.Unlock()
+	if health == nil {
+		h.ReactQuestion(msg)
+		h.ChatEcho(msg.ConvID, "%s", "The keybase connection isn't being supervised.")
+		return nil
+	}
+	h.ChatEcho(msg.ConvID, "keybase connection: %s", health())
+	return nil
+}
+
+//Run listens until ctx is cancelled. Whenever the subscription fails keybase
+//is restarted with exponential backoff and messages sent during the outage
+//are replayed.
+func (s *Server) Run(ctx context.Context, handler Handler) error {
+	handler.SetHealth(s.Health)
+	b := Backoff{Min: time.Second, Max: 5 * time.Minute, Factor: 2}
+	for {
+		started := time.Now()
+		err := s.Listen(ctx, handler)
+		if ctx.Err() != nil {
+			s.setHealth(HealthStopped, nil)
+			return nil
+		}
+		if time.Since(started) > healthyAfter {
+			b.Reset()
+		}
+		s.setHealth(HealthReconnecting, err)
+
+		delay := b.Next()
+		s.Debug("Run: reconnecting in %s", delay)
+		select {
+		case <-ctx.Done():
+			s.setHealth(HealthStopped, nil)
+			return nil
+		case <-time.After(delay):
+		}
+		if err := s.restart(handler); err != nil {
+			s.Debug("Run: failed to restart keybase: %s", err)
+			continue
+		}
+	}
+}
+
+//restart stops the current keybase process and starts a new one,
+//pointing the server and handler at the new connection
+func (s *Server) restart(handler Handler) error {
+	if old := s.keybase(); old != nil {
+		if err := old.Shutdown(); err != nil {
+			s.Debug("restart: error shutting down previous keybase: %s", err)
+		}
+	}
+	kbc, err := kbchat.Start(s.runOpts)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.kbc = kbc
+	s.Unlock()
+	s.SetAPI(kbc)
+	handler.SetAPI(kbc)
+	return nil
+}
+
+//replay handles the messages sent to every known conversation since the
+//last message the bot processed in it
+func (s *Server) replay(handler Handler) {
+	cursors, err := handler.Cursors()
+	if err != nil {
+		s.Debug("replay: unable to load cursors: %s", err)
+		return
+	}
+	var n int
+	for _, c := range cursors {
+		msgs, err := missedMessages(s.pageReader(c.ConvID), c.MsgID)
+		if err != nil {
+			s.Debug("replay: unable to read conversation %s, messages sent while the bot was down were not handled: %s", c.ConvID, err)
+			continue
+		}
+		for _, msg := range msgs {
+			s.handleMsg(handler, msg)
+			n++
+		}
+	}
+	if n > 0 {
+		s.Debug("replay: replayed %d missed messages", n)
+	}
+}
+
+//replayPageSize is how many messages are read at a time while replaying
+const replayPageSize = 100
+
+//pageReader reads a page of a conversation, newest first. next is empty for
+//the latest page, or the token the previous page was returned with.
+type pageReader func(next string) (*chat1.Thread, error)
+
+//pageReader returns a pageReader for a conversation. The chat api's read
+//method is used directly since kbchat's readers don't paginate.
+func (s *Server) pageReader(convID chat1.ConvIDStr) pageReader {
+	return func(next string) (*chat1.Thread, error) {
+		input, err := json.Marshal(map[string]interface{}{
+			"method": "read",
+			"params": map[string]interface{}{"options": map[string]interface{}{
+				"conversation_id": convID,
+				"pagination":      chat1.Pagination{Num: replayPageSize, Next: next},
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		out, err := s.keybase().Command("chat", "api", "-m", string(input))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, out)
+		}
+		var res kbchat.Thread
+		if err := json.Unmarshal(out, &res); err != nil {
+			return nil, err
+		}
+		if res.Error != nil {
+			return nil, errors.New(res.Error.Message)
+		}
+		return &res.Result, nil
+	}
+}
+
+//missedMessages pages back through a conversation until it reaches the
+//message with the given id, and returns every message after it of any kind,
+//oldest first
+func missedMessages(read pageReader, after chat1.MessageID) ([]chat1.MsgSummary, error) {
+	var missed []chat1.MsgSummary
+	next := ""
+	for {
+		page, err := read(next)
+		if err != nil {
+			return nil, err
+		}
+		reached := false
+		for _, m := range page.Messages {
+			if m.Msg == nil {
+				continue
+			}
+			if m.Msg.Id <= after {
+				reached = true
+				continue
+			}
+			missed = append(missed, *m.Msg)
+		}
+		if reached || len(page.Messages) == 0 || page.Pagination == nil || page.Pagination.Last || page.Pagination.Next == "" {
+			break
+		}
+		next = page.Pagination.Next
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].Id < missed[j].Id })
+	return missed, nil
+}
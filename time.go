@@ -20,6 +20,101 @@ var monthAbbr = map[string]time.Month{
 	"dec": 12,
 }
 
+//location is the timezone month and period boundaries are calculated in
+var location = time.Local
+
+//SetLocation sets the timezone month and period boundaries are calculated in
+func SetLocation(loc *time.Location) {
+	location = loc
+}
+
+//now returns the current time in the configured location
+func now() time.Time {
+	return time.Now().In(location)
+}
+
+//Period is the length of a budgeting period
+type Period string
+
+const (
+	Monthly Period = "monthly"
+	Weekly  Period = "weekly"
+)
+
+//period is the configured budgeting period
+var period = Monthly
+
+//SetPeriod sets the budgeting period used for balances and summaries
+func SetPeriod(p Period) {
+	period = p
+}
+
+//Valid returns whether p is a supported period
+func (p Period) Valid() bool {
+	return p == Monthly || p == Weekly
+}
+
+//Start returns the first nanosecond of the period containing t.
+//Weekly periods start on monday.
+func (p Period) Start(t time.Time) time.Time {
+	t = t.In(location)
+	if p == Weekly {
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, location)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+}
+
+//Next returns the start of the period following the one containing t
+func (p Period) Next(t time.Time) time.Time {
+	start := p.Start(t)
+	if p == Weekly {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+//Previous returns the start of the period before the one containing t
+func (p Period) Previous(t time.Time) time.Time {
+	return p.Start(p.Start(t).Add(-1))
+}
+
+//Unit returns the name of a single period ie: month
+func (p Period) Unit() string {
+	if p == Weekly {
+		return "week"
+	}
+	return "month"
+}
+
+//End returns the last nanosecond of the period containing t
+func (p Period) End(t time.Time) time.Time {
+	return p.Next(t).Add(-1)
+}
+
+//StartOfPeriod returns the start of the current budgeting period
+func StartOfPeriod() time.Time {
+	return period.Start(time.Now())
+}
+
+//EndOfPeriod returns the end of the current budgeting period
+func EndOfPeriod() time.Time {
+	return period.End(time.Now())
+}
+
+//rangeTitle describes the time between start and end ie: October 2026 or Oct 5 - Oct 11 2026
+func rangeTitle(start, end time.Time) string {
+	switch {
+	case start.Day() == 1 && end.Equal(start.AddDate(0, 1, 0).Add(-1)):
+		return start.Format("January 2006")
+	case end.Equal(start.AddDate(0, 0, 1).Add(-1)):
+		return start.Format("Mon Jan 2 2006")
+	case start.Year() == end.Year():
+		return start.Format("Jan 2") + " - " + end.Format("Jan 2 2006")
+	}
+	return start.Format("Jan 2 2006") + " - " + end.Format("Jan 2 2006")
+}
+
 //Timestamp is a time.Time with custom json Marshaling/Unmarshaling
 type Timestamp time.Time
 
@@ -63,19 +158,19 @@ func (t *Timestamp) Json() (string, error) {
 
 //StartOfMonth returns a timestamp of the first at 12am of the current month
 func StartOfMonth() time.Time {
-	return MonthStart(time.Now().Month())
+	return MonthStart(now().Month())
 }
 
 func EndOfMonth() time.Time {
-	return MonthEnd(time.Now().Month())
+	return MonthEnd(now().Month())
 }
 
 func MonthStart(m time.Month) time.Time {
-	return time.Date(time.Now().Year(), m, 1, 0, 0, 0, 0, time.UTC)
+	return time.Date(now().Year(), m, 1, 0, 0, 0, 0, location)
 }
 
 func MonthEnd(m time.Month) time.Time {
-	return time.Date(time.Now().Year(), m+1, 0, 11, 59, 59, 999999999, time.UTC)
+	return time.Date(now().Year(), m+1, 0, 23, 59, 59, 999999999, location)
 }
 
 func MonthRangeFromString(m string) (*[2]time.Time, bool) {
@@ -87,7 +182,7 @@ func MonthRangeFromString(m string) (*[2]time.Time, bool) {
 }
 
 func CurrentMonthRange() *[2]time.Time {
-	return monthTimestampRange(time.Now().Month())
+	return monthTimestampRange(now().Month())
 }
 
 //monthTimestampRange returns a slice of two timestamps representing the first nanosecond